@@ -1,24 +1,35 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 // JSONResponse a struct to ensure responses are in a consistent format
 type JSONResponse struct {
-	Status    string   `json:"status"`
-	Error     string   `json:"error,omitempty"`
-	Message   string   `json:"message,omitempty"`
-	Version   string   `json:"version,omitempty"`
-	NextToken string   `json:"nextToken,omitempty"`
-	Items     []string `json:"items,omitempty"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	NextToken string            `json:"nextToken,omitempty"`
+	Items     []string          `json:"items,omitempty"`
+	Object    *ObjectInfo       `json:"object,omitempty"`
+	History   []VersionChange   `json:"history,omitempty"`
+	Trash     []TrashEntry      `json:"trash,omitempty"`
+	Versions  []VersionListing  `json:"versions,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Category  *Category         `json:"category,omitempty"`
 }
 
 // RequestVars an object to hold the parameters from a request
@@ -28,9 +39,16 @@ type RequestVars struct {
 	ObjectPath    string
 	ObjectVersion string
 	Dev           bool
-	Token         string
+	// Channel the release channel requested with ?channel=, dev for ?dev=true, otherwise prod
+	Channel string
+	Token   string
+	// Tag the tag requested as object@tag, or in the tags routes
+	Tag string
 }
 
+// userMetadataPrefix prefix of the headers holding user supplied object metadata
+const userMetadataPrefix = "X-Object-Meta-"
+
 // API the api object, which has a router and the object controller
 type API struct {
 	Objects *ObjectController
@@ -46,6 +64,12 @@ func processRequest(req *http.Request) *RequestVars {
 	dev := req.URL.Query().Get("dev")
 	devParam := strings.ToLower(dev) == "true"
 	token := req.URL.Query().Get("token")
+	channel := req.URL.Query().Get("channel")
+	if len(channel) == 0 && devParam {
+		channel = DevChannel
+	} else if len(channel) == 0 {
+		channel = ProdChannel
+	}
 
 	return &RequestVars{
 		CategoryName:  categoryName,
@@ -53,7 +77,234 @@ func processRequest(req *http.Request) *RequestVars {
 		ObjectPath:    fmt.Sprintf("%s/%s", categoryName, objectName),
 		ObjectVersion: objectVersion,
 		Dev:           devParam,
+		Channel:       channel,
 		Token:         token,
+		Tag:           routeVars["tag"],
+	}
+}
+
+// objectMetadataFromRequest collects the metadata to store with an uploaded object from the request headers
+func objectMetadataFromRequest(req *http.Request) *ObjectMetadata {
+	metadata := &ObjectMetadata{
+		ContentType:     req.Header.Get("Content-Type"),
+		ContentEncoding: req.Header.Get("Content-Encoding"),
+	}
+	// curl and other clients send a form content type by default, which says nothing about the object.
+	// leave it empty so the content type is sniffed instead
+	mediaType, _, _ := mime.ParseMediaType(metadata.ContentType)
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		metadata.ContentType = ""
+	}
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, userMetadataPrefix) && len(name) > len(userMetadataPrefix) {
+			if metadata.UserMetadata == nil {
+				metadata.UserMetadata = make(map[string]string)
+			}
+			metadata.UserMetadata[strings.ToLower(name[len(userMetadataPrefix):])] = values[0]
+		}
+	}
+	return metadata
+}
+
+// checksumsFromRequest collects the checksums uploaded content is expected to have from the
+// X-Checksum-Sha256 (hex), Content-MD5 (base64) and Digest (RFC 3230 SHA-256 and MD5) headers,
+// and the size it is expected to have from the Content-Length header
+func checksumsFromRequest(req *http.Request) (*ContentChecksums, error) {
+	checksums := &ContentChecksums{}
+	if req.ContentLength > 0 {
+		checksums.Length = req.ContentLength
+	}
+	invalid := func(header string) error {
+		return RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Invalid %s header", header)}
+	}
+
+	if value := req.Header.Get("X-Checksum-Sha256"); len(value) > 0 {
+		sum, err := hex.DecodeString(value)
+		if err != nil || len(sum) != 32 {
+			return nil, invalid("X-Checksum-Sha256")
+		}
+		checksums.SHA256 = sum
+	}
+	if value := req.Header.Get("Content-MD5"); len(value) > 0 {
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != 16 {
+			return nil, invalid("Content-MD5")
+		}
+		checksums.MD5 = sum
+	}
+	for _, digest := range strings.Split(strings.Join(req.Header["Digest"], ","), ",") {
+		parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		// other digest algorithms are ignored
+		var checksum *[]byte
+		var size int
+		switch strings.ToLower(parts[0]) {
+		case "sha-256":
+			checksum, size = &checksums.SHA256, 32
+		case "md5":
+			checksum, size = &checksums.MD5, 16
+		default:
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(sum) != size {
+			return nil, invalid("Digest")
+		}
+		// a Digest disagreeing with the other checksum headers can never be satisfied
+		if len(*checksum) > 0 && string(*checksum) != string(sum) {
+			return nil, RequestError{StatusCode: http.StatusBadRequest, Message: "Digest header does not agree with the other checksum headers"}
+		}
+		*checksum = sum
+	}
+	return checksums, nil
+}
+
+// setVersionHeaders sets the X-Object-Version, ETag and Digest response headers for an object version.
+// The ETag is the SHA-256 of the content, or for versions uploaded before checksums were recorded
+// the version name, which is just as strong as versions are never overwritten
+func setVersionHeaders(res http.ResponseWriter, object *ObjectReader) {
+	res.Header().Set("X-Object-Version", object.Version)
+	sum, err := hex.DecodeString(object.Checksum)
+	if len(object.Checksum) == 0 || err != nil {
+		res.Header().Set("ETag", fmt.Sprintf("\"version-%x\"", object.Version))
+		return
+	}
+	res.Header().Set("ETag", fmt.Sprintf("\"%s\"", object.Checksum))
+	res.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+}
+
+// requesterHeader header identifying who made a request, recorded with default version changes
+const requesterHeader = "X-Requester"
+
+// reservedVersions version names that can not be added as they are routes of their own
+var reservedVersions = map[string]bool{"versions": true, "history": true, "rollback": true, "resolve": true, "promote": true, "tags": true}
+
+// asOfFromRequest reads the asOf query param, the RFC3339 time to resolve default versions at.
+// the zero time is returned if it is not set
+func asOfFromRequest(req *http.Request) (time.Time, error) {
+	param := req.URL.Query().Get("asOf")
+	if len(param) == 0 {
+		return time.Time{}, nil
+	}
+	asOf, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		return time.Time{}, RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("asOf must be an RFC3339 time. %s", err.Error())}
+	}
+	return asOf, nil
+}
+
+// constraintFromRequest reads the constraint query param, the semantic version constraint the highest matching
+// version is resolved by. it can not be combined with asOf
+func constraintFromRequest(req *http.Request) (string, error) {
+	constraint := req.URL.Query().Get("constraint")
+	if len(constraint) > 0 && len(req.URL.Query().Get("asOf")) > 0 {
+		return "", RequestError{StatusCode: http.StatusBadRequest, Message: "constraint and asOf can not be combined"}
+	}
+	return constraint, nil
+}
+
+// checkTagOnly returns a bad request error if a request for object@tag also asks for a constraint or asOf
+func checkTagOnly(req *http.Request) error {
+	if len(req.URL.Query().Get("constraint")) > 0 || len(req.URL.Query().Get("asOf")) > 0 {
+		return RequestError{StatusCode: http.StatusBadRequest, Message: "A tag can not be combined with constraint or asOf"}
+	}
+	return nil
+}
+
+// expectedFromRequest reads the version a request expects to replace from the If-Match header or expected query param
+func expectedFromRequest(req *http.Request) string {
+	expected := strings.Trim(req.Header.Get("If-Match"), "\"")
+	if len(expected) == 0 {
+		expected = req.URL.Query().Get("expected")
+	}
+	return expected
+}
+
+// reservedCategories category names that can not be added to as they are routes of their own, or hold the trash
+var reservedCategories = map[string]bool{"trash": true, "categories": true, "batch": true, trashCategory: true}
+
+// categoryFromRequest reads the category to register from the json request body, named by the category url param
+func categoryFromRequest(req *http.Request) (*Category, error) {
+	name := mux.Vars(req)["category"]
+	category := &Category{}
+	if err := json.NewDecoder(req.Body).Decode(category); err != nil {
+		return nil, RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Invalid category. %s", err.Error())}
+	}
+	if len(category.Name) > 0 && category.Name != name {
+		return nil, RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Category name %s does not match %s in the url", category.Name, name)}
+	}
+	category.Name = name
+	return category, nil
+}
+
+// zipFromRequest returns true if a batch is requested as a zip archive with an Accept header of application/zip
+func zipFromRequest(req *http.Request) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == "application/zip" {
+			return true
+		}
+	}
+	return false
+}
+
+// listOptionsFromRequest reads which names to list from the prefix and limit query params,
+// and how to order listed versions from the sort and order query params
+func listOptionsFromRequest(req *http.Request) (ListOptions, error) {
+	query := req.URL.Query()
+	options := ListOptions{Sort: query.Get("sort"), Prefix: query.Get("prefix")}
+	switch strings.ToLower(query.Get("order")) {
+	case "", "asc":
+	case "desc":
+		options.Descending = true
+	default:
+		return options, RequestError{StatusCode: http.StatusBadRequest, Message: "order must be asc or desc"}
+	}
+	if limit := query.Get("limit"); len(limit) > 0 {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > indexPageSize {
+			return options, RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("limit must be an int from 1 to %d", indexPageSize)}
+		}
+		options.Limit = parsed
+	}
+	return options, nil
+}
+
+// requesterFromRequest identifies who made a request from the X-Requester header, or their address without one
+func requesterFromRequest(req *http.Request) string {
+	if requester := req.Header.Get(requesterHeader); len(requester) > 0 {
+		return requester
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// errorStatus the http status to respond to err with
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case RequestError:
+		return e.StatusCode
+	case VersionMismatchError:
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// setObjectHeaders sets the Content-Type, Content-Encoding and X-Object-Meta-* response headers for an object
+func setObjectHeaders(res http.ResponseWriter, metadata ObjectMetadata) {
+	contentType := metadata.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	res.Header().Set("Content-Type", contentType)
+	if len(metadata.ContentEncoding) > 0 {
+		res.Header().Set("Content-Encoding", metadata.ContentEncoding)
+	}
+	for name, value := range metadata.UserMetadata {
+		res.Header().Set(userMetadataPrefix+name, value)
 	}
 }
 
@@ -67,23 +318,42 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-//
-func NewAPI(bucket string, path string, table string) *API {
+// NewAPI returns an API serving objects from the object controller objects
+func NewAPI(objects *ObjectController) *API {
 	router := mux.NewRouter()
 
 	api := &API{
-		Objects: NewObjectController(bucket, path, table),
+		Objects: objects,
 		Router:  router,
 	}
 
 	router.HandleFunc("/up", api.UpPageHandler).Methods("GET")
 	router.HandleFunc("/", api.ListCategoriesHandler).Methods("GET")
+	router.HandleFunc("/trash", api.ListTrashHandler).Methods("GET")
+	router.HandleFunc("/batch", api.BatchHandler).Methods("POST")
+	router.HandleFunc("/categories/{category}", api.GetCategoryHandler).Methods("GET")
+	router.HandleFunc("/categories/{category}", api.RegisterCategoryHandler).Methods("POST")
+	router.HandleFunc("/categories/{category}", api.UpdateCategoryHandler).Methods("PUT")
 	router.HandleFunc("/{category}", api.ListObjectsHandler).Methods("GET")
+	// object@tag resolves the version tag points at. object names can not contain @
+	router.HandleFunc("/{category}/{object:[^@/]+}@{tag}", api.GetObjectHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/{category}/{object:[^@/]+}@{tag}/resolve", api.ResolveObjectHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/tags", api.GetObjectTagsHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/tags/{tag}", api.SetObjectTagHandler).Methods("PUT")
+	router.HandleFunc("/{category}/{object}/tags/{tag}", api.DeleteObjectTagHandler).Methods("DELETE")
 	router.HandleFunc("/{category}/{object}/versions", api.ListObjectVersionsHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/history", api.GetObjectHistoryHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/rollback", api.RollbackObjectHandler).Methods("POST")
+	router.HandleFunc("/{category}/{object}/resolve", api.ResolveObjectHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/promote", api.PromoteObjectHandler).Methods("POST")
 	router.HandleFunc("/{category}/{object}/{version}", api.AddObjectHandler).Methods("POST")
-	router.HandleFunc("/{category}/{object}/{version}", api.GetObjectHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/{version}", api.GetObjectHandler).Methods("GET", "HEAD")
 	router.HandleFunc("/{category}/{object}/{version}", api.SetObjectVersion).Methods("PUT")
-	router.HandleFunc("/{category}/{object}", api.GetObjectHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/{version}", api.DeleteObjectHandler).Methods("DELETE")
+	router.HandleFunc("/{category}/{object}/{version}/meta", api.GetObjectMetaHandler).Methods("GET")
+	router.HandleFunc("/{category}/{object}/{version}/restore", api.RestoreObjectHandler).Methods("POST")
+	router.HandleFunc("/{category}/{object}", api.GetObjectHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/{category}/{object}", api.DeleteObjectHandler).Methods("DELETE")
 	router.Use(loggingMiddleware)
 	return api
 }
@@ -96,13 +366,18 @@ func (a API) UpPageHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 // ListCategoriesHandler returns list of categories specified
+// prefix and limit query params filter the categories and limit the page size
 func (a API) ListCategoriesHandler(res http.ResponseWriter, req *http.Request) {
 	reqVars := processRequest(req)
 
-	list, err := a.Objects.ListCategories(reqVars.Token)
+	options, err := listOptionsFromRequest(req)
+	var list *ListResponse
+	if err == nil {
+		list, err = a.Objects.ListCategories(reqVars.Token, options)
+	}
 
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(errorStatus(err))
 		response, _ := json.Marshal(JSONResponse{
 			Status: "err",
 			Error:  err.Error(),
@@ -122,13 +397,18 @@ func (a API) ListCategoriesHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 // ListObjectsHandler returns list of objects in a category
+// prefix and limit query params filter the objects and limit the page size
 func (a API) ListObjectsHandler(res http.ResponseWriter, req *http.Request) {
 	reqVars := processRequest(req)
 
-	list, err := a.Objects.ListObjects(reqVars.CategoryName, reqVars.Token)
+	options, err := listOptionsFromRequest(req)
+	var list *ListResponse
+	if err == nil {
+		list, err = a.Objects.ListObjects(reqVars.CategoryName, reqVars.Token, options)
+	}
 
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(errorStatus(err))
 		response, _ := json.Marshal(JSONResponse{
 			Status: "err",
 			Error:  err.Error(),
@@ -149,13 +429,21 @@ func (a API) ListObjectsHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 // ListObjectVersionsHandler returns a paginated list of object versions
+// items holds the version names, versions the size, upload time, checksum and default channels of each.
+// sort (name, uploaded or semver), order (asc or desc) and limit query params order and limit the versions,
+// the prefix query param filters them
 func (a API) ListObjectVersionsHandler(res http.ResponseWriter, req *http.Request) {
 	reqVars := processRequest(req)
 
-	list, err := a.Objects.ListObjectVersions(reqVars.CategoryName, reqVars.ObjectName, reqVars.Token)
+	options, err := listOptionsFromRequest(req)
+	var versions []VersionListing
+	var token string
+	if err == nil {
+		versions, token, err = a.Objects.ListObjectVersionDetails(reqVars.CategoryName, reqVars.ObjectName, reqVars.Token, options)
+	}
 
 	if err != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(errorStatus(err))
 		response, _ := json.Marshal(JSONResponse{
 			Status: "err",
 			Error:  err.Error(),
@@ -163,12 +451,17 @@ func (a API) ListObjectVersionsHandler(res http.ResponseWriter, req *http.Reques
 		res.Write(response)
 	} else {
 		res.WriteHeader(http.StatusOK)
+		items := []string{}
+		for _, version := range versions {
+			items = append(items, version.Version)
+		}
 		response := JSONResponse{
-			Status: "ok",
-			Items:  list.Objects,
+			Status:   "ok",
+			Items:    items,
+			Versions: versions,
 		}
-		if len(list.Token) > 0 {
-			response.NextToken = list.Token
+		if len(token) > 0 {
+			response.NextToken = token
 		}
 		content, _ := json.Marshal(response)
 		res.Write(content)
@@ -178,15 +471,28 @@ func (a API) ListObjectVersionsHandler(res http.ResponseWriter, req *http.Reques
 // AddObjectHandler POST requests to add object to cache
 // request body: object content
 // category/object/version in url params
+// Content-Type, Content-Encoding and X-Object-Meta-* headers are stored with the object
+// the upload is rejected if it does not match a Digest, Content-MD5 or X-Checksum-Sha256 header,
+// or if the category is registered and does not allow its version name, content type or size
 func (a API) AddObjectHandler(res http.ResponseWriter, req *http.Request) {
 	objectContent := req.Body
 	reqVars := processRequest(req)
 
-	addObjectErr := a.Objects.AddObject(reqVars.ObjectPath, objectContent, false, false, reqVars.ObjectVersion)
+	checksums, addObjectErr := checksumsFromRequest(req)
+	if reservedVersions[reqVars.ObjectVersion] {
+		addObjectErr = RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s can not be used as a version name", reqVars.ObjectVersion)}
+	} else if reservedCategories[reqVars.CategoryName] {
+		addObjectErr = RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s can not be used as a category name", reqVars.CategoryName)}
+	} else if strings.Contains(reqVars.ObjectName, "@") {
+		addObjectErr = RequestError{StatusCode: http.StatusBadRequest, Message: "Object names can not contain @, it separates tags"}
+	}
+	if addObjectErr == nil {
+		addObjectErr = a.Objects.AddObject(reqVars.ObjectPath, objectContent, objectMetadataFromRequest(req), checksums, false, false, reqVars.ObjectVersion)
+	}
 
 	// return json response for addobject
 	if addObjectErr != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(errorStatus(addObjectErr))
 		response, _ := json.Marshal(JSONResponse{
 			Status: "error",
 			Error:  addObjectErr.Error(),
@@ -201,53 +507,393 @@ func (a API) AddObjectHandler(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// GetObjectHandler GET requests to get object content
+// GetObjectHandler GET and HEAD requests to get object content
 // category/object/version(optional) in url params
-// pulls default version of map if no version is provided and version is set
+// HEAD requests return the same headers without fetching the content
+// pulls default version of map in the requested channel if no version is provided and version is set
+// content is streamed from the blob store. Range and If-Range requests are supported
+// the SHA-256 of the content is returned as the ETag and Digest, and the version served as X-Object-Version.
+// conditional requests are answered with 304 Not Modified when the content has not changed
+// with an asOf query param the default version at that time is returned instead,
+// with a constraint query param the highest version matching the semantic version constraint.
+// category/object@tag returns the version tag points at
 func (a API) GetObjectHandler(res http.ResponseWriter, req *http.Request) {
 	reqVars := processRequest(req)
 
-	objectReader, getObjectErr := a.Objects.GetObject(reqVars.ObjectPath, reqVars.ObjectVersion, reqVars.Dev)
+	version := reqVars.ObjectVersion
+	asOf, getObjectErr := asOfFromRequest(req)
+	var constraint string
+	if getObjectErr == nil {
+		constraint, getObjectErr = constraintFromRequest(req)
+	}
+	if getObjectErr == nil && len(reqVars.Tag) > 0 {
+		if getObjectErr = checkTagOnly(req); getObjectErr == nil {
+			version, getObjectErr = a.Objects.ResolveObjectTag(reqVars.ObjectPath, reqVars.Tag)
+		}
+	} else if getObjectErr == nil && len(version) == 0 && len(constraint) > 0 {
+		version, getObjectErr = a.Objects.ResolveObjectConstraint(reqVars.ObjectPath, constraint)
+	} else if getObjectErr == nil && len(version) == 0 && !asOf.IsZero() {
+		version, getObjectErr = a.Objects.ResolveObjectVersion(reqVars.ObjectPath, reqVars.Channel, asOf)
+	}
+	var objectReader *ObjectReader
+	if getObjectErr == nil {
+		objectReader, getObjectErr = a.Objects.GetObject(reqVars.ObjectPath, version, reqVars.Channel)
+	}
 
 	if getObjectErr != nil {
-		res.WriteHeader(http.StatusInternalServerError)
+		res.WriteHeader(errorStatus(getObjectErr))
 		response, _ := json.Marshal(JSONResponse{
 			Status: "error",
 			Error:  getObjectErr.Error(),
 		})
 		res.Write(response)
 	} else {
-		objectContent, objectReadErr := ioutil.ReadAll(objectReader)
-		if objectReadErr != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			response, _ := json.Marshal(JSONResponse{
-				Status: "error",
-				Error:  objectReadErr.Error(),
-			})
-			res.Write(response)
-		} else {
-			res.WriteHeader(http.StatusOK)
-			res.Write(objectContent)
-			res.Header().Set("Content-Type", "application/java-archive")
-		}
+		defer objectReader.Close()
+		setObjectHeaders(res, objectReader.Metadata)
+		setVersionHeaders(res, objectReader)
+		// ServeContent handles Content-Length, conditional requests (If-None-Match, If-Modified-Since),
+		// Range, If-Range and multi-range requests, seeking the object reader to each requested range
+		http.ServeContent(res, req, "", objectReader.LastModified, objectReader)
 	}
 }
 
+// GetObjectMetaHandler GET requests for the size, upload time, checksum and metadata of an object version as json
+// category/object/version in url params
+func (a API) GetObjectMetaHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	info, err := a.Objects.GetObjectInfo(reqVars.ObjectPath, reqVars.ObjectVersion)
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status: "ok",
+			Object: info,
+		})
+		res.Write(response)
+	}
+}
+
+// SetObjectVersion PUT requests to set the default version of an object in a channel
+// category/object/version in url params, channel in the channel query param (or dev=true)
+// if the request has an If-Match header or expected query param the version is only set if the
+// current default is the one given. If not a 412 is returned with the current default as the version
+// requests without a channel, dev or expected version set prod and dev together, as they did before there were channels
 func (a API) SetObjectVersion(res http.ResponseWriter, req *http.Request) {
 	reqVars := processRequest(req)
 
+	expected := expectedFromRequest(req)
+
 	var setvznerr error
-	if reqVars.Dev {
-		setvznerr = a.Objects.SetObjectDevVersion(reqVars.ObjectPath, reqVars.ObjectVersion)
+	if len(expected) > 0 {
+		setvznerr = a.Objects.SetObjectVersionIfMatch(reqVars.ObjectPath, reqVars.Channel, expected, reqVars.ObjectVersion, requesterFromRequest(req))
+	} else if len(req.URL.Query().Get("channel")) == 0 && !reqVars.Dev {
+		setvznerr = a.Objects.SetObjectProdVersion(reqVars.ObjectPath, reqVars.ObjectVersion, requesterFromRequest(req))
 	} else {
-		setvznerr = a.Objects.SetObjectVersion(reqVars.ObjectPath, reqVars.ObjectVersion)
+		setvznerr = a.Objects.SetObjectChannelVersion(reqVars.ObjectPath, reqVars.Channel, reqVars.ObjectVersion, requesterFromRequest(req))
 	}
 
 	if setvznerr != nil {
-		res.WriteHeader(http.StatusInternalServerError)
-		response, _ := json.Marshal(JSONResponse{
+		res.WriteHeader(errorStatus(setvznerr))
+		response := JSONResponse{
 			Status: "error",
 			Error:  setvznerr.Error(),
+		}
+		if mismatch, ok := setvznerr.(VersionMismatchError); ok {
+			response.Version = mismatch.Current
+		}
+		content, _ := json.Marshal(response)
+		res.Write(content)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status: "ok",
+		})
+		res.Write(response)
+	}
+}
+
+// GetObjectHistoryHandler GET requests for the changes made to the default versions of an object, newest first
+// category/object in url params, optionally a channel query param to only return changes to that channel
+func (a API) GetObjectHistoryHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	history, err := a.Objects.GetObjectHistory(reqVars.ObjectPath, req.URL.Query().Get("channel"))
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:  "ok",
+			History: history,
+		})
+		res.Write(response)
+	}
+}
+
+// RollbackObjectHandler POST requests to restore the default version of an object in a channel to the version
+// it had before its last change
+// category/object in url params, channel in the channel query param (or dev=true)
+// the restored version is returned as the version
+func (a API) RollbackObjectHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	version, err := a.Objects.RollbackObject(reqVars.ObjectPath, reqVars.Channel, requesterFromRequest(req))
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response := JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		}
+		if mismatch, ok := err.(VersionMismatchError); ok {
+			response.Version = mismatch.Current
+		}
+		content, _ := json.Marshal(response)
+		res.Write(content)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:  "ok",
+			Version: version,
+		})
+		res.Write(response)
+	}
+}
+
+// ResolveObjectHandler GET requests for the default version of an object without its content
+// category/object in url params, channel in the channel query param (or dev=true)
+// with an asOf query param the default version at that time is returned,
+// with a constraint query param the highest version matching the semantic version constraint.
+// category/object@tag/resolve returns the version tag points at
+func (a API) ResolveObjectHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	asOf, err := asOfFromRequest(req)
+	var constraint, version string
+	if err == nil {
+		constraint, err = constraintFromRequest(req)
+	}
+	if err == nil && len(reqVars.Tag) > 0 {
+		if err = checkTagOnly(req); err == nil {
+			version, err = a.Objects.ResolveObjectTag(reqVars.ObjectPath, reqVars.Tag)
+		}
+	} else if err == nil && len(constraint) > 0 {
+		version, err = a.Objects.ResolveObjectConstraint(reqVars.ObjectPath, constraint)
+	} else if err == nil {
+		version, err = a.Objects.ResolveObjectVersion(reqVars.ObjectPath, reqVars.Channel, asOf)
+	}
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:  "ok",
+			Version: version,
+		})
+		res.Write(response)
+	}
+}
+
+// PromoteObjectHandler POST requests to copy the default version of an object in one channel to another
+// category/object in url params, the channels in the from (default dev) and to (default prod) query params.
+// if the request has an If-Match header or expected query param the version is only promoted if the
+// from channel is still the one given. If not a 412 is returned with its current default as the version
+// the promoted version is returned as the version
+func (a API) PromoteObjectHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	from, to := req.URL.Query().Get("from"), req.URL.Query().Get("to")
+	if len(from) == 0 {
+		from = DevChannel
+	}
+	if len(to) == 0 {
+		to = ProdChannel
+	}
+	version, err := a.Objects.PromoteObject(reqVars.ObjectPath, from, to, expectedFromRequest(req), requesterFromRequest(req))
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response := JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		}
+		if mismatch, ok := err.(VersionMismatchError); ok {
+			response.Version = mismatch.Current
+		}
+		content, _ := json.Marshal(response)
+		res.Write(content)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:  "ok",
+			Version: version,
+		})
+		res.Write(response)
+	}
+}
+
+// DeleteObjectHandler DELETE requests for an object version, or the whole object without a version
+// deleted versions are moved to the trash, and can be restored until they are purged
+// category/object/version in url params
+// versions that are the default of any channel (or objects with any default) are only deleted with force=true
+func (a API) DeleteObjectHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	force := strings.ToLower(req.URL.Query().Get("force")) == "true"
+	var err error
+	if len(reqVars.ObjectVersion) > 0 {
+		err = a.Objects.DeleteObjectVersion(reqVars.ObjectPath, reqVars.ObjectVersion, force, requesterFromRequest(req))
+	} else {
+		err = a.Objects.DeleteObject(reqVars.ObjectPath, force, requesterFromRequest(req))
+	}
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status: "ok",
+		})
+		res.Write(response)
+	}
+}
+
+// RestoreObjectHandler POST requests to restore a deleted object version from the trash
+// category/object/version in url params
+func (a API) RestoreObjectHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	err := a.Objects.RestoreObjectVersion(reqVars.ObjectPath, reqVars.ObjectVersion, requesterFromRequest(req))
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:  "ok",
+			Version: reqVars.ObjectVersion,
+		})
+		res.Write(response)
+	}
+}
+
+// ListTrashHandler GET requests for the deleted versions waiting to be purged
+func (a API) ListTrashHandler(res http.ResponseWriter, req *http.Request) {
+	trash, err := a.Objects.ListTrash()
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status: "ok",
+			Trash:  trash,
+		})
+		res.Write(response)
+	}
+}
+
+// GetObjectTagsHandler GET requests for the tags of an object and the versions they point at
+// category/object in url params
+func (a API) GetObjectTagsHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	tags, err := a.Objects.GetObjectTags(reqVars.ObjectPath)
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status: "ok",
+			Tags:   tags,
+		})
+		res.Write(response)
+	}
+}
+
+// SetObjectTagHandler PUT requests to point a tag of an object at a version
+// category/object/tag in url params, the version in the version query param
+func (a API) SetObjectTagHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	version := req.URL.Query().Get("version")
+	var err error
+	if len(version) == 0 {
+		err = RequestError{StatusCode: http.StatusBadRequest, Message: "The version query param is required"}
+	} else {
+		err = a.Objects.SetObjectTag(reqVars.ObjectPath, reqVars.Tag, version, requesterFromRequest(req))
+	}
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:  "ok",
+			Version: version,
+		})
+		res.Write(response)
+	}
+}
+
+// DeleteObjectTagHandler DELETE requests to remove a tag of an object
+// category/object/tag in url params
+func (a API) DeleteObjectTagHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	err := a.Objects.DeleteObjectTag(reqVars.ObjectPath, reqVars.Tag, requesterFromRequest(req))
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
 		})
 		res.Write(response)
 	} else {
@@ -258,3 +904,114 @@ func (a API) SetObjectVersion(res http.ResponseWriter, req *http.Request) {
 		res.Write(response)
 	}
 }
+
+// GetCategoryHandler GET requests for a registered category and its policies
+// category in url params
+func (a API) GetCategoryHandler(res http.ResponseWriter, req *http.Request) {
+	reqVars := processRequest(req)
+
+	category, err := a.Objects.GetCategory(reqVars.CategoryName)
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:   "ok",
+			Category: category,
+		})
+		res.Write(response)
+	}
+}
+
+// RegisterCategoryHandler POST requests to register a new category
+// category in url params, request body: the category json
+func (a API) RegisterCategoryHandler(res http.ResponseWriter, req *http.Request) {
+	category, err := categoryFromRequest(req)
+	if err == nil {
+		err = a.Objects.RegisterCategory(category)
+	}
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:   "ok",
+			Category: category,
+		})
+		res.Write(response)
+	}
+}
+
+// UpdateCategoryHandler PUT requests to replace a registered category
+// category in url params, request body: the category json
+func (a API) UpdateCategoryHandler(res http.ResponseWriter, req *http.Request) {
+	category, err := categoryFromRequest(req)
+	if err == nil {
+		err = a.Objects.UpdateCategory(category)
+	}
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		res.WriteHeader(http.StatusOK)
+		response, _ := json.Marshal(JSONResponse{
+			Status:   "ok",
+			Category: category,
+		})
+		res.Write(response)
+	}
+}
+
+// BatchHandler POST requests for several objects at once, streamed as a tar archive or with an Accept
+// header of application/zip as a zip archive
+// request body: a json list of objects, each with a category, object and version or channel (prod by default)
+// the archive starts with manifest.json, describing the version and checksum resolved for each object,
+// followed by the content of each object at category/object/version
+func (a API) BatchHandler(res http.ResponseWriter, req *http.Request) {
+	entries := []BatchEntry{}
+	var manifest *BatchManifest
+	err := json.NewDecoder(req.Body).Decode(&entries)
+	if err != nil {
+		err = RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Invalid batch. %s", err.Error())}
+	} else {
+		manifest, err = a.Objects.ResolveBatch(entries)
+	}
+
+	if err != nil {
+		res.WriteHeader(errorStatus(err))
+		response, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.Write(response)
+	} else {
+		zipped := zipFromRequest(req)
+		if zipped {
+			res.Header().Set("Content-Type", "application/zip")
+		} else {
+			res.Header().Set("Content-Type", "application/x-tar")
+		}
+		res.WriteHeader(http.StatusOK)
+		if err := a.Objects.WriteBatch(res, manifest, zipped); err != nil {
+			// the status is sent already, all that is left is to cut the archive short
+			log.Printf("Unable to stream batch. %s", err.Error())
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +16,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -37,15 +44,13 @@ func makeRequest(categoryName string, objectName string, objectVersion string, m
 func NewMockAPI() *API {
 	return &API{
 		Objects: &ObjectController{
-			bucket: aws.String("unit test"),
-			path:   "dang",
-			table:  aws.String("unit test"),
-			s3: &MockS3{
+			path: "dang",
+			blobs: mockS3Store(&MockS3{
 				bucket: make(map[string]string),
-			},
-			ddb: &MockDynamo{
+			}),
+			versions: mockDynamoStore(&MockDynamo{
 				items: []map[string]*dynamodb.AttributeValue{},
-			},
+			}),
 		},
 	}
 }
@@ -78,7 +83,7 @@ func TestAddObjectHandler(t *testing.T) {
 		t.Fatalf("reponse status should be ok on successful response. Was: %s", response.Status)
 	}
 
-	objectContent, err := api.Objects.GetObject("foo/test.map.yo", "123ABC", false)
+	objectContent, err := api.Objects.GetObject("foo/test.map.yo", "123ABC", ProdChannel)
 	if err != nil {
 		t.Fatalf("Unable to get map after storing it. Error: %s", err.Error())
 	}
@@ -93,6 +98,8 @@ func TestGetObjectHandler(t *testing.T) {
 	res := httptest.NewRecorder()
 
 	req := makeRequest("foo", "test.map.yo", "123ABC", "POST", "", aws.ReadSeekCloser(strings.NewReader("secret sauce")))
+	req.Header.Set("Content-Type", "application/java-archive")
+	req.Header.Set("X-Object-Meta-Build-Id", "42")
 
 	api.AddObjectHandler(res, req)
 	if res.Code != http.StatusOK {
@@ -111,7 +118,10 @@ func TestGetObjectHandler(t *testing.T) {
 		t.Fatalf("GetObject request should be successful. Response code: %d", getRes.Code)
 	}
 	if getRes.Header().Get("Content-Type") != "application/java-archive" {
-		t.Fatalf("GetObjectHandler must set content type to application/java-archive. Is: %s", res.Header().Get("content-type"))
+		t.Fatalf("GetObjectHandler must return the uploaded content type application/java-archive. Is: %s", getRes.Header().Get("content-type"))
+	}
+	if getRes.Header().Get("X-Object-Meta-Build-Id") != "42" {
+		t.Fatalf("GetObjectHandler must return user metadata. X-Object-Meta-Build-Id is: %s", getRes.Header().Get("X-Object-Meta-Build-Id"))
 	}
 	content := getRes.Body.String()
 	if string(content) != "secret sauce" {
@@ -119,6 +129,208 @@ func TestGetObjectHandler(t *testing.T) {
 	}
 }
 
+func TestGetObjectHandlerSniffedContentType(t *testing.T) {
+	api := NewMockAPI()
+	res := httptest.NewRecorder()
+
+	// curl's default content type is ignored in favour of sniffing
+	req := makeRequest("foo", "config.json", "1", "POST", "", strings.NewReader("{\"some\": \"config\"}"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Encoding", "identity")
+	api.AddObjectHandler(res, req)
+
+	getReq := makeRequest("foo", "config.json", "1", "GET", "", nil)
+	getRes := httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("GetObjectHandler should return the sniffed content type. Is: %s", getRes.Header().Get("Content-Type"))
+	}
+	if getRes.Header().Get("Content-Encoding") != "identity" {
+		t.Fatalf("GetObjectHandler should return the uploaded content encoding. Is: %s", getRes.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestGetObjectHandlerRange(t *testing.T) {
+	api := NewMockAPI()
+	res := httptest.NewRecorder()
+	req := makeRequest("foo", "test.map.yo", "123ABC", "POST", "", strings.NewReader("wonderful magic content"))
+	api.AddObjectHandler(res, req)
+
+	getReq := makeRequest("foo", "test.map.yo", "123ABC", "GET", "", nil)
+	getRes := httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Header().Get("Content-Length") != "23" || getRes.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("GetObjectHandler should set Content-Length and Accept-Ranges. Headers: %v", getRes.Header())
+	}
+
+	getReq = makeRequest("foo", "test.map.yo", "123ABC", "GET", "", nil)
+	getReq.Header.Set("Range", "bytes=10-14")
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusPartialContent {
+		t.Fatalf("GetObjectHandler should return 206 for range requests. Status code: %d", getRes.Code)
+	}
+	if getRes.Body.String() != "magic" || getRes.Header().Get("Content-Range") != "bytes 10-14/23" {
+		t.Fatalf("GetObjectHandler returned the wrong range. Body: %s, Content-Range: %s", getRes.Body.String(), getRes.Header().Get("Content-Range"))
+	}
+
+	// suffix ranges and multiple ranges
+	getReq = makeRequest("foo", "test.map.yo", "123ABC", "GET", "", nil)
+	getReq.Header.Set("Range", "bytes=0-8,-7")
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusPartialContent || !strings.HasPrefix(getRes.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("GetObjectHandler should return multipart/byteranges for multi-range requests. Status code: %d", getRes.Code)
+	}
+	if !strings.Contains(getRes.Body.String(), "wonderful") || !strings.Contains(getRes.Body.String(), "content") {
+		t.Fatalf("GetObjectHandler multi-range response is missing a range: %s", getRes.Body.String())
+	}
+
+	getReq = makeRequest("foo", "test.map.yo", "123ABC", "GET", "", nil)
+	getReq.Header.Set("Range", "bytes=100-200")
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("GetObjectHandler should return 416 for unsatisfiable ranges. Status code: %d", getRes.Code)
+	}
+
+	// If-Range with a stale validator returns the whole object
+	getReq = makeRequest("foo", "test.map.yo", "123ABC", "GET", "", nil)
+	getReq.Header.Set("Range", "bytes=10-14")
+	getReq.Header.Set("If-Range", "Mon, 02 Jan 2006 15:04:05 GMT")
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusOK || getRes.Body.String() != "wonderful magic content" {
+		t.Fatalf("GetObjectHandler should ignore Range when If-Range does not match. Status code: %d", getRes.Code)
+	}
+}
+
+func TestAddObjectHandlerChecksums(t *testing.T) {
+	api := NewMockAPI()
+	sum := sha256.Sum256([]byte("wonderful magic content"))
+	digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	res := httptest.NewRecorder()
+	req := makeRequest("foo", "test.map.yo", "1", "POST", "", strings.NewReader("wonderful tragic content"))
+	req.Header.Set("Digest", digest)
+	api.AddObjectHandler(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("AddObjectHandler should return 400 when the content does not match the Digest. Status code: %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	req = makeRequest("foo", "test.map.yo", "1", "POST", "", strings.NewReader("wonderful magic content"))
+	req.Header.Set("X-Checksum-Sha256", "nothex")
+	api.AddObjectHandler(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("AddObjectHandler should return 400 for malformed checksum headers. Status code: %d", res.Code)
+	}
+
+	// content cut off before its Content-Length is not stored, so the version can be uploaded again
+	res = httptest.NewRecorder()
+	req = makeRequest("foo", "test.map.yo", "1", "POST", "", strings.NewReader("wonderful"))
+	req.ContentLength = 1000
+	api.AddObjectHandler(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("AddObjectHandler should return 400 when the content is shorter than its Content-Length. Status code: %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	req = makeRequest("foo", "test.map.yo", "1", "POST", "", strings.NewReader("wonderful magic content"))
+	req.Header.Set("Digest", "UNIXsum=30637, "+digest)
+	req.Header.Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+	api.AddObjectHandler(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("AddObjectHandler should accept content matching its checksums. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+
+	getReq := makeRequest("foo", "test.map.yo", "1", "GET", "", nil)
+	getRes := httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Header().Get("Digest") != digest || getRes.Header().Get("ETag") != fmt.Sprintf("\"%x\"", sum) {
+		t.Fatalf("GetObjectHandler should return the SHA-256 as the Digest and ETag. Headers: %v", getRes.Header())
+	}
+}
+
+func TestGetObjectHandlerConditional(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2"} {
+		req := makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version))
+		api.AddObjectHandler(httptest.NewRecorder(), req)
+	}
+	api.Objects.SetObjectVersion("foo/test.map.yo", "1")
+
+	getRes := httptest.NewRecorder()
+	api.GetObjectHandler(getRes, makeRequest("foo", "test.map.yo", "", "GET", "", nil))
+	etag := getRes.Header().Get("ETag")
+	if getRes.Header().Get("X-Object-Version") != "1" || len(etag) == 0 {
+		t.Fatalf("GetObjectHandler should return the resolved version and its ETag. Headers: %v", getRes.Header())
+	}
+
+	getReq := makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+	getReq.Header.Set("If-None-Match", etag)
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusNotModified || getRes.Body.Len() > 0 {
+		t.Fatalf("GetObjectHandler should return 304 when If-None-Match matches. Status code: %d", getRes.Code)
+	}
+
+	getReq = makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+	getReq.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusNotModified {
+		t.Fatalf("GetObjectHandler should return 304 when not modified since If-Modified-Since. Status code: %d", getRes.Code)
+	}
+
+	// moving the default version changes the ETag
+	api.Objects.SetObjectVersion("foo/test.map.yo", "2")
+	getReq = makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+	getReq.Header.Set("If-None-Match", etag)
+	getRes = httptest.NewRecorder()
+	api.GetObjectHandler(getRes, getReq)
+	if getRes.Code != http.StatusOK || getRes.Body.String() != "content 2" || getRes.Header().Get("X-Object-Version") != "2" {
+		t.Fatalf("GetObjectHandler should return the new default version. Status code: %d, Body: %s", getRes.Code, getRes.Body.String())
+	}
+}
+
+func TestHeadAndMetaRequests(t *testing.T) {
+	api := NewAPI(NewMockAPI().Objects)
+	req := makeRequest("foo", "test.map.yo", "1", "POST", "", strings.NewReader("wonderful magic content"))
+	req.Header.Set("Content-Type", "application/java-archive")
+	api.AddObjectHandler(httptest.NewRecorder(), req)
+	api.Objects.SetObjectVersion("foo/test.map.yo", "1")
+
+	for _, target := range []string{"/foo/test.map.yo/1", "/foo/test.map.yo"} {
+		res := httptest.NewRecorder()
+		api.Router.ServeHTTP(res, httptest.NewRequest("HEAD", target, nil))
+		if res.Code != http.StatusOK || res.Body.Len() > 0 {
+			t.Fatalf("HEAD %s should return 200 without a body. Status code: %d", target, res.Code)
+		}
+		if res.Header().Get("Content-Length") != "23" || res.Header().Get("Content-Type") != "application/java-archive" || len(res.Header().Get("ETag")) == 0 {
+			t.Fatalf("HEAD %s should return the object headers. Headers: %v", target, res.Header())
+		}
+	}
+
+	res := httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/foo/test.map.yo/1/meta", nil))
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || response.Object == nil {
+		t.Fatalf("GET meta should return the object info. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	sum := sha256.Sum256([]byte("wonderful magic content"))
+	if response.Object.Size != 23 || response.Object.Checksum != hex.EncodeToString(sum[:]) || response.Object.ContentType != "application/java-archive" || response.Object.LastModified.IsZero() {
+		t.Fatalf("GET meta returned the wrong object info: %+v", response.Object)
+	}
+
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/foo/test.map.yo/2/meta", nil))
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("GET meta should return 404 for missing versions. Status code: %d", res.Code)
+	}
+}
+
 func TestSetObjectVznHandler(t *testing.T) {
 	api := NewMockAPI()
 	// add object, dont set version
@@ -173,19 +385,643 @@ func TestSetObjectVznHandler(t *testing.T) {
 	}
 }
 
+func TestSetObjectVersionIfMatch(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2", "3"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+	api.Objects.SetObjectVersion("foo/test.map.yo", "1")
+
+	req := makeRequest("foo", "test.map.yo", "3", "PUT", "", nil)
+	req.Header.Set("If-Match", "\"2\"")
+	res := httptest.NewRecorder()
+	api.SetObjectVersion(res, req)
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusPreconditionFailed || response.Version != "1" {
+		t.Fatalf("SetObjectVersion should return 412 and the current version when If-Match does not match. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+
+	req = makeRequest("foo", "test.map.yo", "2", "PUT", "", nil)
+	req.URL.RawQuery = "expected=1"
+	res = httptest.NewRecorder()
+	api.SetObjectVersion(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("SetObjectVersion should succeed when the expected version matches. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if version, _ := api.Objects.versions.GetVersion("foo/test.map.yo", ProdChannel); version != "2" {
+		t.Fatalf("SetObjectVersion should have set the version to 2. Is: %s", version)
+	}
+}
+
+func TestSetObjectVersionMissing(t *testing.T) {
+	api := NewMockAPI()
+	api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", "1", "POST", "", strings.NewReader("content")))
+
+	for _, query := range []string{"", "channel=staging", "expected=*"} {
+		req := makeRequest("foo", "test.map.yo", "typo", "PUT", "", nil)
+		req.URL.RawQuery = query
+		res := httptest.NewRecorder()
+		api.SetObjectVersion(res, req)
+		if res.Code != http.StatusNotFound {
+			t.Fatalf("SetObjectVersion with query %q should return 404 for versions that do not exist. Status code: %d", query, res.Code)
+		}
+	}
+	if _, err := api.Objects.versions.GetVersion("foo/test.map.yo", ProdChannel); err == nil {
+		t.Fatalf("SetObjectVersion should not set versions that do not exist")
+	}
+
+	// versions still being uploaded can not be set either
+	api.Objects.versions.CreateVersionInfo("foo/test.map.yo", "2", &VersionInfo{State: VersionPending, Created: time.Now()})
+	api.Objects.blobs.Put(api.Objects.getObjectKey("foo/test.map.yo", "2"), strings.NewReader("partial"), nil)
+	if err := api.Objects.SetObjectVersion("foo/test.map.yo", "2"); err == nil {
+		t.Fatalf("SetObjectVersion should not set versions that are still being uploaded")
+	}
+}
+
+func TestChannels(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+	api.Objects.SetObjectVersion("foo/test.map.yo", "1")
+
+	req := makeRequest("foo", "test.map.yo", "2", "PUT", "", nil)
+	req.URL.RawQuery = "channel=staging"
+	res := httptest.NewRecorder()
+	api.SetObjectVersion(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("SetObjectVersion should set the staging channel. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+
+	for query, expected := range map[string]string{"channel=staging": "content 2", "": "content 1", "dev=true": "content 1"} {
+		req = makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+		req.URL.RawQuery = query
+		res = httptest.NewRecorder()
+		api.GetObjectHandler(res, req)
+		if res.Body.String() != expected {
+			t.Fatalf("GetObjectHandler with query %q should return %s. Returned: %s", query, expected, res.Body.String())
+		}
+	}
+
+	req = makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+	req.URL.RawQuery = "channel=Not%20A%20Channel"
+	res = httptest.NewRecorder()
+	api.GetObjectHandler(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("GetObjectHandler should return 400 for invalid channels. Status code: %d", res.Code)
+	}
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+
+	rollback := func() *httptest.ResponseRecorder {
+		req := makeRequest("foo", "test.map.yo", "", "POST", "", nil)
+		req.Header.Set("X-Requester", "rollbacker")
+		res := httptest.NewRecorder()
+		api.RollbackObjectHandler(res, req)
+		return res
+	}
+	if res := rollback(); res.Code != http.StatusConflict {
+		t.Fatalf("RollbackObjectHandler should return 409 when there is nothing to roll back to. Status code: %d", res.Code)
+	}
+
+	for _, version := range []string{"1", "2"} {
+		req := makeRequest("foo", "test.map.yo", version, "PUT", "", nil)
+		req.Header.Set("X-Requester", "deployer")
+		api.SetObjectVersion(httptest.NewRecorder(), req)
+	}
+	res := rollback()
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || response.Version != "1" {
+		t.Fatalf("RollbackObjectHandler should restore version 1. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if version, _ := api.Objects.versions.GetVersion("foo/test.map.yo", ProdChannel); version != "1" {
+		t.Fatalf("RollbackObjectHandler should have set the version to 1. Is: %s", version)
+	}
+
+	req := makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+	req.URL.RawQuery = "channel=prod"
+	res = httptest.NewRecorder()
+	api.GetObjectHistoryHandler(res, req)
+	response = &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || len(response.History) != 3 {
+		t.Fatalf("GetObjectHistoryHandler should return the 3 prod changes. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if latest := response.History[0]; latest.Version != "1" || latest.Previous != "2" || latest.Requester != "rollbacker" {
+		t.Fatalf("GetObjectHistoryHandler should return the rollback first. Is: %+v", latest)
+	}
+
+	res = httptest.NewRecorder()
+	api.AddObjectHandler(res, makeRequest("foo", "test.map.yo", "history", "POST", "", strings.NewReader("content")))
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("AddObjectHandler should refuse reserved version names. Status code: %d", res.Code)
+	}
+	res = httptest.NewRecorder()
+	api.AddObjectHandler(res, makeRequest("batch", "test.map.yo", "1", "POST", "", strings.NewReader("content")))
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("AddObjectHandler should refuse reserved category names. Status code: %d", res.Code)
+	}
+}
+
+func TestRollbackLeavesOtherChannels(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2", "3"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+	set := func(channel string, version string) {
+		req := makeRequest("foo", "test.map.yo", version, "PUT", "", nil)
+		req.URL.RawQuery = "channel=" + channel
+		api.SetObjectVersion(httptest.NewRecorder(), req)
+	}
+	set(ProdChannel, "1")
+	set(DevChannel, "3")
+	set(ProdChannel, "2")
+	req := makeRequest("foo", "test.map.yo", "", "POST", "", nil)
+	req.URL.RawQuery = "channel=prod"
+	res := httptest.NewRecorder()
+	api.RollbackObjectHandler(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("RollbackObjectHandler should roll prod back. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	defaults, _ := api.Objects.versions.GetDefaults("foo/test.map.yo")
+	if defaults[ProdChannel] != "1" || defaults[DevChannel] != "3" {
+		t.Fatalf("Setting and rolling back the prod channel should leave dev alone. Defaults: %v", defaults)
+	}
+
+	// setting the default without a channel sets prod and dev together, as it always has
+	api.SetObjectVersion(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", "2", "PUT", "", nil))
+	defaults, _ = api.Objects.versions.GetDefaults("foo/test.map.yo")
+	if defaults[ProdChannel] != "2" || defaults[DevChannel] != "2" {
+		t.Fatalf("Setting the default without a channel should set prod and dev. Defaults: %v", defaults)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+	api.Objects.SetObjectVersion("foo/test.map.yo", "1")
+	api.Objects.SetObjectDevVersion("foo/test.map.yo", "2")
+
+	promote := func(query string) (*httptest.ResponseRecorder, *JSONResponse) {
+		req := makeRequest("foo", "test.map.yo", "", "POST", "", nil)
+		req.URL.RawQuery = query
+		res := httptest.NewRecorder()
+		api.PromoteObjectHandler(res, req)
+		response := &JSONResponse{}
+		json.Unmarshal(res.Body.Bytes(), response)
+		return res, response
+	}
+	if res, response := promote("from=dev&to=prod&expected=3"); res.Code != http.StatusPreconditionFailed || response.Version != "2" {
+		t.Fatalf("PromoteObjectHandler should return 412 and the current version when expected does not match. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if res, _ := promote("from=canary"); res.Code == http.StatusOK {
+		t.Fatalf("PromoteObjectHandler should fail for channels with no version. Status code: %d", res.Code)
+	}
+	if res, _ := promote("from=prod&to=prod"); res.Code != http.StatusBadRequest {
+		t.Fatalf("PromoteObjectHandler should return 400 promoting a channel to itself. Status code: %d", res.Code)
+	}
+	if res, response := promote("expected=2"); res.Code != http.StatusOK || response.Version != "2" {
+		t.Fatalf("PromoteObjectHandler should promote dev to prod. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if version, _ := api.Objects.versions.GetVersion("foo/test.map.yo", ProdChannel); version != "2" {
+		t.Fatalf("PromoteObjectHandler should have set the prod version to 2. Is: %s", version)
+	}
+	history, _ := api.Objects.GetObjectHistory("foo/test.map.yo", ProdChannel)
+	if history[0].Version != "2" || history[0].Previous != "1" {
+		t.Fatalf("PromoteObjectHandler should record the promotion in the history. Latest: %+v", history[0])
+	}
+}
+
+func TestDeleteObject(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2", "3", "5"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+	api.Objects.SetObjectVersion("foo/test.map.yo", "1")
+	api.Objects.SetObjectChannelVersion("foo/test.map.yo", "staging", "2", "")
+
+	deleteObject := func(version string, query string) *httptest.ResponseRecorder {
+		req := makeRequest("foo", "test.map.yo", version, "DELETE", "", nil)
+		req.URL.RawQuery = query
+		res := httptest.NewRecorder()
+		api.DeleteObjectHandler(res, req)
+		return res
+	}
+	if res := deleteObject("1", ""); res.Code != http.StatusConflict {
+		t.Fatalf("DeleteObjectHandler should return 409 for default versions. Status code: %d", res.Code)
+	}
+	if res := deleteObject("4", ""); res.Code != http.StatusNotFound {
+		t.Fatalf("DeleteObjectHandler should return 404 for versions that do not exist. Status code: %d", res.Code)
+	}
+	if res := deleteObject("3", ""); res.Code != http.StatusOK {
+		t.Fatalf("DeleteObjectHandler should delete versions that are not a default. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if _, err := api.Objects.GetObject("foo/test.map.yo", "3", ""); err == nil {
+		t.Fatalf("DeleteObjectHandler should have deleted version 3")
+	}
+
+	// tagged versions are kept like defaults, and forcing removes their tags
+	api.Objects.SetObjectTag("foo/test.map.yo", "lts", "5", "unit test")
+	if res := deleteObject("5", ""); res.Code != http.StatusConflict || !strings.Contains(res.Body.String(), "tagged lts") {
+		t.Fatalf("DeleteObjectHandler should return 409 for tagged versions. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if res := deleteObject("5", "force=true"); res.Code != http.StatusOK {
+		t.Fatalf("DeleteObjectHandler should delete tagged versions with force. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if tags, _ := api.Objects.GetObjectTags("foo/test.map.yo"); len(tags) != 0 {
+		t.Fatalf("DeleteObjectHandler should remove the tags of the version. Tags: %v", tags)
+	}
+	history, _ := api.Objects.GetObjectHistory("foo/test.map.yo", "")
+	if history[1].Action != ActionUntagged || history[1].Tag != "lts" || history[1].Previous != "5" {
+		t.Fatalf("DeleteObjectHandler should record the removed tag. Change: %+v", history[1])
+	}
+
+	// forcing removes the defaults pointing at the version
+	if res := deleteObject("1", "force=true"); res.Code != http.StatusOK {
+		t.Fatalf("DeleteObjectHandler should delete default versions with force. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	defaults, _ := api.Objects.versions.GetDefaults("foo/test.map.yo")
+	if len(defaults) != 1 || defaults["staging"] != "2" {
+		t.Fatalf("DeleteObjectHandler should remove the prod and dev defaults. Defaults: %v", defaults)
+	}
+
+	if res := deleteObject("", ""); res.Code != http.StatusConflict {
+		t.Fatalf("DeleteObjectHandler should return 409 for objects with defaults. Status code: %d", res.Code)
+	}
+	api.Objects.SetObjectTag("foo/test.map.yo", "approved", "2", "unit test")
+	if res := deleteObject("", "force=true"); res.Code != http.StatusOK {
+		t.Fatalf("DeleteObjectHandler should delete objects with force. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if list, _ := api.Objects.ListObjectVersions("foo", "test.map.yo", ""); len(list.Objects) != 0 {
+		t.Fatalf("DeleteObjectHandler should delete every version. Left: %v", list.Objects)
+	}
+	if item := api.Objects.versions.(*DynamoVersionStore).ddb.(*MockDynamo).findItem("foo/test.map.yo"); item != nil {
+		t.Fatalf("DeleteObjectHandler should delete the item holding the defaults. Item: %v", item)
+	}
+	if res := deleteObject("", ""); res.Code != http.StatusNotFound {
+		t.Fatalf("DeleteObjectHandler should return 404 for objects that do not exist. Status code: %d", res.Code)
+	}
+
+	history, _ = api.Objects.GetObjectHistory("foo/test.map.yo", "")
+	if history[0].Action != ActionDeleted || len(history[0].Version) > 0 {
+		t.Fatalf("DeleteObjectHandler should record the object delete. Latest: %+v", history[0])
+	}
+	if history[1].Action != ActionUntagged || history[1].Tag != "approved" || history[1].Previous != "2" {
+		t.Fatalf("DeleteObjectHandler should record the removed tags. Change: %+v", history[1])
+	}
+	if history[2].Channel != "staging" || history[2].Previous != "2" || len(history[2].Version) > 0 {
+		t.Fatalf("DeleteObjectHandler should record the removed defaults. Change: %+v", history[2])
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	api := NewMockAPI()
+	for _, version := range []string{"1", "2"} {
+		api.AddObjectHandler(httptest.NewRecorder(), makeRequest("foo", "test.map.yo", version, "POST", "", strings.NewReader("content "+version)))
+	}
+	deployed := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	api.Objects.versions.AppendHistory("foo/test.map.yo", []VersionChange{
+		{Time: deployed, Channel: ProdChannel, Version: "1"},
+		{Time: deployed.Add(time.Hour), Channel: ProdChannel, Previous: "1", Version: "2"},
+	})
+
+	for asOf, expected := range map[string]string{"2018-10-01T12:30:00Z": "content 1", "2018-10-01T13:00:00Z": "content 2"} {
+		req := makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+		req.URL.RawQuery = "asOf=" + asOf
+		res := httptest.NewRecorder()
+		api.GetObjectHandler(res, req)
+		if res.Body.String() != expected || res.Header().Get("X-Object-Version") != expected[len(expected)-1:] {
+			t.Fatalf("GetObjectHandler asOf %s should return %s. Returned: %s", asOf, expected, res.Body.String())
+		}
+	}
+
+	for query, code := range map[string]int{"asOf=2018-10-01T11:00:00Z": http.StatusNotFound, "asOf=yesterday": http.StatusBadRequest, "asOf=2018-10-01T12:00:00%2B02:00": http.StatusNotFound} {
+		req := makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+		req.URL.RawQuery = query
+		res := httptest.NewRecorder()
+		api.ResolveObjectHandler(res, req)
+		if res.Code != code {
+			t.Fatalf("ResolveObjectHandler with %s should return %d. Status code: %d, Body: %s", query, code, res.Code, res.Body.String())
+		}
+	}
+
+	req := makeRequest("foo", "test.map.yo", "", "GET", "", nil)
+	req.URL.RawQuery = "asOf=2018-10-01T14:00:00%2B01:00"
+	res := httptest.NewRecorder()
+	api.ResolveObjectHandler(res, req)
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || response.Version != "2" {
+		t.Fatalf("ResolveObjectHandler should return version 2. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	api := NewAPI(NewObjectController(blobs, versions, "dang"))
+	for _, version := range []string{"1.2.0", "1.3.0", "1.4.0-rc.1", "2.0.0", "nightly"} {
+		api.Objects.AddObject("maps/de_dust.map", strings.NewReader("content "+version), nil, nil, false, false, version)
+	}
+	api.Objects.DeleteObjectVersion("maps/de_dust.map", "2.0.0", false, "unit test")
+
+	for constraint, expected := range map[string]string{"%5E1": "1.3.0", "~1.2": "1.2.0", "latest": "1.3.0", ">=1.4.0-rc.1": "1.4.0-rc.1"} {
+		res := httptest.NewRecorder()
+		api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/maps/de_dust.map?constraint="+constraint, nil))
+		if res.Code != http.StatusOK || res.Body.String() != "content "+expected || res.Header().Get("X-Object-Version") != expected {
+			t.Fatalf("GET with constraint %s should return version %s. Status code: %d, Body: %s", constraint, expected, res.Code, res.Body.String())
+		}
+	}
+
+	for query, code := range map[string]int{"constraint=%5E2": http.StatusNotFound, "constraint=1.2.3.4": http.StatusBadRequest, "constraint=latest&asOf=2018-10-01T11:00:00Z": http.StatusBadRequest} {
+		res := httptest.NewRecorder()
+		api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/maps/de_dust.map/resolve?"+query, nil))
+		if res.Code != code {
+			t.Fatalf("Resolving with %s should return %d. Status code: %d, Body: %s", query, code, res.Code, res.Body.String())
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	api := NewAPI(NewObjectController(blobs, versions, "dang"))
+	for _, version := range []string{"1", "2"} {
+		api.Objects.AddObject("maps/de_dust.map", strings.NewReader("content "+version), nil, nil, false, false, version)
+	}
+
+	for target, code := range map[string]int{
+		"/maps/de_dust.map/tags/lts?version=1":      http.StatusOK,
+		"/maps/de_dust.map/tags/lts?version=3":      http.StatusNotFound,
+		"/maps/de_dust.map/tags/lts":                http.StatusBadRequest,
+		"/maps/de_dust.map/tags/no%20way?version=1": http.StatusBadRequest,
+	} {
+		res := httptest.NewRecorder()
+		api.Router.ServeHTTP(res, httptest.NewRequest("PUT", target, nil))
+		if res.Code != code {
+			t.Fatalf("PUT %s should return %d. Status code: %d, Body: %s", target, code, res.Code, res.Body.String())
+		}
+	}
+
+	res := httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/maps/de_dust.map@lts", nil))
+	if res.Code != http.StatusOK || res.Body.String() != "content 1" || res.Header().Get("X-Object-Version") != "1" {
+		t.Fatalf("GET object@tag should return the tagged version. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/maps/de_dust.map@lts/resolve", nil))
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || response.Version != "1" {
+		t.Fatalf("Resolving object@tag should return the tagged version. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/maps/de_dust.map/tags", nil))
+	response = &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if len(response.Tags) != 1 || response.Tags["lts"] != "1" {
+		t.Fatalf("GET tags should return the tags. Body: %s", res.Body.String())
+	}
+
+	// object names can not contain @ so tags are never ambiguous
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("POST", "/maps/de_dust.map@lts/3", strings.NewReader("content")))
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("POST should not accept object names containing @. Status code: %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("DELETE", "/maps/de_dust.map/tags/lts", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("DELETE should remove the tag. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/maps/de_dust.map@lts", nil))
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("GET object@tag should return 404 for deleted tags. Status code: %d", res.Code)
+	}
+	history, _ := api.Objects.GetObjectHistory("maps/de_dust.map", "")
+	if len(history) != 2 || history[0].Action != ActionUntagged || history[1].Action != ActionTagged || history[1].Tag != "lts" {
+		t.Fatalf("Tag changes should be recorded in the history. History: %+v", history)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	api := NewAPI(NewObjectController(blobs, versions, "dang"))
+	serve := func(method string, target string, contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		res := httptest.NewRecorder()
+		api.Router.ServeHTTP(res, req)
+		return res
+	}
+
+	maps := `{"owner": "mappers", "contentTypes": ["application/octet-stream"], "maxSize": 10, "versionPattern": "semver"}`
+	for _, step := range []struct {
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{"POST", "/categories/maps", maps, http.StatusOK},
+		{"POST", "/categories/maps", maps, http.StatusConflict},
+		{"POST", "/categories/builds", `{"versionPattern": "("}`, http.StatusBadRequest},
+		{"POST", "/categories/builds", `{"name": "maps"}`, http.StatusBadRequest},
+		{"POST", "/categories/trash", `{}`, http.StatusBadRequest},
+		{"PUT", "/categories/builds", `{}`, http.StatusNotFound},
+		{"GET", "/categories/builds", "", http.StatusNotFound},
+	} {
+		if res := serve(step.method, step.target, "application/json", step.body); res.Code != step.code {
+			t.Fatalf("%s %s should return %d. Status code: %d, Body: %s", step.method, step.target, step.code, res.Code, res.Body.String())
+		}
+	}
+	res := serve("GET", "/categories/maps", "", "")
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || response.Category == nil || response.Category.Owner != "mappers" || response.Category.MaxSize != 10 {
+		t.Fatalf("GET should return the registered category. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+
+	for _, upload := range []struct {
+		version     string
+		contentType string
+		content     string
+		code        int
+	}{
+		{"1.0.0", "application/octet-stream", "small", http.StatusOK},
+		{"nightly", "application/octet-stream", "small", http.StatusBadRequest},
+		{"1.0.1", "text/plain", "small", http.StatusUnsupportedMediaType},
+		{"1.0.1", "application/octet-stream", "far too large", http.StatusRequestEntityTooLarge},
+	} {
+		if res := serve("POST", "/maps/de_dust.map/"+upload.version, upload.contentType, upload.content); res.Code != upload.code {
+			t.Fatalf("Uploading version %s should return %d. Status code: %d, Body: %s", upload.version, upload.code, res.Code, res.Body.String())
+		}
+	}
+	// rejected uploads leave nothing behind, so they can be retried once the policy allows them
+	if res := serve("PUT", "/categories/maps", "application/json", `{"versionPattern": "semver"}`); res.Code != http.StatusOK {
+		t.Fatalf("PUT should replace the category. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if res := serve("POST", "/maps/de_dust.map/1.0.1", "text/plain", "far too large"); res.Code != http.StatusOK {
+		t.Fatalf("Uploads should meet the replaced policies. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+
+	if res := serve("POST", "/builds/app.jar/1", "", "content"); res.Code != http.StatusOK {
+		t.Fatalf("Uploads to categories that are not registered should be allowed. Status code: %d", res.Code)
+	}
+	api.Objects.strictCategories = true
+	if res := serve("POST", "/builds/app.jar/2", "", "content"); res.Code != http.StatusForbidden {
+		t.Fatalf("Uploads to categories that are not registered should be forbidden in strict mode. Status code: %d", res.Code)
+	}
+	if res := serve("POST", "/maps/de_dust.map/1.0.2", "", "content"); res.Code != http.StatusOK {
+		t.Fatalf("Uploads to registered categories should be allowed in strict mode. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+
+	if res := serve("PUT", "/categories/maps", "application/json", `{"requireRegisteredObjects": true, "objects": ["de_dust.map"]}`); res.Code != http.StatusOK {
+		t.Fatalf("PUT should register objects. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if res := serve("POST", "/maps/de_aztec.map/1", "", "content"); res.Code != http.StatusForbidden {
+		t.Fatalf("Uploads to objects that are not registered should be forbidden when the category requires it. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if res := serve("POST", "/maps/de_dust.map/1.0.3", "", "content"); res.Code != http.StatusOK {
+		t.Fatalf("Uploads to registered objects should be allowed. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	if res := serve("PUT", "/categories/maps", "application/json", `{"objects": ["maps/de_dust.map"]}`); res.Code != http.StatusBadRequest {
+		t.Fatalf("PUT should refuse invalid object names. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	api := NewAPI(NewObjectController(blobs, versions, "dang"))
+	for _, version := range []string{"1", "2"} {
+		req := makeRequest("maps", "de_dust.map", version, "POST", "", strings.NewReader("map content "+version))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		api.AddObjectHandler(httptest.NewRecorder(), req)
+	}
+	api.Objects.SetObjectVersion("maps/de_dust.map", "1")
+	api.Objects.SetObjectDevVersion("maps/de_dust.map", "2")
+	serve := func(accept string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		api.Router.ServeHTTP(res, req)
+		return res
+	}
+
+	batch := `[{"category": "maps", "object": "de_dust.map"}, {"category": "maps", "object": "de_dust.map", "channel": "dev"}, {"category": "maps", "object": "de_dust.map", "version": "1"}]`
+	checkBatch := func(files map[string]string) {
+		manifest := &BatchManifest{}
+		if err := json.Unmarshal([]byte(files[batchManifestName]), manifest); err != nil || len(manifest.Objects) != 3 {
+			t.Fatalf("The batch should start with a manifest of each object. Manifest: %s", files[batchManifestName])
+		}
+		sum := sha256.Sum256([]byte("map content 1"))
+		for i, expected := range []BatchMember{
+			{Channel: ProdChannel, Version: "1", Path: "maps/de_dust.map/1", Checksum: hex.EncodeToString(sum[:])},
+			{Channel: "dev", Version: "2", Path: "maps/de_dust.map/2"},
+			{Version: "1", Path: "maps/de_dust.map/1"},
+		} {
+			member := manifest.Objects[i]
+			if member.Channel != expected.Channel || member.Version != expected.Version || member.Path != expected.Path || member.Size != 13 {
+				t.Fatalf("Manifest entry %d should be %+v. Got: %+v", i, expected, member)
+			}
+			if len(expected.Checksum) > 0 && member.Checksum != expected.Checksum {
+				t.Fatalf("Manifest entry %d should have checksum %s. Got: %s", i, expected.Checksum, member.Checksum)
+			}
+		}
+		if len(files) != 3 || files["maps/de_dust.map/1"] != "map content 1" || files["maps/de_dust.map/2"] != "map content 2" {
+			t.Fatalf("The batch should hold the manifest and each version once. Files: %v", files)
+		}
+	}
+
+	res := serve("", batch)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("POST /batch should return a tar archive. Status code: %d, Headers: %v", res.Code, res.Header())
+	}
+	files := map[string]string{}
+	reader := tar.NewReader(res.Body)
+	for header, err := reader.Next(); err != io.EOF; header, err = reader.Next() {
+		if err != nil {
+			t.Fatalf("Unable to read the tar archive. %s", err.Error())
+		}
+		if len(files) == 0 && header.Name != batchManifestName {
+			t.Fatalf("The manifest should be the first file of the archive. Got: %s", header.Name)
+		}
+		content, _ := ioutil.ReadAll(reader)
+		files[header.Name] = string(content)
+	}
+	checkBatch(files)
+
+	res = serve("application/json, application/zip;q=0.9", batch)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("POST /batch should return a zip archive when it is accepted. Status code: %d, Headers: %v", res.Code, res.Header())
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	if err != nil {
+		t.Fatalf("Unable to read the zip archive. %s", err.Error())
+	}
+	files = map[string]string{}
+	for _, file := range zipReader.File {
+		content, _ := file.Open()
+		body, _ := ioutil.ReadAll(content)
+		content.Close()
+		files[file.Name] = string(body)
+	}
+	checkBatch(files)
+
+	for _, failure := range []struct {
+		body string
+		code int
+	}{
+		{`[{"category": "maps", "object": "de_dust.map", "version": "3"}]`, http.StatusNotFound},
+		{`[{"category": "maps", "object": "de_dust.map", "version": "1", "channel": "dev"}]`, http.StatusBadRequest},
+		{`[{"category": "maps"}]`, http.StatusBadRequest},
+		{`[{"category": "maps", "object": "de_dust.map", "version": "1/../2"}]`, http.StatusBadRequest},
+		{`[{"category": "maps", "object": "de_dust.map", "version": ".."}]`, http.StatusBadRequest},
+		{`[]`, http.StatusBadRequest},
+		{`{"category": "maps"}`, http.StatusBadRequest},
+	} {
+		if res := serve("", failure.body); res.Code != failure.code || res.Header().Get("Content-Type") == "application/x-tar" {
+			t.Fatalf("POST /batch %s should return a %d error. Status code: %d, Body: %s", failure.body, failure.code, res.Code, res.Body.String())
+		}
+	}
+}
+
 func TestAPIListRequestsHappy(t *testing.T) {
 	happyAPI := &API{
 		Objects: &ObjectController{
-			bucket: aws.String("unit test"),
-			path:   "dang",
-			s3: &MockS3{
+			path: "dang",
+			blobs: mockS3Store(&MockS3{
 				bucket: map[string]string{
 					"dang/fun/foo.obj/123abc":  "wonderful magic content",
 					"dang/work/bar.obj/456789": "more incredible content",
 				},
-			},
+			}),
+			versions: mockDynamoStore(&MockDynamo{}),
 		},
 	}
+	// listings are served from the index
+	happyAPI.Objects.versions.IndexVersion("fun", "foo.obj", IndexEntry{Version: "123abc"})
+	happyAPI.Objects.versions.IndexVersion("work", "bar.obj", IndexEntry{Version: "456789"})
 
 	listCategoriesRes := httptest.NewRecorder()
 	listCategoriesReq := httptest.NewRequest("GET", "/", nil)
@@ -193,6 +1029,11 @@ func TestAPIListRequestsHappy(t *testing.T) {
 	if listCategoriesRes.Code != 200 {
 		t.Fatalf("API.ListCategoriesHandler should return a 200. Got: %d", listCategoriesRes.Code)
 	}
+	categories := &JSONResponse{}
+	json.Unmarshal(listCategoriesRes.Body.Bytes(), categories)
+	if strings.Join(categories.Items, ",") != "fun,work" {
+		t.Fatalf("API.ListCategoriesHandler should return fun,work. Got: %s", listCategoriesRes.Body.String())
+	}
 
 	listObjectsRes := httptest.NewRecorder()
 	listObjectsReq := mux.SetURLVars(httptest.NewRequest("GET", "/fun", nil), map[string]string{
@@ -212,20 +1053,50 @@ func TestAPIListRequestsHappy(t *testing.T) {
 	if listVersionsRes.Code != 200 {
 		t.Fatalf("API.ListObjectVersionsHandler should return a 200. Got: %d", listVersionsRes.Code)
 	}
+
+	// pages of the categories starting with a prefix, continued with the signed token of the previous page
+	happyAPI.Objects.versions.IndexVersion("fundraising", "plan.doc", IndexEntry{Version: "1"})
+	pageRes := httptest.NewRecorder()
+	happyAPI.ListCategoriesHandler(pageRes, httptest.NewRequest("GET", "/?prefix=fun&limit=1", nil))
+	page := &JSONResponse{}
+	json.Unmarshal(pageRes.Body.Bytes(), page)
+	if strings.Join(page.Items, ",") != "fun" || len(page.NextToken) == 0 {
+		t.Fatalf("API.ListCategoriesHandler should return the first category starting with fun and a token. Got: %s", pageRes.Body.String())
+	}
+	for target, code := range map[string]int{
+		"/?prefix=fun&limit=1&token=" + page.NextToken:  http.StatusOK,
+		"/?prefix=f&limit=1&token=" + page.NextToken:    http.StatusBadRequest,
+		"/?prefix=fun&limit=1&token=x" + page.NextToken: http.StatusBadRequest,
+		"/?limit=0":    http.StatusBadRequest,
+		"/?limit=1001": http.StatusBadRequest,
+	} {
+		res := httptest.NewRecorder()
+		happyAPI.ListCategoriesHandler(res, httptest.NewRequest("GET", target, nil))
+		if res.Code != code {
+			t.Fatalf("API.ListCategoriesHandler should return %d for %s. Got: %d, Body: %s", code, target, res.Code, res.Body.String())
+		}
+		page := &JSONResponse{}
+		json.Unmarshal(res.Body.Bytes(), page)
+		if code == http.StatusOK && (strings.Join(page.Items, ",") != "fundraising" || len(page.NextToken) > 0) {
+			t.Fatalf("API.ListCategoriesHandler should continue with the last category starting with fun. Got: %s", res.Body.String())
+		}
+	}
 }
 
 func TestAPIListRequestsSad(t *testing.T) {
 	sadAPI := &API{
 		Objects: &ObjectController{
-			bucket: aws.String("unit test"),
-			path:   "dang",
-			s3: &MockS3{
+			path: "dang",
+			blobs: mockS3Store(&MockS3{
 				bucket: map[string]string{
 					"dang/fun/foo.obj/123abc":  "wonderful magic content",
 					"dang/work/bar.obj/456789": "more incredible content",
 				},
 				listObjectsErr: errors.New("boo hoo"),
-			},
+			}),
+			versions: mockDynamoStore(&MockDynamo{
+				getItemErr: []error{errors.New("boo hoo"), errors.New("boo hoo"), errors.New("boo hoo")},
+			}),
 		},
 	}
 
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBatchSize the most objects a batch can request
+const maxBatchSize = 100
+
+// batchManifestName the name of the manifest in batch archives, written before the objects
+const batchManifestName = "manifest.json"
+
+// BatchEntry an object requested in a batch, by version or by the default version of a channel (prod if neither is given)
+type BatchEntry struct {
+	Category string `json:"category"`
+	Object   string `json:"object"`
+	Version  string `json:"version,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+}
+
+// BatchMember an object of a batch as it was resolved
+type BatchMember struct {
+	Category string `json:"category"`
+	Object   string `json:"object"`
+	// Channel the channel the version was resolved from, empty if the version was requested
+	Channel string `json:"channel,omitempty"`
+	Version string `json:"version"`
+	// Path the name of the object content in the archive, category/object/version
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	// Checksum hex encoded SHA-256 of the content. Empty for versions added before checksums were recorded
+	Checksum        string            `json:"checksum,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// BatchManifest describes the objects of a batch archive, in the order they were requested
+type BatchManifest struct {
+	Objects []BatchMember `json:"objects"`
+}
+
+// ResolveBatch resolves the version of every entry of a batch. Nothing is streamed before every
+// entry is resolved, so a batch that can not be served fails as a whole with the error of the first bad entry
+func (o ObjectController) ResolveBatch(entries []BatchEntry) (*BatchManifest, error) {
+	invalid := func(message string) error {
+		return RequestError{StatusCode: http.StatusBadRequest, Message: message}
+	}
+	if len(entries) == 0 || len(entries) > maxBatchSize {
+		return nil, invalid(fmt.Sprintf("A batch must request from 1 to %d objects", maxBatchSize))
+	}
+	manifest := &BatchManifest{}
+	for _, entry := range entries {
+		if len(entry.Category) == 0 || len(entry.Object) == 0 || strings.Contains(entry.Category+entry.Object, "/") {
+			return nil, invalid(fmt.Sprintf("Invalid batch entry %s/%s. Entries need a category and object name", entry.Category, entry.Object))
+		} else if strings.Contains(entry.Version, "/") || entry.Version == "." || entry.Version == ".." {
+			// versions can not be uploaded with these names, and they would be joined into another blob key
+			return nil, invalid(fmt.Sprintf("Invalid version %s of batch entry %s/%s", entry.Version, entry.Category, entry.Object))
+		} else if len(entry.Version) > 0 && len(entry.Channel) > 0 {
+			return nil, invalid(fmt.Sprintf("Batch entry %s/%s can have a version or a channel, not both", entry.Category, entry.Object))
+		}
+		objectName := entry.Category + "/" + entry.Object
+		version, channel := entry.Version, ""
+		if len(version) == 0 {
+			channel = entry.Channel
+			if len(channel) == 0 {
+				channel = ProdChannel
+			}
+			var err error
+			if version, err = o.ResolveObjectVersion(objectName, channel, time.Time{}); err != nil {
+				return nil, err
+			}
+		}
+		info, err := o.GetObjectInfo(objectName, version)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Objects = append(manifest.Objects, BatchMember{
+			Category:        entry.Category,
+			Object:          entry.Object,
+			Channel:         channel,
+			Version:         version,
+			Path:            objectName + "/" + version,
+			Size:            info.Size,
+			LastModified:    info.LastModified,
+			Checksum:        info.Checksum,
+			ContentType:     info.ContentType,
+			ContentEncoding: info.ContentEncoding,
+			Metadata:        info.Metadata,
+		})
+	}
+	return manifest, nil
+}
+
+// batchArchive writes the files of a batch archive
+type batchArchive interface {
+	add(name string, content io.Reader, size int64, modified time.Time) error
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) add(name string, content io.Reader, size int64, modified time.Time) error {
+	err := t.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t, content)
+	return err
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) add(name string, content io.Reader, size int64, modified time.Time) error {
+	writer, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// WriteBatch streams the manifest followed by the content of each object of a batch to w as a tar archive,
+// or a zip archive if zipped. Objects requested more than once are written once
+func (o ObjectController) WriteBatch(w io.Writer, manifest *BatchManifest, zipped bool) error {
+	var archive batchArchive = tarArchive{tar.NewWriter(w)}
+	if zipped {
+		archive = zipArchive{zip.NewWriter(w)}
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := archive.add(batchManifestName, bytes.NewReader(content), int64(len(content)), time.Now().UTC()); err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	for _, member := range manifest.Objects {
+		if written[member.Path] {
+			continue
+		}
+		written[member.Path] = true
+		object, err := o.getObjectFromStore(member.Category+"/"+member.Object, member.Version)
+		if err != nil {
+			return err
+		}
+		err = archive.add(member.Path, object, member.Size, member.LastModified)
+		object.Close()
+		if err != nil {
+			return fmt.Errorf("Unable to write object %s version %s to the batch. %s", member.Category+"/"+member.Object, member.Version, err.Error())
+		}
+	}
+	return archive.Close()
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when the requested key does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ObjectMetadata describes object content. It is saved with the content in the blob store
+type ObjectMetadata struct {
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	UserMetadata    map[string]string `json:"userMetadata,omitempty"`
+}
+
+// BlobInfo describes a blob held in a BlobStore
+type BlobInfo struct {
+	Size         int64
+	LastModified time.Time
+	Metadata     ObjectMetadata
+}
+
+// BlobStore is the storage backend holding object content
+// keys are slash separated paths, e.g. prefix/category/object/version
+type BlobStore interface {
+	// Put writes content to key, saving metadata (which may be nil) alongside it
+	Put(key string, content io.Reader, metadata *ObjectMetadata) error
+	// Get returns the content stored at key, or ErrBlobNotFound
+	Get(key string) (io.ReadCloser, error)
+	// GetRange returns length bytes of the content stored at key starting at offset.
+	// A negative length returns everything from offset to the end of the blob
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	// Head returns information about the blob stored at key, or ErrBlobNotFound
+	Head(key string) (*BlobInfo, error)
+	// List returns the names of the blobs under prefix. If a delimiter is provided
+	// the names of the "directories" directly under prefix are returned instead.
+	// token is the opaque token of the previous page, returned with each page but the last
+	List(prefix string, delimiter string, token string) (*ListResponse, error)
+	// Delete removes the blob stored at key
+	Delete(key string) error
+	// Move moves the blob stored at from to to with its metadata, without streaming its content
+	// through the caller. Returns ErrBlobNotFound if there is no blob at from
+	Move(from string, to string) error
+}
+
+const (
+	// MinUploadPartSize is the smallest part s3 accepts in a multipart upload
+	MinUploadPartSize int64 = 5 * 1024 * 1024
+	// DefaultUploadPartSize is the part size used when none is configured
+	DefaultUploadPartSize int64 = 8 * 1024 * 1024
+	// DefaultUploadConcurrency is the number of parts uploaded in parallel when none is configured
+	DefaultUploadConcurrency = 4
+	// maxCopyObjectSize is the largest object s3 copies with a single CopyObject call
+	maxCopyObjectSize int64 = 5 * 1024 * 1024 * 1024
+	// copyPartSize is the part size larger objects are copied in. s3 objects are at most 5TB, 5000 parts of it
+	copyPartSize int64 = 1024 * 1024 * 1024
+)
+
+// S3BlobStore a BlobStore backed by an s3 bucket
+// content is streamed to s3 in parts of partSize bytes, uploading up to concurrency parts at a time
+type S3BlobStore struct {
+	bucket      *string
+	s3          s3iface.S3API
+	partSize    int64
+	concurrency int
+}
+
+// NewS3BlobStore returns a BlobStore for the s3 bucket bucket
+// partSize and concurrency control multipart uploads. Zero values use the defaults
+func NewS3BlobStore(bucket string, partSize int64, concurrency int) *S3BlobStore {
+	var sess = session.Must(session.NewSession())
+	return &S3BlobStore{
+		bucket:      aws.String(bucket),
+		s3:          s3.New(sess),
+		partSize:    partSize,
+		concurrency: concurrency,
+	}
+}
+
+// isNotFound helper function for determining whether an aws error means the key does not exist
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		// head object doesn't return ErrCodeNoSuchKey
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return false
+}
+
+// Put streams content to key. Content that fits in a single part is written with
+// PutObject, anything larger with a multipart upload so that at most
+// concurrency+1 parts are held in memory at once
+func (s S3BlobStore) Put(key string, content io.Reader, metadata *ObjectMetadata) error {
+	partSize := s.partSize
+	if partSize == 0 {
+		partSize = DefaultUploadPartSize
+	} else if partSize < MinUploadPartSize {
+		partSize = MinUploadPartSize
+	}
+
+	// read the first part to find out if a multipart upload is needed
+	body := &eofReader{reader: content}
+	part := make([]byte, partSize)
+	n, last, err := readPart(body, part)
+	if err != nil {
+		return err
+	} else if last {
+		return s.putSinglePart(key, part[:n], metadata)
+	}
+	return s.putMultipart(key, part, body, metadata)
+}
+
+// eofReader records whether the reader it wraps ended with io.EOF. The http server returns
+// io.ErrUnexpectedEOF for request bodies cut off by the client, the same error io.ReadFull returns for
+// a short last part, so only io.EOF from the content itself means it was read entirely
+type eofReader struct {
+	reader io.Reader
+	eof    bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// readPart fills part from content, returning the number of bytes read and whether content ended.
+// Any error other than content ending, including content cut off part way, is returned
+func readPart(content *eofReader, part []byte) (int, bool, error) {
+	n, err := io.ReadFull(content, part)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && content.eof {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// s3Metadata converts ObjectMetadata to the s3 ContentType, ContentEncoding and Metadata fields
+func s3Metadata(metadata *ObjectMetadata) (contentType *string, contentEncoding *string, userMetadata map[string]*string) {
+	if metadata == nil {
+		return nil, nil, nil
+	}
+	if len(metadata.ContentType) > 0 {
+		contentType = aws.String(metadata.ContentType)
+	}
+	if len(metadata.ContentEncoding) > 0 {
+		contentEncoding = aws.String(metadata.ContentEncoding)
+	}
+	if len(metadata.UserMetadata) > 0 {
+		userMetadata = aws.StringMap(metadata.UserMetadata)
+	}
+	return contentType, contentEncoding, userMetadata
+}
+
+// putSinglePart writes content to key with a single PutObject call
+func (s S3BlobStore) putSinglePart(key string, content []byte, metadata *ObjectMetadata) error {
+	byteReader := bytes.NewReader(content)
+	contentType, contentEncoding, userMetadata := s3Metadata(metadata)
+	// I don't think there are retryable errors for s3.putobject
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:          s.bucket,
+		Key:             aws.String(key),
+		Body:            aws.ReadSeekCloser(byteReader),
+		ContentLength:   aws.Int64(int64(byteReader.Len())),
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Metadata:        userMetadata,
+	})
+	return err
+}
+
+// putMultipart streams firstPart followed by the rest of content to key as a multipart upload
+// the upload is aborted if reading content or uploading any part fails, so no partial object is left behind
+func (s S3BlobStore) putMultipart(key string, firstPart []byte, content *eofReader, metadata *ObjectMetadata) error {
+	concurrency := s.concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultUploadConcurrency
+	}
+
+	contentType, contentEncoding, userMetadata := s3Metadata(metadata)
+	upload, err := s.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:          s.bucket,
+		Key:             aws.String(key),
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Metadata:        userMetadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		uploadErr error
+		completed = make([]*s3.CompletedPart, 0)
+		// limits the number of parts being uploaded, and so held in memory, at once
+		inFlight = make(chan struct{}, concurrency)
+	)
+	setErr := func(err error) {
+		mu.Lock()
+		if uploadErr == nil {
+			uploadErr = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploadErr != nil
+	}
+
+	part := firstPart
+	lastPart := false
+	for partNumber := int64(1); !failed(); partNumber++ {
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func(partNumber int64, body []byte) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			res, err := s.s3.UploadPart(&s3.UploadPartInput{
+				Bucket:        s.bucket,
+				Key:           aws.String(key),
+				UploadId:      upload.UploadId,
+				PartNumber:    aws.Int64(partNumber),
+				Body:          bytes.NewReader(body),
+				ContentLength: aws.Int64(int64(len(body))),
+			})
+			if err != nil {
+				setErr(err)
+				return
+			}
+			mu.Lock()
+			completed = append(completed, &s3.CompletedPart{
+				ETag:       res.ETag,
+				PartNumber: aws.Int64(partNumber),
+			})
+			mu.Unlock()
+		}(partNumber, part)
+
+		if lastPart {
+			break
+		}
+		part = make([]byte, len(firstPart))
+		n, last, err := readPart(content, part)
+		if err != nil {
+			setErr(err)
+		} else if last && n == 0 {
+			break
+		} else if last {
+			part = part[:n]
+			lastPart = true
+		}
+	}
+	wg.Wait()
+
+	if uploadErr == nil {
+		sort.Slice(completed, func(i, j int) bool {
+			return *completed[i].PartNumber < *completed[j].PartNumber
+		})
+		_, uploadErr = s.s3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          s.bucket,
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		})
+	}
+	if uploadErr != nil {
+		s.abortMultipart(key, upload.UploadId)
+	}
+	return uploadErr
+}
+
+// abortMultipart aborts a failed multipart upload to key, so its parts are removed
+func (s S3BlobStore) abortMultipart(key string, uploadID *string) {
+	_, err := s.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   s.bucket,
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	// the uploaded parts are kept (and charged for) until the bucket lifecycle rule removes them
+	if err != nil {
+		log.Printf("Unable to abort multipart upload %s of %s. %s", aws.StringValue(uploadID), key, err.Error())
+	}
+}
+
+// Get returns the content stored at key
+func (s S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	res, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// GetRange returns part of the content stored at key using a ranged GetObject
+func (s S3BlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+	res, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Head returns the size, modification time and metadata of the blob stored at key
+func (s S3BlobStore) Head(key string) (*BlobInfo, error) {
+	res, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	info := &BlobInfo{
+		Size:         aws.Int64Value(res.ContentLength),
+		LastModified: aws.TimeValue(res.LastModified),
+		Metadata: ObjectMetadata{
+			ContentType:     aws.StringValue(res.ContentType),
+			ContentEncoding: aws.StringValue(res.ContentEncoding),
+		},
+	}
+	if len(res.Metadata) > 0 {
+		info.Metadata.UserMetadata = aws.StringValueMap(res.Metadata)
+	}
+	return info, nil
+}
+
+// List returns a list of blob names for a given prefix
+// the token is the s3 continuation token of the previous page
+func (s S3BlobStore) List(prefix string, delimiter string, token string) (*ListResponse, error) {
+	isDelimiter := len(delimiter) > 0
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:    s.bucket,
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String(delimiter),
+	}
+	// continue the previous page if token is provided
+	if len(token) > 0 {
+		input.ContinuationToken = aws.String(token)
+	}
+
+	objects, err := s.s3.ListObjectsV2(input)
+	if err != nil {
+		return nil, err
+	}
+	// format response
+	res := &ListResponse{}
+
+	// collect Items
+	keys := make([]string, 0)
+	// if delimiter is provided we are treating CommonPrefixes as the items
+	if isDelimiter {
+		for _, k := range objects.CommonPrefixes {
+			// strip out the prefix and trailing delimiter
+			name := strings.TrimPrefix(*k.Prefix, prefix)
+			keys = append(keys, strings.TrimSuffix(name, delimiter))
+		}
+	} else {
+		for _, k := range objects.Contents {
+			// only want the last item in the path for a key
+			splitKey := strings.Split(*k.Key, "/")
+			keys = append(keys, splitKey[len(splitKey)-1])
+		}
+	}
+	res.Objects = keys
+
+	// set pagination token
+	if aws.BoolValue(objects.IsTruncated) {
+		res.Token = aws.StringValue(objects.NextContinuationToken)
+	}
+
+	return res, nil
+}
+
+// Delete removes the blob stored at key
+func (s S3BlobStore) Delete(key string) error {
+	_, err := s.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: s.bucket,
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Move copies the blob stored at from to to inside the bucket, then deletes it. s3 copies the content and
+// metadata itself, with CopyObject or, for objects too large for it, a multipart upload of UploadPartCopy parts
+func (s S3BlobStore) Move(from string, to string) error {
+	info, err := s.Head(from)
+	if err != nil {
+		return err
+	}
+	source := (&url.URL{Path: aws.StringValue(s.bucket) + "/" + from}).EscapedPath()
+	if info.Size <= maxCopyObjectSize {
+		_, err = s.s3.CopyObject(&s3.CopyObjectInput{
+			Bucket:     s.bucket,
+			Key:        aws.String(to),
+			CopySource: aws.String(source),
+		})
+	} else {
+		err = s.copyMultipart(source, to, info, copyPartSize)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Delete(from)
+}
+
+// copyMultipart copies the blob described by info from source (bucket/key, escaped) to key in parts of partSize bytes
+func (s S3BlobStore) copyMultipart(source string, key string, info *BlobInfo, partSize int64) error {
+	contentType, contentEncoding, userMetadata := s3Metadata(&info.Metadata)
+	upload, err := s.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:          s.bucket,
+		Key:             aws.String(key),
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		Metadata:        userMetadata,
+	})
+	if err != nil {
+		return err
+	}
+	completed := []*s3.CompletedPart{}
+	for offset, partNumber := int64(0), int64(1); offset < info.Size; offset, partNumber = offset+partSize, partNumber+1 {
+		end := offset + partSize - 1
+		if end >= info.Size {
+			end = info.Size - 1
+		}
+		res, err := s.s3.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          s.bucket,
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(partNumber),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			s.abortMultipart(key, upload.UploadId)
+			return err
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: res.CopyPartResult.ETag, PartNumber: aws.Int64(partNumber)})
+	}
+	_, err = s.s3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          s.bucket,
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		s.abortMultipart(key, upload.UploadId)
+	}
+	return err
+}
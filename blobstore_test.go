@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type MockS3 struct {
+	s3iface.S3API
+	bucket         map[string]string
+	putObjectErr   error
+	getObjectErr   error
+	headObjectErr  error
+	listObjectsErr error
+	uploadPartErr  error
+	// content type, encoding and user metadata stored with each key
+	metadata map[string]ObjectMetadata
+	// in progress multipart uploads, upload id -> part number -> content
+	uploads        map[string]map[int64][]byte
+	abortedUploads int
+	copiedObjects  int
+	mu             sync.Mutex
+}
+
+// mocks s3 ListObjectsV2, but always returns page size of 1.
+// continuation tokens are the last key or common prefix listed
+func (m *MockS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if m.listObjectsErr != nil {
+		return nil, m.listObjectsErr
+	}
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+
+	keys := []string{}
+	for k := range m.bucket {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	// entries are keys, or common prefixes if a delimiter is provided
+	entries := []string{}
+	for _, k := range keys {
+		entry := k
+		if len(delimiter) > 0 {
+			idx := strings.Index(k[len(prefix):], delimiter)
+			if idx < 0 {
+				continue
+			}
+			entry = k[:len(prefix)+idx+len(delimiter)]
+		}
+		if entry <= aws.StringValue(input.ContinuationToken) || len(entries) > 0 && entries[len(entries)-1] == entry {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(len(entries) > 1)}
+	if len(entries) > 1 {
+		entries = entries[:1]
+		output.NextContinuationToken = aws.String(entries[0])
+	}
+	for _, entry := range entries {
+		if len(delimiter) > 0 {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+		} else {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(entry)})
+		}
+	}
+	return output, nil
+}
+
+func (m *MockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if m.putObjectErr != nil {
+		return nil, m.putObjectErr
+	}
+	content, _ := ioutil.ReadAll(input.Body)
+	m.bucket[*input.Key] = string(content)
+	m.setMetadata(*input.Key, input.ContentType, input.ContentEncoding, input.Metadata)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *MockS3) setMetadata(key string, contentType *string, contentEncoding *string, userMetadata map[string]*string) {
+	if m.metadata == nil {
+		m.metadata = make(map[string]ObjectMetadata)
+	}
+	metadata := ObjectMetadata{
+		ContentType:     aws.StringValue(contentType),
+		ContentEncoding: aws.StringValue(contentEncoding),
+	}
+	// s3 returns user metadata keys in canonical header form
+	for k, v := range userMetadata {
+		if metadata.UserMetadata == nil {
+			metadata.UserMetadata = make(map[string]string)
+		}
+		metadata.UserMetadata[http.CanonicalHeaderKey(k)] = *v
+	}
+	m.metadata[key] = metadata
+}
+
+func (m *MockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if m.getObjectErr != nil {
+		return nil, m.getObjectErr
+	}
+	body, ok := m.bucket[*input.Key]
+
+	if ok {
+		// only supports the bytes=start- and bytes=start-end forms
+		if input.Range != nil {
+			var start, end int
+			if n, _ := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); n == 2 {
+				body = body[start : end+1]
+			} else {
+				body = body[start:]
+			}
+		}
+		return &s3.GetObjectOutput{
+			Body: aws.ReadSeekCloser(strings.NewReader(body)),
+		}, nil
+	}
+	return nil, awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("object %s does not exist", *input.Key), errors.New("the heck happened"))
+}
+
+func (m *MockS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	if m.headObjectErr != nil {
+		return nil, m.headObjectErr
+	}
+	body, ok := m.bucket[*input.Key]
+	if !ok {
+		return nil, awserr.New("NotFound", "no such key", errors.New("ok"))
+	}
+	metadata := m.metadata[*input.Key]
+	output := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(body))),
+		LastModified:  aws.Time(time.Date(2018, time.October, 1, 12, 0, 0, 0, time.UTC)),
+	}
+	if len(metadata.ContentType) > 0 {
+		output.ContentType = aws.String(metadata.ContentType)
+	}
+	if len(metadata.ContentEncoding) > 0 {
+		output.ContentEncoding = aws.String(metadata.ContentEncoding)
+	}
+	if len(metadata.UserMetadata) > 0 {
+		output.Metadata = aws.StringMap(metadata.UserMetadata)
+	}
+	return output, nil
+}
+
+func (m *MockS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.uploads == nil {
+		m.uploads = make(map[string]map[int64][]byte)
+	}
+	uploadID := fmt.Sprintf("upload-%d", len(m.uploads)+m.abortedUploads)
+	m.uploads[uploadID] = make(map[int64][]byte)
+	m.setMetadata(uploadID, input.ContentType, input.ContentEncoding, input.Metadata)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (m *MockS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if m.uploadPartErr != nil {
+		return nil, m.uploadPartErr
+	}
+	content, _ := ioutil.ReadAll(input.Body)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[*input.UploadId][*input.PartNumber] = content
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", *input.PartNumber))}, nil
+}
+
+func (m *MockS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts := m.uploads[*input.UploadId]
+	content := ""
+	for i, part := range input.MultipartUpload.Parts {
+		if *part.PartNumber != int64(i+1) {
+			return nil, errors.New("parts must be completed in order")
+		}
+		content += string(parts[*part.PartNumber])
+	}
+	m.bucket[*input.Key] = content
+	m.metadata[*input.Key] = m.metadata[*input.UploadId]
+	delete(m.uploads, *input.UploadId)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *MockS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.uploads, *input.UploadId)
+	m.abortedUploads++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// copySource the key of a CopySource, which is the escaped bucket/key
+func copySource(source *string) string {
+	unescaped, _ := url.PathUnescape(aws.StringValue(source))
+	return strings.SplitN(unescaped, "/", 2)[1]
+}
+
+func (m *MockS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	source := copySource(input.CopySource)
+	body, ok := m.bucket[source]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("object %s does not exist", source), errors.New("ok"))
+	}
+	m.bucket[*input.Key] = body
+	if m.metadata != nil {
+		m.metadata[*input.Key] = m.metadata[source]
+	}
+	m.copiedObjects++
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *MockS3) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	var start, end int
+	fmt.Sscanf(*input.CopySourceRange, "bytes=%d-%d", &start, &end)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[*input.UploadId][*input.PartNumber] = []byte(m.bucket[copySource(input.CopySource)][start : end+1])
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("etag-%d", *input.PartNumber))}}, nil
+}
+
+func (m *MockS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(m.bucket, *input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func mockS3Store(m *MockS3) *S3BlobStore {
+	return &S3BlobStore{
+		bucket: aws.String("unit test"),
+		s3:     m,
+	}
+}
+
+func TestS3BlobStorePut(t *testing.T) {
+	store := mockS3Store(&MockS3{
+		bucket: make(map[string]string),
+	})
+
+	err := store.Put("dang/unit test/123", strings.NewReader("heyyaaaaa"), &ObjectMetadata{
+		ContentType:  "application/json",
+		UserMetadata: map[string]string{"build-id": "42"},
+	})
+
+	if err != nil {
+		t.Fatalf("received unexpected error putting object: %s", err.Error())
+	}
+	info, _ := store.Head("dang/unit test/123")
+	if info.Metadata.ContentType != "application/json" || info.Metadata.UserMetadata["Build-Id"] != "42" {
+		t.Fatalf("S3BlobStore.Head should return the metadata stored with the object. Is: %+v", info.Metadata)
+	}
+}
+
+// errorReader returns content and then fails with err, like a client disconnecting mid upload
+type errorReader struct {
+	content io.Reader
+	err     error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.content.Read(p)
+	if err == io.EOF {
+		if e.err != nil {
+			return n, e.err
+		}
+		return n, errors.New("client went away")
+	}
+	return n, err
+}
+
+func TestS3BlobStorePutMultipart(t *testing.T) {
+	mock := &MockS3{
+		bucket: make(map[string]string),
+	}
+	store := mockS3Store(mock)
+	store.partSize = MinUploadPartSize
+	store.concurrency = 2
+
+	// two full parts and a partial one
+	content := strings.Repeat("a", int(MinUploadPartSize)) + strings.Repeat("b", int(MinUploadPartSize)) + "ccc"
+	if err := store.Put("dang/big/object/1", strings.NewReader(content), nil); err != nil {
+		t.Fatalf("S3BlobStore.Put returned an error for a multipart upload: %v", err)
+	}
+	if mock.bucket["dang/big/object/1"] != content {
+		t.Fatalf("S3BlobStore.Put multipart upload did not store the full content. Stored %d bytes", len(mock.bucket["dang/big/object/1"]))
+	}
+	if len(mock.uploads) != 0 {
+		t.Fatalf("S3BlobStore.Put should complete every multipart upload it starts")
+	}
+
+	// reading the body fails part way through
+	err := store.Put("dang/big/object/2", &errorReader{content: strings.NewReader(content)}, nil)
+	if err == nil {
+		t.Fatalf("S3BlobStore.Put should return an error when the content can not be read")
+	}
+	if _, ok := mock.bucket["dang/big/object/2"]; ok || mock.abortedUploads != 1 {
+		t.Fatalf("S3BlobStore.Put should abort the multipart upload when reading fails. Aborted uploads: %d", mock.abortedUploads)
+	}
+
+	// the http server returns io.ErrUnexpectedEOF for bodies cut off before their Content-Length
+	err = store.Put("dang/big/object/4", &errorReader{content: strings.NewReader(content), err: io.ErrUnexpectedEOF}, nil)
+	if _, ok := mock.bucket["dang/big/object/4"]; err == nil || ok || mock.abortedUploads != 2 {
+		t.Fatalf("S3BlobStore.Put should abort the multipart upload when the content is cut off. Error: %v, Aborted uploads: %d", err, mock.abortedUploads)
+	}
+	err = store.Put("dang/small/object/4", &errorReader{content: strings.NewReader("cut"), err: io.ErrUnexpectedEOF}, nil)
+	if _, ok := mock.bucket["dang/small/object/4"]; err == nil || ok {
+		t.Fatalf("S3BlobStore.Put should not store content that is cut off. Error: %v", err)
+	}
+
+	// a part fails to upload
+	mock.uploadPartErr = errors.New("whoa")
+	err = store.Put("dang/big/object/3", strings.NewReader(content), nil)
+	if err == nil {
+		t.Fatalf("S3BlobStore.Put should return an error when a part fails to upload")
+	}
+	if _, ok := mock.bucket["dang/big/object/3"]; ok || mock.abortedUploads != 3 {
+		t.Fatalf("S3BlobStore.Put should abort the multipart upload when a part fails. Aborted uploads: %d", mock.abortedUploads)
+	}
+}
+
+func TestS3BlobStoreGetHeadDelete(t *testing.T) {
+	store := mockS3Store(&MockS3{
+		bucket: map[string]string{
+			"dang/fun/foo.obj/123abc": "wonderful magic content",
+		},
+	})
+
+	body, err := store.Get("dang/fun/foo.obj/123abc")
+	if err != nil {
+		t.Fatalf("S3BlobStore.Get should not return an error when the key exists: %v", err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	if string(content) != "wonderful magic content" {
+		t.Fatalf("S3BlobStore.Get returned the wrong content: %s", string(content))
+	}
+
+	body, err = store.GetRange("dang/fun/foo.obj/123abc", 10, 5)
+	if err != nil {
+		t.Fatalf("S3BlobStore.GetRange should not return an error when the key exists: %v", err)
+	}
+	content, _ = ioutil.ReadAll(body)
+	if string(content) != "magic" {
+		t.Fatalf("S3BlobStore.GetRange returned the wrong content: %s", string(content))
+	}
+	body, _ = store.GetRange("dang/fun/foo.obj/123abc", 16, -1)
+	content, _ = ioutil.ReadAll(body)
+	if string(content) != "content" {
+		t.Fatalf("S3BlobStore.GetRange with no length should read to the end. Returned: %s", string(content))
+	}
+
+	info, err := store.Head("dang/fun/foo.obj/123abc")
+	if err != nil || info.Size != int64(len("wonderful magic content")) {
+		t.Fatalf("S3BlobStore.Head should return the blob size. Info: %+v, Error: %v", info, err)
+	}
+
+	if err := store.Delete("dang/fun/foo.obj/123abc"); err != nil {
+		t.Fatalf("S3BlobStore.Delete returned an error: %v", err)
+	}
+	if _, err := store.Get("dang/fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("S3BlobStore.Get should return ErrBlobNotFound after delete. Returned: %v", err)
+	}
+	if _, err := store.Head("dang/fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("S3BlobStore.Head should return ErrBlobNotFound after delete. Returned: %v", err)
+	}
+}
+
+func TestS3BlobStoreMove(t *testing.T) {
+	mock := &MockS3{
+		bucket: map[string]string{
+			"dang/fun/foo.obj/123abc": "wonderful magic content",
+		},
+		metadata: map[string]ObjectMetadata{
+			"dang/fun/foo.obj/123abc": {ContentType: "text/plain"},
+		},
+	}
+	store := mockS3Store(mock)
+
+	if err := store.Move("dang/fun/foo.obj/123abc", "dang/.trash/fun/foo.obj/123abc"); err != nil {
+		t.Fatalf("S3BlobStore.Move returned an error: %v", err)
+	}
+	if mock.copiedObjects != 1 || mock.bucket["dang/.trash/fun/foo.obj/123abc"] != "wonderful magic content" {
+		t.Fatalf("S3BlobStore.Move should copy the content in the bucket. Bucket: %v", mock.bucket)
+	}
+	if info, _ := store.Head("dang/.trash/fun/foo.obj/123abc"); info.Metadata.ContentType != "text/plain" {
+		t.Fatalf("S3BlobStore.Move should keep the metadata. Is: %+v", info.Metadata)
+	}
+	if _, ok := mock.bucket["dang/fun/foo.obj/123abc"]; ok {
+		t.Fatalf("S3BlobStore.Move should delete the original")
+	}
+	if err := store.Move("dang/fun/foo.obj/123abc", "dang/.trash/fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("S3BlobStore.Move should return ErrBlobNotFound for missing blobs. Returned: %v", err)
+	}
+
+	// objects too large for CopyObject are copied a part at a time
+	info, _ := store.Head("dang/.trash/fun/foo.obj/123abc")
+	if err := store.copyMultipart("unit%20test/dang/.trash/fun/foo.obj/123abc", "dang/fun/foo.obj/123abc", info, 10); err != nil {
+		t.Fatalf("S3BlobStore.copyMultipart returned an error: %v", err)
+	}
+	if content := mock.bucket["dang/fun/foo.obj/123abc"]; content != "wonderful magic content" {
+		t.Fatalf("S3BlobStore.copyMultipart should copy every part. Copied: %s", content)
+	}
+	if metadata := mock.metadata["dang/fun/foo.obj/123abc"]; metadata.ContentType != "text/plain" {
+		t.Fatalf("S3BlobStore.copyMultipart should keep the metadata. Is: %+v", metadata)
+	}
+}
+
+func TestS3BlobStoreList(t *testing.T) {
+	store := mockS3Store(&MockS3{
+		bucket: map[string]string{
+			"foo.obj/123abc": "wonderful magic content",
+			"bar.obj/456789": "more incredible content",
+		},
+	})
+	res, _ := store.List("", "", "")
+	if len(res.Token) == 0 || strings.Join(res.Objects, ",") != "456789" {
+		t.Fatalf("S3BlobStore.List should have returned the first page and a token. Returned: %v, Token: %s", res.Objects, res.Token)
+	}
+	res, _ = store.List("", "", res.Token)
+	if len(res.Token) != 0 || strings.Join(res.Objects, ",") != "123abc" {
+		t.Fatalf("S3BlobStore.List should continue with the second and last page. Returned: %v, Token: %s", res.Objects, res.Token)
+	}
+
+	delimiterRes, _ := store.List("", "/", "")
+	if strings.Join(delimiterRes.Objects, ",") != "bar.obj" {
+		t.Fatalf("when / is provided as a delimiter the objects should be listed, starting with bar.obj. Was: %v", delimiterRes.Objects)
+	}
+	delimiterRes, _ = store.List("", "/", delimiterRes.Token)
+	if strings.Join(delimiterRes.Objects, ",") != "foo.obj" {
+		t.Fatalf("the second page should list foo.obj. Was: %v", delimiterRes.Objects)
+	}
+}
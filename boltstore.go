@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bolt bucket holding the default versions of each object, keyed by object name
+var boltDefaultsBucket = []byte("defaults")
+
+// bolt bucket holding the info recorded for each object version, keyed by object name/version
+var boltVersionsBucket = []byte("versions")
+
+// bolt bucket holding the history of changes to the default versions of each object, keyed by object name
+var boltHistoryBucket = []byte("history")
+
+// bolt bucket holding the tags of each object as a json map of tag to version, keyed by object name
+var boltTagsBucket = []byte("tags")
+
+// bolt bucket holding the index, a bucket per category holding a bucket per object holding
+// the IndexEntry json of each version, keyed by version
+var boltIndexBucket = []byte("index")
+
+// bolt bucket holding the Category json of each registered category, keyed by category name
+var boltCategoriesBucket = []byte("categories")
+
+// boltDefaults the default versions of an object as stored in bolt, keyed by the same
+// attribute names used in dynamodb (see channelAttribute)
+type boltDefaults map[string]string
+
+// BoltVersionStore a VersionStore backed by an embedded bolt database file
+// for running without dynamodb
+type BoltVersionStore struct {
+	db *bolt.DB
+}
+
+// NewBoltVersionStore opens (or creates) the bolt database at filename
+func NewBoltVersionStore(filename string) (*BoltVersionStore, error) {
+	// the timeout stops a second process from blocking forever on the file lock
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltDefaultsBucket, boltVersionsBucket, boltHistoryBucket, boltTagsBucket, boltIndexBucket, boltCategoriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltVersionStore{db: db}, nil
+}
+
+// Close closes the underlying bolt database
+func (b BoltVersionStore) Close() error {
+	return b.db.Close()
+}
+
+func getBoltDefaults(tx *bolt.Tx, objectName string) (boltDefaults, error) {
+	defaults := boltDefaults{}
+	raw := tx.Bucket(boltDefaultsBucket).Get([]byte(objectName))
+	if raw == nil {
+		return defaults, nil
+	}
+	if err := json.Unmarshal(raw, &defaults); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+// GetVersion returns the default version of objectName in channel
+func (b BoltVersionStore) GetVersion(objectName string, channel string) (string, error) {
+	var defaults boltDefaults
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		defaults, err = getBoltDefaults(tx, objectName)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if version := defaults[channelAttribute(channel)]; len(version) > 0 {
+		return version, nil
+	}
+	return "", noVersionSet(objectName, channel)
+}
+
+// SetVersion sets the default version of objectName in channel
+func (b BoltVersionStore) SetVersion(objectName string, channel string, version string, requester string) error {
+	return b.setVersion(objectName, []string{channel}, channel, nil, version, requester)
+}
+
+// SetProdVersion sets the prod and dev versions of objectName in the same transaction
+func (b BoltVersionStore) SetProdVersion(objectName string, version string, requester string) error {
+	return b.setVersion(objectName, []string{ProdChannel, DevChannel}, ProdChannel, nil, version, requester)
+}
+
+// CompareAndSetVersion sets the default version of objectName in channel if the current version is expected
+func (b BoltVersionStore) CompareAndSetVersion(objectName string, channel string, expected string, version string, requester string) error {
+	return b.setVersion(objectName, []string{channel}, channel, &expected, version, requester)
+}
+
+// PromoteVersion sets the default version of objectName in channel to to version, if it is the default of channel from
+func (b BoltVersionStore) PromoteVersion(objectName string, from string, to string, version string, requester string) error {
+	return b.setVersion(objectName, []string{to}, from, &version, version, requester)
+}
+
+// setVersion sets the default version of objectName in channels, first checking the current version of channel checked
+// is expected if it is set.
+// the change is recorded in the history in the same transaction
+func (b BoltVersionStore) setVersion(objectName string, channels []string, checked string, expected *string, version string, requester string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		defaults, err := getBoltDefaults(tx, objectName)
+		if err != nil {
+			return err
+		}
+		current := defaults[channelAttribute(checked)]
+		if expected != nil && (len(current) == 0 || current != *expected && *expected != "*") {
+			return VersionMismatchError{ObjectName: objectName, Channel: checked, Expected: *expected, Current: current}
+		}
+		changes := channelChanges(channels, version, requester, defaults)
+		for _, channel := range channels {
+			defaults[channelAttribute(channel)] = version
+		}
+		raw, err := json.Marshal(defaults)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltDefaultsBucket).Put([]byte(objectName), raw); err != nil {
+			return err
+		}
+		return appendBoltHistory(tx, objectName, changes)
+	})
+}
+
+func getBoltHistory(tx *bolt.Tx, objectName string) ([]VersionChange, error) {
+	changes := []VersionChange{}
+	raw := tx.Bucket(boltHistoryBucket).Get([]byte(objectName))
+	if raw == nil {
+		return changes, nil
+	}
+	if err := json.Unmarshal(raw, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// appendBoltHistory appends changes to the history of objectName, dropping the oldest changes past historyLimit
+func appendBoltHistory(tx *bolt.Tx, objectName string, changes []VersionChange) error {
+	history, err := getBoltHistory(tx, objectName)
+	if err != nil {
+		return err
+	}
+	history = append(history, changes...)
+	if len(history) > historyLimit {
+		history = history[len(history)-historyLimit:]
+	}
+	raw, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltHistoryBucket).Put([]byte(objectName), raw)
+}
+
+// GetHistory returns the changes made to the default versions of objectName, oldest first
+func (b BoltVersionStore) GetHistory(objectName string) ([]VersionChange, error) {
+	var history []VersionChange
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		history, err = getBoltHistory(tx, objectName)
+		return err
+	})
+	return history, err
+}
+
+// AppendHistory records changes in the history of objectName
+func (b BoltVersionStore) AppendHistory(objectName string, changes []VersionChange) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return appendBoltHistory(tx, objectName, changes)
+	})
+}
+
+// GetDefaults returns the default versions of objectName, keyed by channel
+func (b BoltVersionStore) GetDefaults(objectName string) (map[string]string, error) {
+	var defaults boltDefaults
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		defaults, err = getBoltDefaults(tx, objectName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	channels := map[string]string{}
+	for attribute, version := range defaults {
+		if channel, ok := attributeChannel(attribute); ok {
+			channels[channel] = version
+		}
+	}
+	return channels, nil
+}
+
+// ClearVersion removes the default version of objectName in channel if it is expected
+func (b BoltVersionStore) ClearVersion(objectName string, channel string, expected string, requester string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		defaults, err := getBoltDefaults(tx, objectName)
+		if err != nil {
+			return err
+		}
+		current := defaults[channelAttribute(channel)]
+		if current != expected {
+			return VersionMismatchError{ObjectName: objectName, Channel: channel, Expected: expected, Current: current}
+		}
+		delete(defaults, channelAttribute(channel))
+		raw, err := json.Marshal(defaults)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltDefaultsBucket).Put([]byte(objectName), raw); err != nil {
+			return err
+		}
+		return appendBoltHistory(tx, objectName, clearedChanges(map[string]string{channel: expected}, requester))
+	})
+}
+
+// DeleteDefaults removes all default versions of objectName
+func (b BoltVersionStore) DeleteDefaults(objectName string, requester string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		defaults, err := getBoltDefaults(tx, objectName)
+		if err != nil || len(defaults) == 0 {
+			return err
+		}
+		if err := tx.Bucket(boltDefaultsBucket).Delete([]byte(objectName)); err != nil {
+			return err
+		}
+		previous := map[string]string{}
+		for attribute, version := range defaults {
+			if channel, ok := attributeChannel(attribute); ok {
+				previous[channel] = version
+			}
+		}
+		return appendBoltHistory(tx, objectName, clearedChanges(previous, requester))
+	})
+}
+
+// GetVersionInfo returns the info recorded for version of objectName, nil if there is none
+func (b BoltVersionStore) GetVersionInfo(objectName string, version string) (*VersionInfo, error) {
+	var info *VersionInfo
+	err := b.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(boltVersionsBucket).Get([]byte(versionItemName(objectName, version)))
+		if raw == nil {
+			return nil
+		}
+		info = &VersionInfo{}
+		return json.Unmarshal(raw, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// CreateVersionInfo records info for a new version of objectName, unless the version already exists.
+// bolt serializes update transactions so the check and the write are atomic
+func (b BoltVersionStore) CreateVersionInfo(objectName string, version string, info *VersionInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltVersionsBucket)
+		key := []byte(versionItemName(objectName, version))
+		if existing := bucket.Get(key); existing != nil {
+			current := VersionInfo{}
+			if err := json.Unmarshal(existing, &current); err != nil {
+				return err
+			}
+			if !current.replaceable(time.Now()) {
+				return ErrVersionExists
+			}
+		}
+		return bucket.Put(key, raw)
+	})
+}
+
+// PutVersionInfo records info for version of objectName
+func (b BoltVersionStore) PutVersionInfo(objectName string, version string, info *VersionInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVersionsBucket).Put([]byte(versionItemName(objectName, version)), raw)
+	})
+}
+
+// DeleteVersionInfo removes the info recorded for version of objectName
+func (b BoltVersionStore) DeleteVersionInfo(objectName string, version string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVersionsBucket).Delete([]byte(versionItemName(objectName, version)))
+	})
+}
+
+func getBoltTags(tx *bolt.Tx, objectName string) (map[string]string, error) {
+	tags := map[string]string{}
+	raw := tx.Bucket(boltTagsBucket).Get([]byte(objectName))
+	if raw == nil {
+		return tags, nil
+	}
+	err := json.Unmarshal(raw, &tags)
+	return tags, err
+}
+
+func putBoltTags(tx *bolt.Tx, objectName string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return tx.Bucket(boltTagsBucket).Delete([]byte(objectName))
+	}
+	raw, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltTagsBucket).Put([]byte(objectName), raw)
+}
+
+// GetTags returns the versions the tags of objectName point at, keyed by tag
+func (b BoltVersionStore) GetTags(objectName string) (map[string]string, error) {
+	var tags map[string]string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tags, err = getBoltTags(tx, objectName)
+		return err
+	})
+	return tags, err
+}
+
+// SetTag points tag of objectName at version, returning the version it pointed at before
+func (b BoltVersionStore) SetTag(objectName string, tag string, version string) (string, error) {
+	var previous string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		tags, err := getBoltTags(tx, objectName)
+		if err != nil {
+			return err
+		}
+		previous = tags[tag]
+		tags[tag] = version
+		return putBoltTags(tx, objectName, tags)
+	})
+	return previous, err
+}
+
+// DeleteTag removes tag of objectName, returning ErrTagNotFound if it is not set
+func (b BoltVersionStore) DeleteTag(objectName string, tag string) (string, error) {
+	var previous string
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		tags, err := getBoltTags(tx, objectName)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if previous, ok = tags[tag]; !ok {
+			return ErrTagNotFound
+		}
+		delete(tags, tag)
+		return putBoltTags(tx, objectName, tags)
+	})
+	return previous, err
+}
+
+// DeleteTags removes every tag of objectName
+func (b BoltVersionStore) DeleteTags(objectName string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTagsBucket).Delete([]byte(objectName))
+	})
+}
+
+// IndexVersion records the version in the bucket of its object, creating the buckets of the object and category
+func (b BoltVersionStore) IndexVersion(categoryName string, objectName string, entry IndexEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		category, err := tx.Bucket(boltIndexBucket).CreateBucketIfNotExists([]byte(categoryName))
+		if err != nil {
+			return err
+		}
+		object, err := category.CreateBucketIfNotExists([]byte(objectName))
+		if err != nil {
+			return err
+		}
+		return object.Put([]byte(entry.Version), raw)
+	})
+}
+
+// UnindexVersion removes the version, and the buckets of its object and category once they are empty
+func (b BoltVersionStore) UnindexVersion(categoryName string, objectName string, version string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(boltIndexBucket)
+		category := index.Bucket([]byte(categoryName))
+		if category == nil {
+			return nil
+		}
+		object := category.Bucket([]byte(objectName))
+		if object == nil {
+			return nil
+		}
+		if err := object.Delete([]byte(version)); err != nil {
+			return err
+		}
+		if key, _ := object.Cursor().First(); key != nil {
+			return nil
+		}
+		if err := category.DeleteBucket([]byte(objectName)); err != nil {
+			return err
+		}
+		if key, _ := category.Cursor().First(); key != nil {
+			return nil
+		}
+		return index.DeleteBucket([]byte(categoryName))
+	})
+}
+
+// listBoltBucket calls found with up to limit keys and values of bucket starting with prefix, starting after after
+func listBoltBucket(bucket *bolt.Bucket, prefix string, after string, limit int, found func(key []byte, value []byte) error) error {
+	if bucket == nil {
+		return nil
+	}
+	cursor := bucket.Cursor()
+	// keys are sorted, so the keys starting with prefix follow it
+	start := after
+	if prefix > after {
+		start = prefix
+	}
+	key, value := cursor.Seek([]byte(start))
+	if key != nil && string(key) == after {
+		key, value = cursor.Next()
+	}
+	for listed := 0; key != nil && strings.HasPrefix(string(key), prefix) && listed < limit; listed++ {
+		if err := found(key, value); err != nil {
+			return err
+		}
+		key, value = cursor.Next()
+	}
+	return nil
+}
+
+// ListIndexedCategories returns up to limit indexed categories starting with prefix sorted by name, starting after after
+func (b BoltVersionStore) ListIndexedCategories(prefix string, after string, limit int) ([]string, error) {
+	categories := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return listBoltBucket(tx.Bucket(boltIndexBucket), prefix, after, limit, func(key []byte, value []byte) error {
+			categories = append(categories, string(key))
+			return nil
+		})
+	})
+	return categories, err
+}
+
+// ListIndexedObjects returns up to limit indexed objects of categoryName starting with prefix sorted by name,
+// starting after after
+func (b BoltVersionStore) ListIndexedObjects(categoryName string, prefix string, after string, limit int) ([]string, error) {
+	objects := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		category := tx.Bucket(boltIndexBucket).Bucket([]byte(categoryName))
+		return listBoltBucket(category, prefix, after, limit, func(key []byte, value []byte) error {
+			objects = append(objects, string(key))
+			return nil
+		})
+	})
+	return objects, err
+}
+
+// ListIndexedVersions returns up to limit indexed versions of objectName starting with prefix sorted by version,
+// starting after after
+func (b BoltVersionStore) ListIndexedVersions(categoryName string, objectName string, prefix string, after string, limit int) ([]IndexEntry, error) {
+	entries := []IndexEntry{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		category := tx.Bucket(boltIndexBucket).Bucket([]byte(categoryName))
+		if category == nil {
+			return nil
+		}
+		return listBoltBucket(category.Bucket([]byte(objectName)), prefix, after, limit, func(key []byte, value []byte) error {
+			entry := IndexEntry{}
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// GetCategory returns the category registered as categoryName, or ErrCategoryNotFound
+func (b BoltVersionStore) GetCategory(categoryName string) (*Category, error) {
+	var category *Category
+	err := b.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(boltCategoriesBucket).Get([]byte(categoryName))
+		if raw == nil {
+			return ErrCategoryNotFound
+		}
+		category = &Category{}
+		return json.Unmarshal(raw, category)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+// putBoltCategory writes category if it is registered, or for new categories if it is not
+func (b BoltVersionStore) putBoltCategory(category *Category, registered bool) error {
+	raw, err := json.Marshal(category)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltCategoriesBucket)
+		key := []byte(category.Name)
+		if exists := bucket.Get(key) != nil; exists && !registered {
+			return ErrCategoryExists
+		} else if !exists && registered {
+			return ErrCategoryNotFound
+		}
+		return bucket.Put(key, raw)
+	})
+}
+
+// CreateCategory registers category, unless it is already registered
+func (b BoltVersionStore) CreateCategory(category *Category) error {
+	return b.putBoltCategory(category, false)
+}
+
+// PutCategory replaces category, if it is registered
+func (b BoltVersionStore) PutCategory(category *Category) error {
+	return b.putBoltCategory(category, true)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltVersionStore, func()) {
+	dir, err := ioutil.TempDir("", "s3-object-cache")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	store, err := NewBoltVersionStore(filepath.Join(dir, "versions.db"))
+	if err != nil {
+		t.Fatalf("NewBoltVersionStore returned an error: %v", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltVersionStore(t *testing.T) {
+	store, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	if _, err := store.GetVersion("fun/foo.obj", ProdChannel); err == nil {
+		t.Fatalf("GetVersion should return an error when no version is set")
+	}
+
+	store.SetProdVersion("prod object", "123", "unit test")
+	store.SetVersion("dev object", DevChannel, "456", "unit test")
+
+	prodObjectVersion, err := store.GetVersion("prod object", ProdChannel)
+	if err != nil || prodObjectVersion != "123" {
+		t.Fatalf("SetProdVersion should have set version to: %+v. Is: %+v", "123", prodObjectVersion)
+	}
+	prodObjectDevVersion, err := store.GetVersion("prod object", DevChannel)
+	if err != nil || prodObjectDevVersion != "123" {
+		t.Fatalf("SetProdVersion should have set dev version to: %+v. Is: %+v", "123", prodObjectDevVersion)
+	}
+	devObjectVersion, err := store.GetVersion("dev object", ProdChannel)
+	if err == nil {
+		t.Fatalf("SetVersion should not have set prod version when new object is created for dev: Prod version: %s", devObjectVersion)
+	}
+	devObjectDevVersion, err := store.GetVersion("dev object", DevChannel)
+	if err != nil || devObjectDevVersion != "456" {
+		t.Fatalf("SetVersion should have set dev version to: %+v. Is: %+v", "456", devObjectDevVersion)
+	}
+
+	// setting the dev version leaves the prod version alone
+	store.SetVersion("prod object", DevChannel, "789", "unit test")
+	prodObjectVersion, _ = store.GetVersion("prod object", ProdChannel)
+	if prodObjectVersion != "123" {
+		t.Fatalf("Setting the dev version should not change the prod version. Is: %s", prodObjectVersion)
+	}
+	// and setting the prod channel leaves the dev version alone
+	store.SetVersion("prod object", ProdChannel, "999", "unit test")
+	prodObjectDevVersion, _ = store.GetVersion("prod object", DevChannel)
+	if prodObjectDevVersion != "789" {
+		t.Fatalf("Setting the prod channel should not change the dev version. Is: %s", prodObjectDevVersion)
+	}
+}
+
+func TestBoltCompareAndSetVersion(t *testing.T) {
+	store, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	if err := store.CompareAndSetVersion("fun/foo.obj", ProdChannel, "*", "1", "unit test"); err == nil {
+		t.Fatalf("CompareAndSetVersion should fail when no version is set")
+	}
+	store.SetVersion("fun/foo.obj", ProdChannel, "1", "unit test")
+	err := store.CompareAndSetVersion("fun/foo.obj", ProdChannel, "2", "3", "unit test")
+	if mismatch, ok := err.(VersionMismatchError); !ok || mismatch.Current != "1" {
+		t.Fatalf("CompareAndSetVersion should return the current version when it does not match. Returned: %v", err)
+	}
+	if err := store.CompareAndSetVersion("fun/foo.obj", ProdChannel, "1", "3", "unit test"); err != nil {
+		t.Fatalf("CompareAndSetVersion should set the version when it matches. Returned: %v", err)
+	}
+	if version, _ := store.GetVersion("fun/foo.obj", ProdChannel); version != "3" {
+		t.Fatalf("CompareAndSetVersion should have set the version to 3. Is: %s", version)
+	}
+}
+
+func TestBoltVersionInfo(t *testing.T) {
+	store, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	if info, err := store.GetVersionInfo("fun/foo.obj", "123"); info != nil || err != nil {
+		t.Fatalf("GetVersionInfo should return nothing for unrecorded versions. Info: %+v, Error: %v", info, err)
+	}
+	store.PutVersionInfo("fun/foo.obj", "123", &VersionInfo{Checksum: "abc123"})
+	info, err := store.GetVersionInfo("fun/foo.obj", "123")
+	if err != nil || info == nil || info.Checksum != "abc123" {
+		t.Fatalf("GetVersionInfo should return the recorded checksum. Info: %+v, Error: %v", info, err)
+	}
+}
+
+func TestObjectControllerLocalStores(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+
+	mocker := NewObjectController(blobs, versions, "")
+	if err := mocker.AddObject("fun/foo.obj", strings.NewReader("party time"), nil, nil, false, true, "123"); err != nil {
+		t.Fatalf("AddObject returned an error: %v", err)
+	}
+	body, err := mocker.GetObject("fun/foo.obj", "", ProdChannel)
+	if err != nil {
+		t.Fatalf("GetObject should return the default version: %v", err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "party time" {
+		t.Fatalf("GetObject did not return the stored content: %s", string(content))
+	}
+}
+
+func TestAddObjectConcurrentUploads(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	mocker := NewObjectController(blobs, versions, "")
+
+	// of concurrent uploads of a version exactly one succeeds, the others conflict
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			errs <- mocker.AddObject("fun/foo.obj", strings.NewReader(fmt.Sprintf("upload %d", i)), nil, nil, false, false, "123")
+		}(i)
+	}
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		err := <-errs
+		if err == nil {
+			succeeded++
+		} else if reqErr, ok := err.(RequestError); !ok || reqErr.StatusCode != http.StatusConflict {
+			t.Fatalf("AddObject should return a conflict error for the losing uploads. Returned: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("Exactly one upload should succeed. %d did", succeeded)
+	}
+}
+
+func TestBoltHistory(t *testing.T) {
+	store, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store.SetVersion("fun/foo.obj", DevChannel, "1", "alice")
+	store.SetProdVersion("fun/foo.obj", "2", "bob")
+	store.CompareAndSetVersion("fun/foo.obj", ProdChannel, "1", "3", "carol")
+
+	history, err := store.GetHistory("fun/foo.obj")
+	if err != nil {
+		t.Fatalf("GetHistory returned an error: %v", err)
+	}
+	// the failed compare and set is not recorded
+	if len(history) != 3 {
+		t.Fatalf("GetHistory should return 3 changes. Returned: %+v", history)
+	}
+	if history[0].Channel != DevChannel || history[0].Previous != "" || history[0].Requester != "alice" {
+		t.Fatalf("GetHistory should record the first dev change. Is: %+v", history[0])
+	}
+	if history[2].Channel != DevChannel || history[2].Previous != "1" || history[2].Version != "2" || history[2].Requester != "bob" {
+		t.Fatalf("GetHistory should record the dev change made by setting prod. Is: %+v", history[2])
+	}
+}
+
+func TestBoltPromoteVersion(t *testing.T) {
+	store, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store.SetVersion("fun/foo.obj", "staging", "1", "unit test")
+	if err := store.PromoteVersion("fun/foo.obj", "staging", ProdChannel, "2", "unit test"); err == nil {
+		t.Fatalf("PromoteVersion should fail when the version is not the default of the from channel")
+	}
+	if err := store.PromoteVersion("fun/foo.obj", "staging", ProdChannel, "1", "unit test"); err != nil {
+		t.Fatalf("PromoteVersion should promote the current version. Returned: %v", err)
+	}
+	// promoting to prod leaves dev alone
+	if version, err := store.GetVersion("fun/foo.obj", DevChannel); err == nil {
+		t.Fatalf("PromoteVersion to prod should not set the dev version. Is: %s", version)
+	}
+}
+
+func TestBoltDeleteDefaults(t *testing.T) {
+	store, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	store.SetProdVersion("fun/foo.obj", "1", "unit test")
+	store.SetVersion("fun/foo.obj", "staging", "2", "unit test")
+	if err := store.ClearVersion("fun/foo.obj", "staging", "1", "unit test"); err == nil {
+		t.Fatalf("ClearVersion should fail when the version is not expected")
+	}
+	store.ClearVersion("fun/foo.obj", "staging", "2", "unit test")
+	defaults, _ := store.GetDefaults("fun/foo.obj")
+	if len(defaults) != 2 || defaults[ProdChannel] != "1" || defaults[DevChannel] != "1" {
+		t.Fatalf("ClearVersion should only remove the staging version. Defaults: %v", defaults)
+	}
+	store.DeleteDefaults("fun/foo.obj", "unit test")
+	if defaults, _ := store.GetDefaults("fun/foo.obj"); len(defaults) != 0 {
+		t.Fatalf("DeleteDefaults should remove every default. Defaults: %v", defaults)
+	}
+	if history, _ := store.GetHistory("fun/foo.obj"); len(history) != 6 {
+		t.Fatalf("ClearVersion and DeleteDefaults should record the removed defaults. History: %+v", history)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Category a registered category and the policies uploads to it have to meet
+type Category struct {
+	Name        string `json:"name"`
+	Owner       string `json:"owner,omitempty"`
+	Description string `json:"description,omitempty"`
+	// ContentTypes the media types objects can be uploaded with, e.g. application/zip. Any if empty
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	// MaxSize the size in bytes objects can be uploaded up to. Unlimited if 0
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// VersionPattern a regular expression version names have to match entirely, or semver to only allow
+	// semantic versions. Any version name if empty
+	VersionPattern string `json:"versionPattern,omitempty"`
+	// RequireRegisteredObjects whether uploads are only accepted for the objects listed in Objects
+	RequireRegisteredObjects bool `json:"requireRegisteredObjects,omitempty"`
+	// Objects the names of the objects registered in the category
+	Objects []string `json:"objects,omitempty"`
+}
+
+// SemverVersionPattern the version pattern of categories only allowing semantic versions
+const SemverVersionPattern = "semver"
+
+// checkCategory returns a bad request error if category can not be registered.
+// the content types are normalised to lower case media types
+func checkCategory(category *Category) error {
+	invalid := func(message string) error {
+		return RequestError{StatusCode: http.StatusBadRequest, Message: message}
+	}
+	if len(category.Name) == 0 || strings.Contains(category.Name, "/") || reservedCategories[category.Name] {
+		return invalid(fmt.Sprintf("%q can not be used as a category name", category.Name))
+	}
+	if category.MaxSize < 0 {
+		return invalid("maxSize must be a positive number of bytes, or 0 for no limit")
+	}
+	for i, contentType := range category.ContentTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return invalid(fmt.Sprintf("Invalid content type %q. %s", contentType, err.Error()))
+		}
+		category.ContentTypes[i] = mediaType
+	}
+	if _, err := category.versionPattern(); err != nil {
+		return invalid(fmt.Sprintf("Invalid version pattern %q. %s", category.VersionPattern, err.Error()))
+	}
+	for _, object := range category.Objects {
+		if len(object) == 0 || strings.ContainsAny(object, "/@") {
+			return invalid(fmt.Sprintf("%q can not be registered as an object name", object))
+		}
+	}
+	return nil
+}
+
+// versionPattern compiles the version pattern of the category to match whole version names.
+// nil for categories that allow any version name or only semantic versions
+func (c Category) versionPattern() (*regexp.Regexp, error) {
+	if len(c.VersionPattern) == 0 || c.VersionPattern == SemverVersionPattern {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + c.VersionPattern + ")$")
+}
+
+// checkVersion returns a bad request error if version can not be uploaded to the category
+func (c Category) checkVersion(version string) error {
+	allowed := true
+	if c.VersionPattern == SemverVersionPattern {
+		_, allowed = ParseSemver(version)
+	} else if pattern, err := c.versionPattern(); err != nil {
+		return err
+	} else if pattern != nil {
+		allowed = pattern.MatchString(version)
+	}
+	if !allowed {
+		return RequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Version %s does not match version pattern %s of category %s", version, c.VersionPattern, c.Name),
+		}
+	}
+	return nil
+}
+
+// checkObject returns a forbidden error if versions of object objectName can not be uploaded to the category
+// because it requires registered objects and the object is not registered
+func (c Category) checkObject(objectName string) error {
+	if !c.RequireRegisteredObjects {
+		return nil
+	}
+	_, name := splitObjectName(objectName)
+	for _, registered := range c.Objects {
+		if name == registered {
+			return nil
+		}
+	}
+	return RequestError{
+		StatusCode: http.StatusForbidden,
+		Message:    fmt.Sprintf("Object %s is not registered in category %s. Register it before uploading to it", name, c.Name),
+	}
+}
+
+// checkContentType returns an unsupported media type error if objects with contentType can not be uploaded to the category
+func (c Category) checkContentType(contentType string) error {
+	if len(c.ContentTypes) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, allowed := range c.ContentTypes {
+		if mediaType == allowed {
+			return nil
+		}
+	}
+	return RequestError{
+		StatusCode: http.StatusUnsupportedMediaType,
+		Message:    fmt.Sprintf("Content type %s can not be uploaded to category %s. Allowed: %s", contentType, c.Name, strings.Join(c.ContentTypes, ", ")),
+	}
+}
+
+// tooLarge the error returned when an upload is larger than the category allows
+func (c Category) tooLarge() error {
+	return RequestError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Message:    fmt.Sprintf("Objects of category %s can not be larger than %d bytes", c.Name, c.MaxSize),
+	}
+}
+
+// errSizeLimit is returned by sizeLimitReader once the limit is exceeded
+var errSizeLimit = errors.New("Size limit exceeded")
+
+// sizeLimitReader fails reads once more than remaining bytes are read, so oversized uploads are
+// stopped while they are streamed rather than after
+type sizeLimitReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		r.exceeded = true
+		return n, errSizeLimit
+	}
+	return n, err
+}
+
+// GetCategory returns the category registered as categoryName, or a 404 RequestError if it is not registered
+func (o ObjectController) GetCategory(categoryName string) (*Category, error) {
+	category, err := o.versions.GetCategory(categoryName)
+	if err == ErrCategoryNotFound {
+		return nil, RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Category %s is not registered", categoryName),
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read category %s from the version store. %s", categoryName, err.Error())
+	}
+	return category, nil
+}
+
+// RegisterCategory registers a new category, returning a 409 RequestError if it is already registered
+func (o ObjectController) RegisterCategory(category *Category) error {
+	if err := checkCategory(category); err != nil {
+		return err
+	}
+	err := o.versions.CreateCategory(category)
+	if err == ErrCategoryExists {
+		return RequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("Category %s is already registered", category.Name),
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to register category %s in the version store. %s", category.Name, err.Error())
+	}
+	return nil
+}
+
+// UpdateCategory replaces a registered category, returning a 404 RequestError if it is not registered
+func (o ObjectController) UpdateCategory(category *Category) error {
+	if err := checkCategory(category); err != nil {
+		return err
+	}
+	err := o.versions.PutCategory(category)
+	if err == ErrCategoryNotFound {
+		return RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Category %s is not registered", category.Name),
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to update category %s in the version store. %s", category.Name, err.Error())
+	}
+	return nil
+}
+
+// uploadCategory the registered category of objectName new versions are checked against, nil if the category
+// is not registered. In strict mode uploads to categories that are not registered are forbidden
+func (o ObjectController) uploadCategory(objectName string) (*Category, error) {
+	categoryName, _ := splitObjectName(objectName)
+	category, err := o.versions.GetCategory(categoryName)
+	if err == ErrCategoryNotFound {
+		if o.strictCategories {
+			return nil, RequestError{
+				StatusCode: http.StatusForbidden,
+				Message:    fmt.Sprintf("Category %s is not registered. Register it before uploading to it", categoryName),
+			}
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read category %s from the version store. %s", categoryName, err.Error())
+	}
+	return category, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileListPageSize number of items returned per FileBlobStore.List call, mirrors s3
+const fileListPageSize = 1000
+
+// FileBlobStore a BlobStore backed by a directory on the local filesystem
+// blobs are stored at root/objects/{key}, and their metadata at root/metadata/{key}
+type FileBlobStore struct {
+	root string
+}
+
+// NewFileBlobStore returns a BlobStore rooted at directory root, creating it if needed
+func NewFileBlobStore(root string) (*FileBlobStore, error) {
+	store := &FileBlobStore{root: root}
+	if err := os.MkdirAll(store.objectsDir(), 0755); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (f FileBlobStore) objectsDir() string {
+	return filepath.Join(f.root, "objects")
+}
+
+func (f FileBlobStore) metadataDir() string {
+	return filepath.Join(f.root, "metadata")
+}
+
+// filename converts a blob key to a path on disk, refusing keys that would escape the root
+func (f FileBlobStore) filename(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("Invalid key %s", key)
+		}
+	}
+	return filepath.Join(f.objectsDir(), filepath.FromSlash(key)), nil
+}
+
+// metadataFilename returns the path metadata for key is stored at
+func (f FileBlobStore) metadataFilename(key string) (string, error) {
+	filename, err := f.filename(key)
+	if err != nil {
+		return "", err
+	}
+	rel, _ := filepath.Rel(f.objectsDir(), filename)
+	return filepath.Join(f.metadataDir(), rel), nil
+}
+
+// writeFile writes content to filename. Content is written to a temporary file which is
+// renamed into place once complete, so readers never see a partial file
+func writeFile(filename string, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Put writes content to key. Metadata is written first so it is in place as soon as the blob is visible
+func (f FileBlobStore) Put(key string, content io.Reader, metadata *ObjectMetadata) error {
+	filename, err := f.filename(key)
+	if err != nil {
+		return err
+	}
+	metadataFilename, _ := f.metadataFilename(key)
+	if metadata == nil {
+		metadata = &ObjectMetadata{}
+	}
+	raw, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(metadataFilename, bytes.NewReader(raw)); err != nil {
+		return err
+	}
+	return writeFile(filename, content)
+}
+
+// Get returns the content stored at key
+func (f FileBlobStore) Get(key string) (io.ReadCloser, error) {
+	filename, err := f.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+// limitedFile reads a section of a file and closes it when done
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// GetRange returns part of the content stored at key
+func (f FileBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	body, err := f.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	file := body.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return limitedFile{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+// Head returns the size, modification time and metadata of the blob stored at key
+func (f FileBlobStore) Head(key string) (*BlobInfo, error) {
+	filename, err := f.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	blobInfo := &BlobInfo{
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}
+	metadataFilename, _ := f.metadataFilename(key)
+	raw, err := ioutil.ReadFile(metadataFilename)
+	// blobs written without metadata have none to return
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(raw, &blobInfo.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return blobInfo, nil
+}
+
+// List returns a list of blob names for a given prefix, following the same
+// semantics and pagination as S3BlobStore.List. tokens are the last key or common prefix listed
+func (f FileBlobStore) List(prefix string, delimiter string, token string) (*ListResponse, error) {
+	marker := token
+
+	keys, err := f.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	// entries are full keys, or common prefixes if a delimiter is provided
+	entries := make([]string, 0)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := key
+		if len(delimiter) > 0 {
+			idx := strings.Index(key[len(prefix):], delimiter)
+			if idx < 0 {
+				continue
+			}
+			entry = key[:len(prefix)+idx+len(delimiter)]
+		}
+		if len(entries) > 0 && entries[len(entries)-1] == entry {
+			continue
+		}
+		if len(marker) > 0 && entry <= marker {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	res := &ListResponse{}
+	if len(entries) > fileListPageSize {
+		entries = entries[:fileListPageSize]
+		res.Token = entries[len(entries)-1]
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if len(delimiter) > 0 {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(entry, prefix), delimiter))
+		} else {
+			// only want the last item in the path for a key
+			splitKey := strings.Split(entry, "/")
+			names = append(names, splitKey[len(splitKey)-1])
+		}
+	}
+	res.Objects = names
+	return res, nil
+}
+
+// keys returns every key in the store in lexical order
+func (f FileBlobStore) keys() ([]string, error) {
+	keys := make([]string, 0)
+	walkErr := filepath.Walk(f.objectsDir(), func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip in progress uploads
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(f.objectsDir(), filename)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Delete removes the blob stored at key and its metadata, along with any directories left empty
+func (f FileBlobStore) Delete(key string) error {
+	filename, err := f.filename(key)
+	if err != nil {
+		return err
+	}
+	metadataFilename, _ := f.metadataFilename(key)
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(metadataFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyDirs(filepath.Dir(filename), f.objectsDir())
+	removeEmptyDirs(filepath.Dir(metadataFilename), f.metadataDir())
+	return nil
+}
+
+// Move renames the blob stored at from and its metadata to to, removing directories left empty
+func (f FileBlobStore) Move(from string, to string) error {
+	filename, err := f.filename(from)
+	if err != nil {
+		return err
+	}
+	target, err := f.filename(to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	metadataFilename, _ := f.metadataFilename(from)
+	metadataTarget, _ := f.metadataFilename(to)
+	// metadata is moved first so it is in place as soon as the blob is visible, like Put
+	for _, move := range [][2]string{{metadataFilename, metadataTarget}, {filename, target}} {
+		if err := os.MkdirAll(filepath.Dir(move[1]), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(move[0], move[1]); err != nil && !(move[0] == metadataFilename && os.IsNotExist(err)) {
+			return err
+		}
+	}
+	removeEmptyDirs(filepath.Dir(filename), f.objectsDir())
+	removeEmptyDirs(filepath.Dir(metadataFilename), f.metadataDir())
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents, up to but not including root, while they are empty
+func removeEmptyDirs(dir string, root string) {
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// os.Remove refuses to remove directories that are not empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
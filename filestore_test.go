@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestFileStore(t *testing.T) (*FileBlobStore, func()) {
+	dir, err := ioutil.TempDir("", "s3-object-cache")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	store, err := NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileBlobStore returned an error: %v", err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestFileBlobStorePutGet(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	if _, err := store.Get("fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("FileBlobStore.Get should return ErrBlobNotFound for missing keys. Returned: %v", err)
+	}
+	if _, err := store.Head("fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("FileBlobStore.Head should return ErrBlobNotFound for missing keys. Returned: %v", err)
+	}
+
+	metadata := &ObjectMetadata{
+		ContentType:     "application/gzip",
+		ContentEncoding: "gzip",
+		UserMetadata:    map[string]string{"build-id": "42"},
+	}
+	if err := store.Put("fun/foo.obj/123abc", strings.NewReader("wonderful magic content"), metadata); err != nil {
+		t.Fatalf("FileBlobStore.Put returned an error: %v", err)
+	}
+	body, err := store.Get("fun/foo.obj/123abc")
+	if err != nil {
+		t.Fatalf("FileBlobStore.Get returned an error: %v", err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "wonderful magic content" {
+		t.Fatalf("FileBlobStore.Get returned the wrong content: %s", string(content))
+	}
+	body, err = store.GetRange("fun/foo.obj/123abc", 10, 5)
+	if err != nil {
+		t.Fatalf("FileBlobStore.GetRange returned an error: %v", err)
+	}
+	content, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "magic" {
+		t.Fatalf("FileBlobStore.GetRange returned the wrong content: %s", string(content))
+	}
+
+	info, err := store.Head("fun/foo.obj/123abc")
+	if err != nil || info.Size != int64(len("wonderful magic content")) {
+		t.Fatalf("FileBlobStore.Head should return the blob size. Info: %+v, Error: %v", info, err)
+	}
+	if info.Metadata.ContentType != "application/gzip" || info.Metadata.ContentEncoding != "gzip" || info.Metadata.UserMetadata["build-id"] != "42" {
+		t.Fatalf("FileBlobStore.Head should return the stored metadata. Is: %+v", info.Metadata)
+	}
+	// the directory for an object is not a blob
+	if _, err := store.Head("fun/foo.obj"); err != ErrBlobNotFound {
+		t.Fatalf("FileBlobStore.Head should return ErrBlobNotFound for directories. Returned: %v", err)
+	}
+
+	if err := store.Put("../escape", strings.NewReader("nope"), nil); err == nil {
+		t.Fatalf("FileBlobStore.Put should refuse keys containing ..")
+	}
+}
+
+func TestFileBlobStoreList(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	for _, key := range []string{"dang/fun/foo.obj/123abc", "dang/fun/foo.obj/456def", "dang/fun/bar.obj/1", "dang/work/baz.obj/1"} {
+		store.Put(key, strings.NewReader("content"), nil)
+	}
+
+	categories, err := store.List("dang/", "/", "")
+	if err != nil {
+		t.Fatalf("FileBlobStore.List returned an error: %v", err)
+	}
+	if strings.Join(categories.Objects, ",") != "fun,work" || len(categories.Token) > 0 {
+		t.Fatalf("FileBlobStore.List with a delimiter should return fun,work. Returned: %+v", categories)
+	}
+
+	objects, _ := store.List("dang/fun/", "/", "")
+	if strings.Join(objects.Objects, ",") != "bar.obj,foo.obj" {
+		t.Fatalf("FileBlobStore.List should return bar.obj,foo.obj. Returned: %v", objects.Objects)
+	}
+
+	versions, _ := store.List("dang/fun/foo.obj/", "", "")
+	if strings.Join(versions.Objects, ",") != "123abc,456def" {
+		t.Fatalf("FileBlobStore.List should return 123abc,456def. Returned: %v", versions.Objects)
+	}
+
+	// tokens mark the last item seen
+	afterFirst, _ := store.List("dang/fun/foo.obj/", "", "dang/fun/foo.obj/123abc")
+	if strings.Join(afterFirst.Objects, ",") != "456def" {
+		t.Fatalf("FileBlobStore.List should resume after the token. Returned: %v", afterFirst.Objects)
+	}
+}
+
+func TestFileBlobStoreDelete(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	store.Put("fun/foo.obj/123abc", strings.NewReader("content"), nil)
+	if err := store.Delete("fun/foo.obj/123abc"); err != nil {
+		t.Fatalf("FileBlobStore.Delete returned an error: %v", err)
+	}
+	if _, err := store.Get("fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("FileBlobStore.Get should return ErrBlobNotFound after delete. Returned: %v", err)
+	}
+	// empty directories are cleaned up so the category is no longer listed
+	categories, _ := store.List("", "/", "")
+	if len(categories.Objects) != 0 {
+		t.Fatalf("FileBlobStore.List should not return empty categories. Returned: %v", categories.Objects)
+	}
+}
+
+func TestFileBlobStoreMove(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	store.Put("fun/foo.obj/123abc", strings.NewReader("content"), &ObjectMetadata{ContentType: "text/plain"})
+	if err := store.Move("fun/foo.obj/123abc", ".trash/fun/foo.obj/123abc"); err != nil {
+		t.Fatalf("FileBlobStore.Move returned an error: %v", err)
+	}
+	info, err := store.Head(".trash/fun/foo.obj/123abc")
+	if err != nil || info.Size != 7 || info.Metadata.ContentType != "text/plain" {
+		t.Fatalf("FileBlobStore.Move should move the content and metadata. Info: %+v, Error: %v", info, err)
+	}
+	if _, err := store.Head("fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("FileBlobStore.Head should return ErrBlobNotFound after a move. Returned: %v", err)
+	}
+	if categories, _ := store.List("", "/", ""); len(categories.Objects) != 1 {
+		t.Fatalf("FileBlobStore.Move should clean up the directories it leaves empty. Categories: %v", categories.Objects)
+	}
+	if err := store.Move("fun/foo.obj/123abc", ".trash/fun/foo.obj/123abc"); err != ErrBlobNotFound {
+		t.Fatalf("FileBlobStore.Move should return ErrBlobNotFound for missing blobs. Returned: %v", err)
+	}
+}
+
+func TestObjectControllerFileBlobStore(t *testing.T) {
+	store, cleanup := newTestFileStore(t)
+	defer cleanup()
+
+	mocker := ObjectController{
+		path:     "dang",
+		blobs:    store,
+		versions: mockDynamoStore(&MockDynamo{}),
+	}
+	if err := mocker.AddObject("fun/foo.obj", strings.NewReader("party time"), nil, nil, false, false, "123"); err != nil {
+		t.Fatalf("AddObject returned an error: %v", err)
+	}
+	body, err := mocker.GetObject("fun/foo.obj", "123", ProdChannel)
+	if err != nil {
+		t.Fatalf("GetObject returned an error: %v", err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "party time" {
+		t.Fatalf("GetObject did not return the stored content: %s", string(content))
+	}
+	list, _ := mocker.ListObjectVersions("fun", "foo.obj", "")
+	if strings.Join(list.Objects, ",") != "123" {
+		t.Fatalf("ListObjectVersions should return 123. Returned: %v", list.Objects)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// indexPageSize the number of categories, objects or versions listed from the index per page,
+// and the most a page can be limited to
+const indexPageSize = 1000
+
+// newCursorKey a random key to sign tokens with, for when no secret is configured
+func newCursorKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// splitObjectName splits category/object into its category and object
+func splitObjectName(objectName string) (string, string) {
+	parts := strings.SplitN(objectName, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// signCursor the signature of a token for the page after after of the listing identified by scope
+func (o ObjectController) signCursor(after string, scope []string) []byte {
+	mac := hmac.New(sha256.New, o.cursorKey)
+	for _, part := range scope {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	mac.Write([]byte(after))
+	return mac.Sum(nil)
+}
+
+// marshalCursor the token of the page after after of the listing identified by scope (what is listed and the prefix).
+// tokens are signed, so they can not be forged, changed or used to continue any other listing
+func (o ObjectController) marshalCursor(after string, scope ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(after)) + "." + base64.RawURLEncoding.EncodeToString(o.signCursor(after, scope))
+}
+
+// indexAfter the name a page of the listing identified by scope starts after, from the token of the previous page.
+// tokens that were not returned by the same listing are a bad request
+func (o ObjectController) indexAfter(token string, scope ...string) (string, error) {
+	if len(token) == 0 {
+		return "", nil
+	}
+	invalid := RequestError{StatusCode: http.StatusBadRequest, Message: "Invalid token. Tokens can only continue the listing that returned them"}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", invalid
+	}
+	after, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, o.signCursor(string(after), scope)) {
+		return "", invalid
+	}
+	return string(after), nil
+}
+
+// indexPage trims names listed with a limit of pageSize+1 to a page, returning the token of the next page if there is one
+func (o ObjectController) indexPage(names []string, pageSize int, scope ...string) ([]string, string) {
+	if len(names) <= pageSize {
+		return names, ""
+	}
+	names = names[:pageSize]
+	// tokens mark the last name listed
+	return names, o.marshalCursor(names[len(names)-1], scope...)
+}
+
+// listIndexedVersions lists a page of up to pageSize indexed versions of objectName in categoryName starting
+// with prefix, returning the token of the next page if there is one
+func (o ObjectController) listIndexedVersions(categoryName string, objectName string, prefix string, token string, pageSize int) ([]IndexEntry, string, error) {
+	scope := []string{"versions", categoryName, objectName, prefix}
+	after, err := o.indexAfter(token, scope...)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, err := o.versions.ListIndexedVersions(categoryName, objectName, prefix, after, pageSize+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to list object %s/%s versions from the index. %s", categoryName, objectName, err.Error())
+	}
+	nextToken := ""
+	if len(entries) > pageSize {
+		entries = entries[:pageSize]
+		nextToken = o.marshalCursor(entries[len(entries)-1].Version, scope...)
+	}
+	return entries, nextToken, nil
+}
+
+// listAllIndexedVersions lists every indexed version of objectName starting with prefix, by name
+func (o ObjectController) listAllIndexedVersions(objectName string, prefix string) ([]IndexEntry, error) {
+	categoryName, name := splitObjectName(objectName)
+	entries := []IndexEntry{}
+	token := ""
+	for {
+		listed, next, err := o.listIndexedVersions(categoryName, name, prefix, token, indexPageSize)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, listed...)
+		if len(next) == 0 {
+			return entries, nil
+		}
+		token = next
+	}
+}
+
+// indexVersion records version of objectName in the index with its size, times and checksum.
+// versions that can not be served (still being uploaded or deleted) return a RequestError
+func (o ObjectController) indexVersion(objectName string, version string) error {
+	object, err := o.getObjectFromStore(objectName, version)
+	if err != nil {
+		return err
+	}
+	entry := IndexEntry{
+		Version:      version,
+		Size:         object.Size,
+		LastModified: object.LastModified,
+		Created:      object.Created,
+		Checksum:     object.Checksum,
+	}
+	// versions added before their creation was recorded
+	if entry.Created.IsZero() {
+		entry.Created = object.LastModified
+	}
+	categoryName, name := splitObjectName(objectName)
+	if err := o.versions.IndexVersion(categoryName, name, entry); err != nil {
+		return fmt.Errorf("Unable to index object %s version %s. %s", objectName, version, err.Error())
+	}
+	return nil
+}
+
+// unindexVersion removes version of objectName from the index
+func (o ObjectController) unindexVersion(objectName string, version string) error {
+	categoryName, name := splitObjectName(objectName)
+	if err := o.versions.UnindexVersion(categoryName, name, version); err != nil {
+		return fmt.Errorf("Unable to remove object %s version %s from the index. %s", objectName, version, err.Error())
+	}
+	return nil
+}
+
+// Reindex rebuilds the index from the blob store: every version that can be served is indexed and
+// indexed versions that are no longer stored are removed. returns the number of versions indexed and removed
+func (o ObjectController) Reindex() (int, int, error) {
+	indexed, removed := 0, 0
+	stored := map[string]bool{}
+	categories, err := listAll(o.listBlobCategories)
+	if err != nil {
+		return indexed, removed, fmt.Errorf("Unable to list categories in the blob store. %s", err.Error())
+	}
+	for _, category := range categories {
+		objects, err := listAll(func(token string) (*ListResponse, error) {
+			return o.listBlobObjects(category, token)
+		})
+		if err != nil {
+			return indexed, removed, fmt.Errorf("Unable to list objects of category %s in the blob store. %s", category, err.Error())
+		}
+		for _, object := range objects {
+			versions, err := listAll(func(token string) (*ListResponse, error) {
+				return o.listBlobVersions(category, object, token)
+			})
+			if err != nil {
+				return indexed, removed, fmt.Errorf("Unable to list object %s/%s versions in the blob store. %s", category, object, err.Error())
+			}
+			for _, version := range versions {
+				err := o.indexVersion(category+"/"+object, version)
+				// versions still being uploaded are indexed once they are ready, deleted ones when restored
+				if _, ok := err.(RequestError); ok {
+					continue
+				} else if err != nil {
+					return indexed, removed, err
+				}
+				stored[category+"/"+object+"/"+version] = true
+				indexed++
+			}
+		}
+	}
+
+	categories, err = listAll(func(token string) (*ListResponse, error) {
+		return o.ListCategories(token, ListOptions{})
+	})
+	if err != nil {
+		return indexed, removed, err
+	}
+	for _, category := range categories {
+		objects, err := listAll(func(token string) (*ListResponse, error) {
+			return o.ListObjects(category, token, ListOptions{})
+		})
+		if err != nil {
+			return indexed, removed, err
+		}
+		for _, object := range objects {
+			versions, err := listAll(func(token string) (*ListResponse, error) {
+				return o.ListObjectVersions(category, object, token)
+			})
+			if err != nil {
+				return indexed, removed, err
+			}
+			for _, version := range versions {
+				if stored[category+"/"+object+"/"+version] {
+					continue
+				}
+				if err := o.unindexVersion(category+"/"+object, version); err != nil {
+					return indexed, removed, err
+				}
+				removed++
+			}
+		}
+	}
+	return indexed, removed, nil
+}
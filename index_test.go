@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReindex(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	objects := NewObjectController(blobs, versions, "dang")
+	// versions stored before there was an index
+	for _, key := range []string{"dang/maps/a.map/1", "dang/maps/b.map/1", "dang/maps/b.map/2", "dang/builds/app.jar/1"} {
+		blobs.Put(key, strings.NewReader("content"), nil)
+	}
+	if list, _ := objects.ListCategories("", ListOptions{}); len(list.Objects) != 0 {
+		t.Fatalf("ListCategories should only list indexed categories. Listed: %v", list.Objects)
+	}
+	// and an index entry for content that is gone
+	versions.IndexVersion("maps", "gone.map", IndexEntry{Version: "1"})
+
+	indexed, removed, err := objects.Reindex()
+	if err != nil || indexed != 4 || removed != 1 {
+		t.Fatalf("Reindex should index 4 versions and remove 1. Indexed: %d, Removed: %d, Error: %v", indexed, removed, err)
+	}
+	if list, _ := objects.ListCategories("", ListOptions{}); strings.Join(list.Objects, ",") != "builds,maps" {
+		t.Fatalf("ListCategories should list the reindexed categories. Listed: %v", list.Objects)
+	}
+	if list, _ := objects.ListObjects("maps", "", ListOptions{}); strings.Join(list.Objects, ",") != "a.map,b.map" {
+		t.Fatalf("ListObjects should list the reindexed objects. Listed: %v", list.Objects)
+	}
+	listed, _, _ := objects.ListObjectVersionDetails("maps", "b.map", "", ListOptions{})
+	if len(listed) != 2 || listed[1].Version != "2" || listed[1].Size != int64(len("content")) {
+		t.Fatalf("ListObjectVersionDetails should describe the reindexed versions. Listed: %+v", listed)
+	}
+
+	// deleting the last version of an object removes it from the index, restoring it adds it back
+	objects.DeleteObjectVersion("maps/a.map", "1", false, "unit test")
+	if list, _ := objects.ListObjects("maps", "", ListOptions{}); strings.Join(list.Objects, ",") != "b.map" {
+		t.Fatalf("ListObjects should not list objects without versions. Listed: %v", list.Objects)
+	}
+	objects.DeleteObject("builds/app.jar", false, "unit test")
+	if list, _ := objects.ListCategories("", ListOptions{}); strings.Join(list.Objects, ",") != "maps" {
+		t.Fatalf("ListCategories should not list categories without objects. Listed: %v", list.Objects)
+	}
+	objects.RestoreObjectVersion("maps/a.map", "1", "unit test")
+	if list, _ := objects.ListObjects("maps", "", ListOptions{}); strings.Join(list.Objects, ",") != "a.map,b.map" {
+		t.Fatalf("ListObjects should list restored objects. Listed: %v", list.Objects)
+	}
+}
+
+func TestIndexPage(t *testing.T) {
+	objects := NewObjectController(nil, mockDynamoStore(&MockDynamo{}), "")
+	page, token := objects.indexPage([]string{"a", "b", "c"}, 2, "categories", "")
+	if strings.Join(page, ",") != "a,b" || len(token) == 0 {
+		t.Fatalf("indexPage should return the first 2 names and a token. Page: %v, Token: %s", page, token)
+	}
+	if after, err := objects.indexAfter(token, "categories", ""); err != nil || after != "b" {
+		t.Fatalf("indexAfter should continue after b. After: %s, Error: %v", after, err)
+	}
+	if _, token := objects.indexPage([]string{"a", "b"}, 2, "categories", ""); len(token) > 0 {
+		t.Fatalf("indexPage should not return a token for the last page. Token: %s", token)
+	}
+
+	// tokens are rejected when changed, forged or used for another listing
+	forged := base64.RawURLEncoding.EncodeToString([]byte("z")) + token[strings.Index(token, "."):]
+	other := NewObjectController(nil, mockDynamoStore(&MockDynamo{}), "")
+	for name, check := range map[string]func() error{
+		"modified":      func() error { _, err := objects.indexAfter(forged, "categories", ""); return err },
+		"other prefix":  func() error { _, err := objects.indexAfter(token, "categories", "a"); return err },
+		"other listing": func() error { _, err := objects.indexAfter(token, "objects", "b", ""); return err },
+		"other key":     func() error { _, err := other.indexAfter(token, "categories", ""); return err },
+		"not a token":   func() error { _, err := objects.ListCategories("not a token!", ListOptions{}); return err },
+		"unsigned token": func() error {
+			_, err := objects.ListCategories(base64.StdEncoding.EncodeToString([]byte("b")), ListOptions{})
+			return err
+		},
+	} {
+		if err, ok := check().(RequestError); !ok || err.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s tokens should be refused with a bad request. Returned: %v", name, err)
+		}
+	}
+}
+
+func TestListPrefixAndLimit(t *testing.T) {
+	objects := NewObjectController(nil, mockDynamoStore(&MockDynamo{}), "")
+	for _, object := range []string{"de_dust.map", "de_dust2.map", "cs_office.map", "de_nuke.map"} {
+		objects.versions.IndexVersion("maps", object, IndexEntry{Version: "1"})
+	}
+
+	listed := []string{}
+	token := ""
+	for pages := 1; ; pages++ {
+		list, err := objects.ListObjects("maps", token, ListOptions{Prefix: "de_", Limit: 2})
+		if err != nil || len(list.Objects) > 2 {
+			t.Fatalf("ListObjects should list pages of up to 2 objects. Listed: %v, Error: %v", list, err)
+		}
+		listed = append(listed, list.Objects...)
+		if token = list.Token; len(token) == 0 || pages > 3 {
+			break
+		}
+	}
+	if strings.Join(listed, ",") != "de_dust.map,de_dust2.map,de_nuke.map" {
+		t.Fatalf("ListObjects should list every object starting with the prefix once. Listed: %v", listed)
+	}
+}
@@ -1,31 +1,227 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// newBlobStore returns the blob store selected by the STORAGE_BACKEND environment variable
+func newBlobStore() BlobStore {
+	backend, _ := os.LookupEnv("STORAGE_BACKEND")
+
+	switch backend {
+	case "", "s3":
+		bucket, bucketExists := os.LookupEnv("S3_BUCKET")
+		if !bucketExists {
+			panic("S3_BUCKET environment variable is mandatory")
+		}
+		return NewS3BlobStore(bucket, uploadPartSize(), uploadConcurrency())
+	case "filesystem":
+		root, rootExists := os.LookupEnv("STORAGE_PATH")
+		if !rootExists {
+			panic("STORAGE_PATH environment variable is mandatory for the filesystem storage backend")
+		}
+		store, err := NewFileBlobStore(root)
+		if err != nil {
+			panic(err)
+		}
+		return store
+	default:
+		panic("STORAGE_BACKEND must be one of s3, filesystem")
+	}
+}
+
+// newVersionStore returns the version store selected by the VERSION_BACKEND environment variable
+func newVersionStore() VersionStore {
+	backend, _ := os.LookupEnv("VERSION_BACKEND")
+
+	switch backend {
+	case "", "dynamo":
+		dynamoTable, ddbExists := os.LookupEnv("DYNAMO_TABLE")
+		if !ddbExists {
+			panic("DYNAMO_TABLE environment variable is mandatory")
+		}
+		return NewDynamoVersionStore(dynamoTable)
+	case "bolt":
+		filename, fileExists := os.LookupEnv("BOLT_DB_PATH")
+		if !fileExists {
+			panic("BOLT_DB_PATH environment variable is mandatory for the bolt version backend")
+		}
+		store, err := NewBoltVersionStore(filename)
+		if err != nil {
+			panic(err)
+		}
+		return store
+	default:
+		panic("VERSION_BACKEND must be one of dynamo, bolt")
+	}
+}
+
+// uploadPartSize returns the multipart upload part size configured with UPLOAD_PART_SIZE_MB
+func uploadPartSize() int64 {
+	param, ok := os.LookupEnv("UPLOAD_PART_SIZE_MB")
+	if !ok {
+		return DefaultUploadPartSize
+	}
+	partSizeMB, err := strconv.Atoi(param)
+	if err != nil || int64(partSizeMB)*1024*1024 < MinUploadPartSize {
+		log.Printf("Unable to use UPLOAD_PART_SIZE_MB %s, must be an int of at least 5. Using default %d bytes", param, DefaultUploadPartSize)
+		return DefaultUploadPartSize
+	}
+	return int64(partSizeMB) * 1024 * 1024
+}
+
+// uploadConcurrency returns the number of parts uploaded in parallel configured with UPLOAD_CONCURRENCY
+func uploadConcurrency() int {
+	param, ok := os.LookupEnv("UPLOAD_CONCURRENCY")
+	if !ok {
+		return DefaultUploadConcurrency
+	}
+	concurrency, err := strconv.Atoi(param)
+	if err != nil || concurrency < 1 {
+		log.Printf("Unable to use UPLOAD_CONCURRENCY %s, must be a positive int. Using default %d", param, DefaultUploadConcurrency)
+		return DefaultUploadConcurrency
+	}
+	return concurrency
+}
+
+// retentionPolicies returns the retention policies configured with RETENTION_POLICIES, nil if there are none
+func retentionPolicies() RetentionPolicies {
+	param, ok := os.LookupEnv("RETENTION_POLICIES")
+	if !ok {
+		return nil
+	}
+	policies, err := ParseRetentionPolicies(param)
+	if err != nil {
+		panic(err)
+	}
+	return policies
+}
+
+// retentionInterval returns how often the retention policies are applied in the background, configured
+// with RETENTION_INTERVAL. 0 if they are not
+func retentionInterval() time.Duration {
+	param, ok := os.LookupEnv("RETENTION_INTERVAL")
+	if !ok {
+		return 0
+	}
+	interval, err := time.ParseDuration(param)
+	if err != nil || interval <= 0 {
+		log.Printf("Unable to use RETENTION_INTERVAL %s, must be a positive duration such as 1h. Not collecting garbage", param)
+		return 0
+	}
+	return interval
+}
+
+// trashGracePeriod returns how long deleted versions can be restored, configured with TRASH_GRACE_PERIOD
+func trashGracePeriod() time.Duration {
+	param, ok := os.LookupEnv("TRASH_GRACE_PERIOD")
+	if !ok {
+		return DefaultTrashGracePeriod
+	}
+	period, err := time.ParseDuration(param)
+	if err != nil || period <= 0 {
+		log.Printf("Unable to use TRASH_GRACE_PERIOD %s, must be a positive duration such as 72h. Using default %s", param, DefaultTrashGracePeriod)
+		return DefaultTrashGracePeriod
+	}
+	return period
+}
+
+// transferTimeout returns how long reading a request and writing its response may take, configured with
+// TRANSFER_TIMEOUT. 0 if they can take as long as they need, as large objects are streamed in both directions
+func transferTimeout() time.Duration {
+	param, ok := os.LookupEnv("TRANSFER_TIMEOUT")
+	if !ok {
+		return 0
+	}
+	timeout, err := time.ParseDuration(param)
+	if err != nil || timeout <= 0 {
+		log.Printf("Unable to use TRANSFER_TIMEOUT %s, must be a positive duration such as 1h. Not limiting transfers", param)
+		return 0
+	}
+	return timeout
+}
+
+// runGC the gc subcommand, applying the retention policies (if any) and purging the trash once
+func runGC(objects *ObjectController, args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report the versions that would be deleted without deleting them")
+	flags.Parse(args)
+
+	if policies := retentionPolicies(); len(policies) > 0 {
+		collected, err := objects.CollectGarbage(policies, *dryRun)
+		logCollected(collected, *dryRun, err)
+		if err != nil {
+			os.Exit(1)
+		}
+	}
+	purged, err := objects.PurgeTrash(*dryRun)
+	action := "purged"
+	if *dryRun {
+		action = "would purge"
+	}
+	for _, version := range purged {
+		log.Printf("Trash: %s %s", action, version)
+	}
+	if err != nil {
+		log.Fatalf("Trash: purge failed. %s", err.Error())
+	}
+}
+
+// runReindex the reindex subcommand, rebuilding the index the listings are served from out of the blob store
+func runReindex(objects *ObjectController) {
+	indexed, removed, err := objects.Reindex()
+	log.Printf("Reindex: indexed %d versions, removed %d that are no longer stored", indexed, removed)
+	if err != nil {
+		log.Fatalf("Reindex: failed. %s", err.Error())
+	}
+}
+
 func main() {
-	bucket, bucketExists := os.LookupEnv("S3_BUCKET")
 	pathPrefix, _ := os.LookupEnv("S3_PATH_PREFIX")
-	dynamoTable, ddbExists := os.LookupEnv("DYNAMO_TABLE")
 
-	if !bucketExists {
-		panic("S3_BUCKET environment variable is mandatory")
+	objects := NewObjectController(newBlobStore(), newVersionStore(), pathPrefix)
+	objects.trashGracePeriod = trashGracePeriod()
+	objects.strictCategories = strings.ToLower(os.Getenv("STRICT_CATEGORIES")) == "true"
+	// list tokens are signed with a random key unless a secret shared by every instance is configured
+	if secret := os.Getenv("CURSOR_SECRET"); len(secret) > 0 {
+		objects.cursorKey = []byte(secret)
+	}
+	// `s3-object-cache gc [-dry-run]` applies the retention policies once instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		runGC(objects, os.Args[2:])
+		return
+	}
+	// `s3-object-cache reindex` backfills the index from the blob store
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		runReindex(objects)
+		return
+	}
+	if policies, interval := retentionPolicies(), retentionInterval(); len(policies) > 0 && interval > 0 {
+		dryRun := strings.ToLower(os.Getenv("RETENTION_DRY_RUN")) == "true"
+		go objects.collectGarbageEvery(interval, policies, dryRun)
 	}
-	if !ddbExists {
-		panic("DYNAMO_TABLE environment variable is mandatory")
+	go objects.purgeTrashEvery(trashPurgeInterval)
+	if len(os.Getenv("CURSOR_SECRET")) == 0 {
+		log.Printf("CURSOR_SECRET is not set. List tokens are signed with a random key, so they only work with this instance until it restarts")
 	}
 
-	api := NewAPI(bucket, pathPrefix, dynamoTable)
+	api := NewAPI(objects)
 	// TODO: graceful shutdown https://github.com/gorilla/mux#graceful-shutdown
+	// uploads and downloads of large objects and batches are streamed for as long as they take, so only the
+	// headers and idle connections are timed out unless TRANSFER_TIMEOUT is set
 	srv := &http.Server{
-		Handler:      api.Router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		Addr:         ":80",
+		Handler:           api.Router,
+		ReadHeaderTimeout: 15 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ReadTimeout:       transferTimeout(),
+		WriteTimeout:      transferTimeout(),
+		Addr:              ":80",
 	}
 
 	log.Fatal(srv.ListenAndServe())
@@ -1,336 +1,797 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/base64"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
+	"net/http"
 	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
+// sniffLen number of bytes http.DetectContentType considers
+const sniffLen = 512
+
 // ListResponse helper struct to hold pagination / items for List commands
 type ListResponse struct {
 	Objects []string
 	Token   string
 }
 
-// base64 encode token string to make it ambiguous
-func marshalToken(token string) string {
-	return base64.StdEncoding.EncodeToString([]byte(token))
+// RequestError an error caused by the request rather than the service.
+// StatusCode is the http status the api responds with
+type RequestError struct {
+	StatusCode int
+	Message    string
 }
 
-// base64 decode token string
-func unmarshalToken(token string) (string, error) {
-	final, err := base64.StdEncoding.DecodeString(token)
-	if err != nil {
-		return "", err
+func (e RequestError) Error() string {
+	return e.Message
+}
+
+// ContentChecksums checksums the client expects uploaded content to have. Empty checksums are not checked
+type ContentChecksums struct {
+	SHA256 []byte
+	MD5    []byte
+	// Length the size in bytes the content was sent with, so content cut off part way is not stored. Not checked if 0
+	Length int64
+}
+
+// byteCounter counts the bytes written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// channelPattern valid release channel names
+var channelPattern = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,63}$")
+
+// checkChannel returns a bad request error if channel is not a valid channel name
+func checkChannel(channel string) error {
+	if !channelPattern.MatchString(channel) {
+		return RequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Invalid channel %q. Channels are lower case letters, numbers, - and _", channel),
+		}
 	}
-	return string(final), nil
+	return nil
 }
 
-// ObjectController object to handle the storage, retrieval, and versioning of objects in s3 and dynamo
+// ObjectController object to handle the storage, retrieval, and versioning of objects
+// object content is kept in the blob store, default versions in the version store
 type ObjectController struct {
-	bucket *string
-	path   string
-	table  *string
-	s3     s3iface.S3API
-	ddb    dynamodbiface.DynamoDBAPI
+	path     string
+	blobs    BlobStore
+	versions VersionStore
+	// trashGracePeriod how long deleted versions can be restored before they are purged
+	trashGracePeriod time.Duration
+	// strictCategories whether uploads to categories that are not registered are rejected
+	strictCategories bool
+	// cursorKey the key list tokens are signed with
+	cursorKey []byte
 }
 
 // NewObjectController returns a new object controller
-func NewObjectController(bucket string, pathPrefix string, table string) *ObjectController {
-	var sess = session.Must(session.NewSession())
+func NewObjectController(blobs BlobStore, versions VersionStore, pathPrefix string) *ObjectController {
 	return &ObjectController{
-		bucket: aws.String(bucket),
-		path:   pathPrefix,
-		table:  aws.String(table),
-		s3:     s3.New(sess),
-		ddb:    dynamodb.New(sess),
+		path:             pathPrefix,
+		blobs:            blobs,
+		versions:         versions,
+		trashGracePeriod: DefaultTrashGracePeriod,
+		cursorKey:        newCursorKey(),
 	}
 }
 
 // GetObject Orchestrator for getting objects.
-// if version is supplied attempt to pull directly from S3
-// else, look up version in dynamo and return that
+// if version is supplied attempt to pull directly from the blob store
+// else, look up the version of channel in the version store and return that
 // TODO: add redis cache
-func (o ObjectController) GetObject(objectName string, version string, dev bool) (io.ReadCloser, error) {
+func (o ObjectController) GetObject(objectName string, version string, channel string) (*ObjectReader, error) {
 	if len(version) > 0 {
-		// passes s3 errors upwards
-		return o.getObjectFromS3(objectName, version)
+		// passes blob store errors upwards
+		return o.getObjectFromStore(objectName, version)
+	}
+	version, err := o.ResolveObjectVersion(objectName, channel, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return o.getObjectFromStore(objectName, version)
+}
+
+// ResolveObjectVersion returns the default version of objectName in channel, or the default it had at asOf if set.
+// past defaults are resolved from the object history
+func (o ObjectController) ResolveObjectVersion(objectName string, channel string, asOf time.Time) (string, error) {
+	if err := checkChannel(channel); err != nil {
+		return "", err
+	}
+	if asOf.IsZero() {
+		version, err := o.versions.GetVersion(objectName, channel)
+		if err != nil {
+			return "", fmt.Errorf("Error looking up version for object %s. Error:%s", objectName, err.Error())
+		}
+		return version, nil
+	}
+	history, err := o.GetObjectHistory(objectName, channel)
+	if err != nil {
+		return "", err
+	}
+	recorded := false
+	for _, change := range history {
+		if !change.Time.After(asOf) {
+			// the default may have been removed by deleting its version
+			if len(change.Version) > 0 {
+				return change.Version, nil
+			}
+			recorded = true
+			break
+		}
+	}
+	// the oldest change replacing a version means older changes were dropped from the history
+	if !recorded && len(history) > 0 && len(history[len(history)-1].Previous) > 0 {
+		return "", RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("History of object %s does not go back to %s", objectName, asOf.Format(time.RFC3339)),
+		}
+	}
+	return "", RequestError{
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("No %s version of object %s is recorded at %s", channel, objectName, asOf.Format(time.RFC3339)),
+	}
+}
+
+// ResolveObjectConstraint returns the highest indexed version of objectName matching a semantic version constraint.
+// versions that are not semantic versions, still being uploaded or deleted are never matched
+func (o ObjectController) ResolveObjectConstraint(objectName string, constraint string) (string, error) {
+	parsed, err := ParseConstraint(constraint)
+	if err != nil {
+		return "", RequestError{StatusCode: http.StatusBadRequest, Message: err.Error()}
 	}
-	version, err := o.getObjectVersion(objectName, dev)
+	entries, err := o.listAllIndexedVersions(objectName, "")
 	if err != nil {
-		return nil, fmt.Errorf("Error looking up version for object %s. Error:%s", objectName, err.Error())
+		return "", err
+	}
+	type candidate struct {
+		name   string
+		semver Semver
+	}
+	candidates := []candidate{}
+	for _, entry := range entries {
+		if semver, ok := ParseSemver(entry.Version); ok && parsed.Match(semver) {
+			candidates = append(candidates, candidate{name: entry.Version, semver: semver})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].semver.Compare(candidates[j].semver) > 0
+	})
+	for _, c := range candidates {
+		err := o.checkVersionAvailable(objectName, c.name)
+		if err == nil {
+			return c.name, nil
+		} else if _, ok := err.(RequestError); !ok {
+			return "", err
+		}
+	}
+	return "", RequestError{
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("No version of object %s matches %s", objectName, constraint),
 	}
-	return o.getObjectFromS3(objectName, version)
 }
 
-// ListCategories returns categories configured
-// // These are discovered by listing objects in s3
-// it would be better to store this info in a database
-func (o ObjectController) ListCategories(token string) (*ListResponse, error) {
-	return o.listObjectsS3(o.path, "/", token)
+// GetObjectInfo returns what is known about version of objectName without fetching its content
+func (o ObjectController) GetObjectInfo(objectName string, version string) (*ObjectInfo, error) {
+	object, err := o.getObjectFromStore(objectName, version)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:            objectName,
+		Version:         object.Version,
+		Size:            object.Size,
+		LastModified:    object.LastModified,
+		Checksum:        object.Checksum,
+		ContentType:     object.Metadata.ContentType,
+		ContentEncoding: object.Metadata.ContentEncoding,
+		Metadata:        object.Metadata.UserMetadata,
+	}, nil
 }
 
-// ListObjects lists objects given in a specific categoryName
-// These are discovered by listing objects in s3
-// it would be better to store this info in a database
-func (o ObjectController) ListObjects(categoryName string, token string) (*ListResponse, error) {
+// ListCategories returns a page of the categories in the index. Only the Prefix and Limit options apply
+func (o ObjectController) ListCategories(token string, options ListOptions) (*ListResponse, error) {
+	scope := []string{"categories", options.Prefix}
+	after, err := o.indexAfter(token, scope...)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := o.versions.ListIndexedCategories(options.Prefix, after, options.pageSize()+1)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list categories from the index. %s", err.Error())
+	}
+	page, nextToken := o.indexPage(categories, options.pageSize(), scope...)
+	return &ListResponse{Objects: page, Token: nextToken}, nil
+}
+
+// ListObjects returns a page of the objects of categoryName in the index. Only the Prefix and Limit options apply
+func (o ObjectController) ListObjects(categoryName string, token string, options ListOptions) (*ListResponse, error) {
+	scope := []string{"objects", categoryName, options.Prefix}
+	after, err := o.indexAfter(token, scope...)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := o.versions.ListIndexedObjects(categoryName, options.Prefix, after, options.pageSize()+1)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list objects of category %s from the index. %s", categoryName, err.Error())
+	}
+	page, nextToken := o.indexPage(objects, options.pageSize(), scope...)
+	return &ListResponse{Objects: page, Token: nextToken}, nil
+}
+
+// ListObjectVersions returns a page of the versions of an object in the index
+func (o ObjectController) ListObjectVersions(categoryName string, objectName string, token string) (*ListResponse, error) {
+	entries, nextToken, err := o.listIndexedVersions(categoryName, objectName, "", token, indexPageSize)
+	if err != nil {
+		return nil, err
+	}
+	versions := []string{}
+	for _, entry := range entries {
+		versions = append(versions, entry.Version)
+	}
+	return &ListResponse{Objects: versions, Token: nextToken}, nil
+}
+
+// listBlobCategories lists the categories in the blob store, for reindexing
+func (o ObjectController) listBlobCategories(token string) (*ListResponse, error) {
+	objpath := ""
+	if len(o.path) > 0 {
+		// add trailing slash
+		objpath = path.Clean(o.path) + "/"
+	}
+	categories, err := o.blobs.List(objpath, "/", token)
+	if err != nil {
+		return nil, err
+	}
+	// the trash is kept alongside the categories
+	visible := []string{}
+	for _, category := range categories.Objects {
+		if category != trashCategory {
+			visible = append(visible, category)
+		}
+	}
+	categories.Objects = visible
+	return categories, nil
+}
+
+// listBlobObjects lists the objects of categoryName in the blob store
+func (o ObjectController) listBlobObjects(categoryName string, token string) (*ListResponse, error) {
 	objpath := path.Clean(categoryName)
 	if len(o.path) > 0 {
 		objpath = path.Join(o.path, objpath)
 	}
 	// add trailing slash
 	objpath += "/"
-	return o.listObjectsS3(objpath, "/", token)
+	return o.blobs.List(objpath, "/", token)
 }
 
-// ListObjectVersions lists versions for a given object and category
-// These are discovered by listing objects in s3
-// it would be better to store this info in a database
-func (o ObjectController) ListObjectVersions(categoryName string, objectName string, token string) (*ListResponse, error) {
+// listBlobVersions lists the versions of an object in the blob store, including those still being uploaded
+func (o ObjectController) listBlobVersions(categoryName string, objectName string, token string) (*ListResponse, error) {
 	objpath := path.Join(categoryName, objectName)
 	if len(o.path) > 0 {
 		objpath = path.Join(o.path, objpath)
 	}
 	// add trailing slash
 	objpath += "/"
-	return o.listObjectsS3(objpath, "", token)
+	return o.blobs.List(objpath, "", token)
+}
+
+// VersionListing a version of an object as listed, with what is known about it
+type VersionListing struct {
+	Version      string    `json:"version"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	// Uploaded when the version was added, the last modified time of versions added before it was recorded
+	Uploaded time.Time `json:"uploaded"`
+	// Checksum hex encoded SHA-256 of the content. Empty for versions added before checksums were recorded
+	Checksum string `json:"checksum,omitempty"`
+	// Channels the channels the version is currently the default of
+	Channels []string `json:"channels,omitempty"`
+}
+
+// version listing sort orders
+const (
+	SortName     = "name"
+	SortUploaded = "uploaded"
+	SortSemver   = "semver"
+)
+
+// ListOptions which names are listed and how versions are ordered by ListObjectVersionDetails
+type ListOptions struct {
+	// Sort SortName (the default), SortUploaded or SortSemver
+	Sort       string
+	Descending bool
+	// Limit the maximum number of names returned, 0 for no limit. Pages hold at most indexPageSize names
+	Limit int
+	// Prefix only names starting with it are listed
+	Prefix string
+}
+
+// pageSize the number of names listed per page
+func (l ListOptions) pageSize() int {
+	if l.Limit > 0 && l.Limit < indexPageSize {
+		return l.Limit
+	}
+	return indexPageSize
+}
+
+// maxSortedVersions the most versions that are listed and sorted in memory for orders other than by name
+const maxSortedVersions = 10000
+
+// ListObjectVersionDetails lists the versions of object objectName in categoryName with their size, upload time,
+// checksum and the channels they are the default of. Versions listed by name in ascending order are listed
+// a page at a time. For any other order every version is listed and sorted, so there is never a next token, and
+// objects with more than maxSortedVersions versions are a bad request
+func (o ObjectController) ListObjectVersionDetails(categoryName string, objectName string, token string, options ListOptions) ([]VersionListing, string, error) {
+	switch options.Sort {
+	case "", SortName, SortUploaded, SortSemver:
+	default:
+		return nil, "", RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Unable to sort versions by %s, must be one of name, uploaded, semver", options.Sort)}
+	}
+	if options.Limit < 0 {
+		return nil, "", RequestError{StatusCode: http.StatusBadRequest, Message: "limit can not be negative"}
+	}
+	fullName := path.Join(categoryName, objectName)
+	paged := (options.Sort == "" || options.Sort == SortName) && !options.Descending
+	var entries []IndexEntry
+	nextToken := ""
+	if paged {
+		var err error
+		if entries, nextToken, err = o.listIndexedVersions(categoryName, objectName, options.Prefix, token, options.pageSize()); err != nil {
+			return nil, "", err
+		}
+	} else {
+		// tokens only continue listings by name, so every version is listed from the start
+		pageToken := ""
+		for {
+			listed, next, err := o.listIndexedVersions(categoryName, objectName, options.Prefix, pageToken, indexPageSize)
+			if err != nil {
+				return nil, "", err
+			}
+			entries = append(entries, listed...)
+			if len(entries) > maxSortedVersions {
+				return nil, "", RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Object %s has more than %d versions, too many to sort by anything but name. List them by name a page at a time, or narrow them down with a prefix", fullName, maxSortedVersions)}
+			} else if len(next) == 0 {
+				break
+			}
+			pageToken = next
+		}
+	}
+
+	defaults, err := o.versions.GetDefaults(fullName)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read object %s defaults from the version store. %s", fullName, err.Error())
+	}
+	channels := map[string][]string{}
+	for channel, version := range defaults {
+		channels[version] = append(channels[version], channel)
+	}
+	versions := []VersionListing{}
+	for _, entry := range entries {
+		listing := VersionListing{
+			Version:      entry.Version,
+			Size:         entry.Size,
+			LastModified: entry.LastModified,
+			Uploaded:     entry.Created,
+			Checksum:     entry.Checksum,
+			Channels:     channels[entry.Version],
+		}
+		sort.Strings(listing.Channels)
+		versions = append(versions, listing)
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if options.Descending {
+			a, b = b, a
+		}
+		switch options.Sort {
+		case SortUploaded:
+			return a.Uploaded.Before(b.Uploaded)
+		case SortSemver:
+			// versions that are not semantic versions come first, by name
+			aSemver, aOk := ParseSemver(a.Version)
+			bSemver, bOk := ParseSemver(b.Version)
+			if aOk && bOk {
+				return aSemver.Compare(bSemver) < 0
+			} else if aOk != bOk {
+				return bOk
+			}
+		}
+		return a.Version < b.Version
+	})
+	if !paged && options.Limit > 0 && len(versions) > options.Limit {
+		versions = versions[:options.Limit]
+	}
+	return versions, nextToken, nil
+}
+
+// listAll collects every page of a list call
+func listAll(list func(token string) (*ListResponse, error)) ([]string, error) {
+	items := []string{}
+	token := ""
+	for {
+		page, err := list(token)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Objects...)
+		if len(page.Token) == 0 {
+			return items, nil
+		}
+		token = page.Token
+	}
 }
 
 // SetObjectVersion sets default prod/dev version of object objectName to version version
 func (o ObjectController) SetObjectVersion(objectName string, version string) error {
-	err := o.addObjectToDynamo(objectName, false, version)
+	return o.SetObjectProdVersion(objectName, version, "")
+}
+
+// SetObjectProdVersion sets the default prod and dev versions of objectName to version, as setting the
+// default version did before there were channels. the change is recorded as made by requester
+func (o ObjectController) SetObjectProdVersion(objectName string, version string, requester string) error {
+	if err := o.checkVersionAvailable(objectName, version); err != nil {
+		return err
+	}
+	err := o.versions.SetProdVersion(objectName, version, requester)
 	if err != nil {
-		return fmt.Errorf("Unable to write object %s version %s info to dynamo. %s", objectName, version, err.Error())
+		return fmt.Errorf("Unable to write object %s version %s info to the version store. %s", objectName, version, err.Error())
 	}
 	return nil
 }
 
 // SetObjectDevVersion sets default dev version of object objectName to version version
 func (o ObjectController) SetObjectDevVersion(objectName string, version string) error {
-	err := o.addObjectToDynamo(objectName, true, version)
+	return o.SetObjectChannelVersion(objectName, DevChannel, version, "")
+}
+
+// SetObjectChannelVersion sets the default version of object objectName in channel to version version
+// channels are independent, setting prod leaves dev alone
+// the change is recorded in the object history as made by requester
+func (o ObjectController) SetObjectChannelVersion(objectName string, channel string, version string, requester string) error {
+	if err := checkChannel(channel); err != nil {
+		return err
+	}
+	if err := o.checkVersionAvailable(objectName, version); err != nil {
+		return err
+	}
+	err := o.versions.SetVersion(objectName, channel, version, requester)
 	if err != nil {
-		return fmt.Errorf("Unable to write object %s version %s info to dynamo. %s", objectName, version, err.Error())
+		return fmt.Errorf("Unable to write object %s version %s info to the version store. %s", objectName, version, err.Error())
 	}
 	return nil
 }
 
-// AddObject Orchestrator for adding objects
-// checks if object version already written to s3
-// attempts to write objects to s3. Will not overwrite objects in S3, returns error
-// sets versions in database if dev/prod flags supplied
-func (o ObjectController) AddObject(objectName string, objectContent io.Reader, dev bool, prod bool, version string) error {
-	objectexists, err := o.checkVersionS3(objectName, version)
-	if err != nil {
-		return fmt.Errorf("Unexpected error looking up object %s version %s in S3: %s", objectName, version, err.Error())
+// SetObjectVersionIfMatch sets the default version of objectName in channel to version if it is currently
+// expected ("*" matches any version). Otherwise a VersionMismatchError holding the current version is returned
+func (o ObjectController) SetObjectVersionIfMatch(objectName string, channel string, expected string, version string, requester string) error {
+	if err := checkChannel(channel); err != nil {
+		return err
 	}
-	// return error if trying to redeploy same version of object
-	if objectexists && !(dev || prod) {
-		return fmt.Errorf("Object %s version %s already exists in S3. Not overwriting", objectName, version)
-	} else if !objectexists {
-		// write object to S3 if not already there
-		err := o.addObjectToS3(objectName, version, objectContent)
-		if err != nil {
-			return fmt.Errorf("Unable to write object %s version %s to S3. Error: %s", objectName, version, err.Error())
+	if err := o.checkVersionAvailable(objectName, version); err != nil {
+		return err
+	}
+	err := o.versions.CompareAndSetVersion(objectName, channel, expected, version, requester)
+	if _, ok := err.(VersionMismatchError); ok {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Unable to write object %s version %s info to the version store. %s", objectName, version, err.Error())
+	}
+	return nil
+}
+
+// PromoteObject sets the default version of objectName in channel to to the current default of channel from,
+// if it is still the version given by expected ("" or "*" match any version). Otherwise a VersionMismatchError
+// holding the current version of from is returned. returns the promoted version
+func (o ObjectController) PromoteObject(objectName string, from string, to string, expected string, requester string) (string, error) {
+	for _, channel := range []string{from, to} {
+		if err := checkChannel(channel); err != nil {
+			return "", err
 		}
 	}
-	// update dynamo if dev/prod is set
-	if dev {
-		return o.SetObjectDevVersion(objectName, version)
-	} else if prod {
-		return o.SetObjectVersion(objectName, version)
+	if from == to {
+		return "", RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Can not promote channel %s to itself", from)}
 	}
+	version, err := o.ResolveObjectVersion(objectName, from, time.Time{})
+	if err != nil {
+		return "", err
+	}
+	if len(expected) > 0 && expected != "*" && version != expected {
+		return "", VersionMismatchError{ObjectName: objectName, Channel: from, Expected: expected, Current: version}
+	}
+	if err := o.checkVersionAvailable(objectName, version); err != nil {
+		return "", err
+	}
+	// the store only sets to if from has not changed since it was read
+	err = o.versions.PromoteVersion(objectName, from, to, version, requester)
+	if _, ok := err.(VersionMismatchError); ok {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("Unable to write object %s version %s info to the version store. %s", objectName, version, err.Error())
+	}
+	return version, nil
+}
 
+// checkVersionAvailable returns a 404 RequestError unless version of objectName exists and can be served,
+// so defaults never point at missing content
+func (o ObjectController) checkVersionAvailable(objectName string, version string) error {
+	_, err := o.getObjectFromStore(objectName, version)
+	if _, ok := err.(RequestError); ok {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Unexpected error looking up object %s version %s: %s", objectName, version, err.Error())
+	}
 	return nil
 }
 
-// generateItemContent is a helper to generate the dynamodb putItem input
-func generateItemContent(objectName string, dev bool, version string) map[string]*dynamodb.AttributeValue {
-	item := map[string]*dynamodb.AttributeValue{
-		"name": &dynamodb.AttributeValue{
-			S: aws.String(objectName),
-		},
+// GetObjectHistory returns the changes made to the default versions of objectName, newest first
+// only changes to channel are returned if it is set
+func (o ObjectController) GetObjectHistory(objectName string, channel string) ([]VersionChange, error) {
+	history, err := o.versions.GetHistory(objectName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read object %s history from the version store. %s", objectName, err.Error())
 	}
-	// "dev" objects are for lower environments. If the dev bool is passed only set the dev version
-	if dev {
-		item["dev"] = &dynamodb.AttributeValue{
-			S: aws.String(version),
-		}
-	} else { // otherwise we're setting the prod version, and the dev version should be set to the same as the prod version
-		item["version"] = &dynamodb.AttributeValue{
-			S: aws.String(version),
-		}
-		item["dev"] = &dynamodb.AttributeValue{
-			S: aws.String(version),
+	changes := []VersionChange{}
+	for i := len(history) - 1; i >= 0; i-- {
+		if len(channel) == 0 || history[i].Channel == channel {
+			changes = append(changes, history[i])
 		}
 	}
-	return item
+	return changes, nil
 }
 
-// isRetryable helper function for determining whether an aws error is retryable
-func isRetryable(err error) bool {
-	if aerr, ok := err.(awserr.Error); ok {
-		switch aerr.Code() {
-		case dynamodb.ErrCodeProvisionedThroughputExceededException:
-			return true
-		case dynamodb.ErrCodeInternalServerError:
-			return true
-		default:
-			return false
+// RollbackObject restores the default version of objectName in channel to the version it had before its last change.
+// the rollback is a change itself, so rolling back twice restores the version that was rolled back
+// returns the restored version
+func (o ObjectController) RollbackObject(objectName string, channel string, requester string) (string, error) {
+	if err := checkChannel(channel); err != nil {
+		return "", err
+	}
+	history, err := o.GetObjectHistory(objectName, channel)
+	if err != nil {
+		return "", err
+	}
+	if len(history) == 0 || len(history[0].Previous) == 0 {
+		return "", RequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("Object %s has no previous %s version to roll back to", objectName, channel),
+		}
+	}
+	// only roll back if nothing changed the version since the last recorded change
+	last := history[0]
+	if len(last.Version) == 0 {
+		return "", RequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("The %s version of object %s was removed when version %s was deleted. Set it instead", channel, objectName, last.Previous),
 		}
 	}
-	return false
+	if err := o.SetObjectVersionIfMatch(objectName, channel, last.Version, last.Previous, requester); err != nil {
+		return "", err
+	}
+	return last.Previous, nil
 }
 
-// puts item in dynamodb
-// item primary key is name, also has columns dev and version that are versions of the item
-func (o ObjectController) addObjectToDynamo(objectName string, dev bool, version string) error {
-	// inline function for running put item
-	putItem := func() (*dynamodb.PutItemOutput, error) {
-		return o.ddb.PutItem(&dynamodb.PutItemInput{
-			TableName: o.table,
-			Item:      generateItemContent(objectName, dev, version),
-		})
+// DeleteObjectVersion deletes version of objectName, moving it to the trash. A version that is the default of
+// any channel or tagged is only deleted if force is set, removing it as the default and removing its tags.
+// The delete is recorded in the object history
+func (o ObjectController) DeleteObjectVersion(objectName string, version string, force bool, requester string) error {
+	exists, err := o.checkVersionExists(objectName, version)
+	if err != nil {
+		return fmt.Errorf("Unexpected error looking up object %s version %s in the blob store: %s", objectName, version, err.Error())
+	} else if !exists {
+		return RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s version %s does not exist", objectName, version),
+		}
 	}
-	// backoff for put item
-	retries := 3
-	for i := 1; i < retries; i++ {
-		_, err := putItem()
-		if err != nil {
-			if !isRetryable(err) {
-				return err
-			} else if i+1 < retries {
-				time.Sleep(time.Duration(i) * time.Second)
-			} else {
-				return err
-			}
-		} else {
-			return nil
+	defaults, err := o.versions.GetDefaults(objectName)
+	if err != nil {
+		return fmt.Errorf("Unable to read object %s defaults from the version store. %s", objectName, err.Error())
+	}
+	channels := []string{}
+	for channel, current := range defaults {
+		if current == version {
+			channels = append(channels, channel)
 		}
 	}
-	return nil
+	sort.Strings(channels)
+	tags, err := o.GetObjectTags(objectName)
+	if err != nil {
+		return err
+	}
+	tagged := []string{}
+	for tag, current := range tags {
+		if current == version {
+			tagged = append(tagged, tag)
+		}
+	}
+	sort.Strings(tagged)
+	if (len(channels) > 0 || len(tagged) > 0) && !force {
+		uses := []string{}
+		if len(channels) > 0 {
+			uses = append(uses, "the default of "+strings.Join(channels, ", "))
+		}
+		if len(tagged) > 0 {
+			uses = append(uses, "tagged "+strings.Join(tagged, ", "))
+		}
+		return RequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("Object %s version %s is %s. Set force=true to delete it anyway", objectName, version, strings.Join(uses, " and ")),
+		}
+	}
+	for _, channel := range channels {
+		err := o.versions.ClearVersion(objectName, channel, version, requester)
+		// a channel that changed in the meantime no longer points at the version
+		if _, ok := err.(VersionMismatchError); err != nil && !ok {
+			return fmt.Errorf("Unable to remove object %s %s version from the version store. %s", objectName, channel, err.Error())
+		}
+	}
+	for _, tag := range tagged {
+		// a tag that was removed in the meantime is gone already
+		err := o.DeleteObjectTag(objectName, tag, requester)
+		if reqErr, ok := err.(RequestError); err != nil && !(ok && reqErr.StatusCode == http.StatusNotFound) {
+			return err
+		}
+	}
+	if err := o.trashVersion(objectName, version, requester); err != nil {
+		return err
+	}
+	return o.versions.AppendHistory(objectName, []VersionChange{
+		{Time: time.Now().UTC(), Action: ActionDeleted, Version: version, Requester: requester},
+	})
 }
 
-// listObjectsS3 returns a list of object names for a given path
-// the token is a base64 encoded string
-func (o ObjectController) listObjectsS3(path string, delimiter string, token string) (*ListResponse, error) {
-	isDelimiter := len(delimiter) > 0
-
-	input := &s3.ListObjectsInput{
-		Bucket:    o.bucket,
-		Prefix:    aws.String(path),
-		Delimiter: aws.String(delimiter),
+// DeleteObject deletes every indexed version of objectName, moving them to the trash, and its defaults. Objects with
+// defaults are only deleted if force is set. The delete is recorded in the object history, which is kept.
+// versions still being uploaded are not indexed yet, so they are left to be added once their upload completes
+func (o ObjectController) DeleteObject(objectName string, force bool, requester string) error {
+	defaults, err := o.versions.GetDefaults(objectName)
+	if err != nil {
+		return fmt.Errorf("Unable to read object %s defaults from the version store. %s", objectName, err.Error())
 	}
-	// set Marker if token is provided for pagination
-	if len(token) > 0 {
-		startKey, err := unmarshalToken(token)
-		if err != nil {
-			return nil, err
+	if len(defaults) > 0 && !force {
+		channels := []string{}
+		for channel := range defaults {
+			channels = append(channels, channel)
+		}
+		sort.Strings(channels)
+		return RequestError{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("Object %s has %s versions set. Set force=true to delete it anyway", objectName, strings.Join(channels, ", ")),
 		}
-		input.Marker = aws.String(startKey)
 	}
-
-	objects, err := o.s3.ListObjects(input)
+	versions, err := o.listAllIndexedVersions(objectName, "")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// format response
-	res := &ListResponse{}
-
-	// collect Items
-	keys := make([]string, 0)
-	// if delimiter is provided we are treating CommonPrefixes as the items
-	if isDelimiter {
-		for _, k := range objects.CommonPrefixes {
-			// strip out any potential trailing delimiter chars
-			keys = append(keys, strings.Replace(*k.Prefix, delimiter, "", -1))
+	if len(versions) == 0 && len(defaults) == 0 {
+		return RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s does not exist", objectName),
 		}
-	} else {
-		for _, k := range objects.Contents {
-			// only want the last item in the path for a key
-			splitKey := strings.Split(*k.Key, "/")
-			keys = append(keys, splitKey[len(splitKey)-1])
+	}
+	// defaults are removed first so they never point at deleted content
+	if err := o.versions.DeleteDefaults(objectName, requester); err != nil {
+		return fmt.Errorf("Unable to remove object %s defaults from the version store. %s", objectName, err.Error())
+	}
+	tags, err := o.GetObjectTags(objectName)
+	if err != nil {
+		return err
+	}
+	if err := o.versions.DeleteTags(objectName); err != nil {
+		return fmt.Errorf("Unable to remove object %s tags from the version store. %s", objectName, err.Error())
+	}
+	// the removed tags are recorded like tags removed one at a time
+	names := []string{}
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	untagged := []VersionChange{}
+	for _, tag := range names {
+		untagged = append(untagged, VersionChange{Time: time.Now().UTC(), Action: ActionUntagged, Tag: tag, Previous: tags[tag], Requester: requester})
+	}
+	if len(untagged) > 0 {
+		if err := o.versions.AppendHistory(objectName, untagged); err != nil {
+			return err
 		}
 	}
-	res.Objects = keys
-
-	// set pagination token
-	if *objects.IsTruncated {
-		nextKey := ""
-		if isDelimiter {
-			nextKey = *objects.NextMarker
-		} else { // NextToken should be key of last item in list of contents if no delimiter
-			nextKey = *objects.Contents[len(objects.Contents)-1].Key
+	for _, entry := range versions {
+		if err := o.trashVersion(objectName, entry.Version, requester); err != nil {
+			return err
 		}
-		res.Token = marshalToken(nextKey)
 	}
-
-	return res, nil
+	return o.versions.AppendHistory(objectName, []VersionChange{
+		{Time: time.Now().UTC(), Action: ActionDeleted, Requester: requester},
+	})
 }
 
-func (o ObjectController) getObjectFromDynamo(objectName string) (map[string]*dynamodb.AttributeValue, error) {
-	// function for making aws call
-	getObject := func() (*dynamodb.GetItemOutput, error) {
-		return o.ddb.GetItem(&dynamodb.GetItemInput{
-			Key: map[string]*dynamodb.AttributeValue{
-				"name": &dynamodb.AttributeValue{S: aws.String(objectName)},
-			},
-			TableName: o.table,
-		})
+// AddObject Orchestrator for adding objects
+// checks if object version already written to the blob store
+// claims the version in the version store with a conditional write, so of concurrent uploads of the
+// same version exactly one is written and the others fail with a conflict. Will not overwrite objects
+// sets versions in database if dev/prod flags supplied
+// metadata is stored with the object content. If it has no content type one is sniffed from the content
+// the SHA-256 of the content is recorded with the version. If it does not match checksums the content is deleted
+// uploads to registered categories are rejected if their object is not registered when the category requires it,
+// or their version name, content type or size is not allowed
+func (o ObjectController) AddObject(objectName string, objectContent io.Reader, metadata *ObjectMetadata, checksums *ContentChecksums, dev bool, prod bool, version string) error {
+	objectexists, err := o.checkVersionExists(objectName, version)
+	if err != nil {
+		return fmt.Errorf("Unexpected error looking up object %s version %s in the blob store: %s", objectName, version, err.Error())
 	}
-	// backoff for get item
-	retries := 3
-	for i := 1; i < retries; i++ {
-		res, err := getObject()
+	// return error if trying to redeploy same version of object
+	if objectexists && !(dev || prod) {
+		return versionConflict(objectName, version)
+	} else if !objectexists {
+		// new versions have to meet the policies of their category
+		category, err := o.uploadCategory(objectName)
 		if err != nil {
-			if !isRetryable(err) {
-				return nil, err
-			} else if i+1 < retries {
-				time.Sleep(time.Duration(i) * time.Second)
-			} else {
-				return nil, err
+			return err
+		}
+		if category != nil {
+			if err := category.checkObject(objectName); err != nil {
+				return err
+			}
+			if err := category.checkVersion(version); err != nil {
+				return err
 			}
-		} else {
-			return res.Item, nil
+		}
+		// write object to the blob store if not already there
+		err = o.addObjectToStore(objectName, version, objectContent, metadata, checksums, category)
+		if _, ok := err.(RequestError); ok {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Unable to write object %s version %s to the blob store. Error: %s", objectName, version, err.Error())
+		}
+		// the listings are served from the index. versions that can not be indexed are removed again
+		// like content that can not be stored, so the upload can be retried
+		if err := o.indexVersion(objectName, version); err != nil {
+			o.unindexVersion(objectName, version)
+			o.blobs.Delete(o.getObjectKey(objectName, version))
+			o.versions.DeleteVersionInfo(objectName, version)
+			return err
 		}
 	}
-	return nil, nil
-}
-
-func (o ObjectController) getObjectVersion(objectName string, dev bool) (string, error) {
-	item, err := o.getObjectFromDynamo(objectName)
-	if err != nil {
-		return "", err
-	}
+	// update the version store if dev/prod is set
 	if dev {
-		val, ok := item["dev"]
-		if ok {
-			return *val.S, nil
-		}
-		return "", fmt.Errorf("No dev version set for object %s", objectName)
+		return o.SetObjectDevVersion(objectName, version)
+	} else if prod {
+		return o.SetObjectVersion(objectName, version)
 	}
-	val, ok := item["version"]
-	if ok {
-		return *val.S, nil
+
+	return nil
+}
+
+// versionConflict the error returned when adding a version that already exists
+func versionConflict(objectName string, version string) error {
+	return RequestError{
+		StatusCode: http.StatusConflict,
+		Message:    fmt.Sprintf("Object %s version %s already exists. Not overwriting", objectName, version),
 	}
-	return "", fmt.Errorf("No version set for object %s", objectName)
 }
 
 // generates the key for a object to be stored / retrieved from
 func (o ObjectController) getObjectKey(objectName string, version string) string {
-	// add path if present to s3 object key
+	// add path if present to the blob key
 	key := fmt.Sprintf("%s/%s", objectName, version)
 	if len(o.path) > 0 {
 		key = fmt.Sprintf("%s/%s", o.path, key)
@@ -338,20 +799,10 @@ func (o ObjectController) getObjectKey(objectName string, version string) string
 	return key
 }
 
-// returns true if version is already stored in s3, false otherwise
-func (o ObjectController) checkVersionS3(objectName string, version string) (bool, error) {
-	key := o.getObjectKey(objectName, version)
-
-	_, err := o.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: o.bucket,
-		Key:    aws.String(key),
-	})
-
-	// head object returns error if object does not exist
-	aerr, ok := err.(awserr.Error)
-
-	// head object doesn't return ErrCodeNoSuchKey
-	if ok && aerr.Code() == "NotFound" {
+// returns true if version is already stored in the blob store, false otherwise
+func (o ObjectController) checkVersionExists(objectName string, version string) (bool, error) {
+	_, err := o.blobs.Head(o.getObjectKey(objectName, version))
+	if err == ErrBlobNotFound {
 		return false, nil
 	} else if err != nil {
 		return false, err
@@ -359,43 +810,221 @@ func (o ObjectController) checkVersionS3(objectName string, version string) (boo
 	return true, nil
 }
 
-func (o ObjectController) addObjectToS3(objectName string, version string, objectContent io.Reader) error {
-	// add path if present to s3 object key
+// addObjectToStore streams a new version to the blob store. category the registered category whose
+// content type and size limits the content has to meet, nil if it has none
+func (o ObjectController) addObjectToStore(objectName string, version string, objectContent io.Reader, metadata *ObjectMetadata, checksums *ContentChecksums, category *Category) error {
+	if metadata == nil {
+		metadata = &ObjectMetadata{}
+	}
+	if checksums == nil {
+		checksums = &ContentChecksums{}
+	}
+	var limited *sizeLimitReader
+	if category != nil && category.MaxSize > 0 {
+		limited = &sizeLimitReader{reader: objectContent, remaining: category.MaxSize}
+		objectContent = limited
+	}
+	if len(metadata.ContentType) == 0 {
+		// sniff the content type from the start of the content without consuming it
+		buffered := bufio.NewReaderSize(objectContent, sniffLen)
+		start, _ := buffered.Peek(sniffLen)
+		sniffed := *metadata
+		sniffed.ContentType = http.DetectContentType(start)
+		metadata = &sniffed
+		objectContent = buffered
+	}
+	if category != nil {
+		if err := category.checkContentType(metadata.ContentType); err != nil {
+			return err
+		}
+	}
+	// claim the version before writing anything, so concurrent uploads can not overwrite each other
+	created := time.Now().UTC()
+	err := o.versions.CreateVersionInfo(objectName, version, &VersionInfo{State: VersionPending, Created: created})
+	if err == ErrVersionExists {
+		return versionConflict(objectName, version)
+	} else if err != nil {
+		return err
+	}
+	// the content and claim are removed again if the content can not be stored and verified
+	// so the upload can be retried
 	key := o.getObjectKey(objectName, version)
-
-	// have to know ContentLength
-	byteArray, readErr := ioutil.ReadAll(objectContent)
-	if readErr != nil {
-		fmt.Printf("readerr %v\n", readErr)
-		return readErr
+	abort := func() {
+		o.blobs.Delete(key)
+		o.versions.DeleteVersionInfo(objectName, version)
 	}
 
-	byteReader := bytes.NewReader(byteArray)
-	// I don't think there are retryable errors for s3.putobject
-	_, err := o.s3.PutObject(&s3.PutObjectInput{
-		Bucket:        o.bucket,
-		Key:           aws.String(key),
-		Body:          aws.ReadSeekCloser(byteReader),
-		ContentLength: aws.Int64(int64(byteReader.Len())),
+	// hash the content as it is streamed to the blob store
+	sha := sha256.New()
+	var size byteCounter
+	hashes := []io.Writer{sha, &size}
+	var md hash.Hash
+	if len(checksums.MD5) > 0 {
+		md = md5.New()
+		hashes = append(hashes, md)
+	}
+	err = o.blobs.Put(key, io.TeeReader(objectContent, io.MultiWriter(hashes...)), metadata)
+	if limited != nil && limited.exceeded {
+		abort()
+		return category.tooLarge()
+	} else if err != nil {
+		abort()
+		return err
+	}
+	if checksums.Length > 0 && int64(size) != checksums.Length {
+		abort()
+		return RequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Object %s version %s content is %d bytes, expected %d", objectName, version, size, checksums.Length),
+		}
+	}
+	checksum := sha.Sum(nil)
+	if len(checksums.SHA256) > 0 && !bytes.Equal(checksums.SHA256, checksum) {
+		abort()
+		return RequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Object %s version %s content has SHA-256 %x, expected %x", objectName, version, checksum, checksums.SHA256),
+		}
+	}
+	if md != nil && !bytes.Equal(checksums.MD5, md.Sum(nil)) {
+		abort()
+		return RequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Object %s version %s content has MD5 %x, expected %x", objectName, version, md.Sum(nil), checksums.MD5),
+		}
+	}
+	err = o.versions.PutVersionInfo(objectName, version, &VersionInfo{
+		State:    VersionReady,
+		Checksum: hex.EncodeToString(checksum),
+		Created:  created,
 	})
-
-	return err
+	if err != nil {
+		abort()
+		return err
+	}
+	return nil
 }
 
-func (o ObjectController) getObjectFromS3(objectName string, version string) (io.ReadCloser, error) {
+func (o ObjectController) getObjectFromStore(objectName string, version string) (*ObjectReader, error) {
 	key := o.getObjectKey(objectName, version)
-	res, err := o.s3.GetObject(&s3.GetObjectInput{
-		Bucket: o.bucket,
-		Key:    aws.String(key),
-	})
-
-	if err != nil {
-		aerr, ok := err.(awserr.Error)
-		// format not found errors nicely
-		if ok && aerr.Code() == s3.ErrCodeNoSuchKey {
-			return nil, fmt.Errorf("Object %s version %s does not exist", objectName, version)
+	info, err := o.blobs.Head(key)
+	// format not found errors nicely
+	if err == ErrBlobNotFound {
+		return nil, RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s version %s does not exist", objectName, version),
 		}
+	} else if err != nil {
 		return nil, err
 	}
-	return res.Body, nil
+	versionInfo, err := o.versions.GetVersionInfo(objectName, version)
+	if err != nil {
+		return nil, err
+	}
+	// deleted versions are hidden, even if moving them to the trash did not complete
+	if versionInfo != nil && versionInfo.Trashed() {
+		return nil, RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s version %s was deleted", objectName, version),
+		}
+	}
+	// content is not served until it has been verified
+	if versionInfo != nil && versionInfo.Pending() {
+		return nil, RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s version %s is still being uploaded", objectName, version),
+		}
+	}
+	checksum := ""
+	var created time.Time
+	if versionInfo != nil {
+		checksum = versionInfo.Checksum
+		created = versionInfo.Created
+	}
+	return &ObjectReader{
+		Version:      version,
+		Checksum:     checksum,
+		Created:      created,
+		Size:         info.Size,
+		LastModified: info.LastModified,
+		Metadata:     info.Metadata,
+		blobs:        o.blobs,
+		key:          key,
+	}, nil
+}
+
+// ObjectInfo describes an object version
+type ObjectInfo struct {
+	Name         string    `json:"name"`
+	Version      string    `json:"version"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	// Checksum hex encoded SHA-256 of the content. Empty for versions added before checksums were recorded
+	Checksum        string            `json:"checksum,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// ObjectReader streams the content of an object version from the blob store.
+// Content is not fetched until the first Read, and seeking drops the current
+// stream so the next Read fetches the content from the new offset with a ranged get
+type ObjectReader struct {
+	Version string
+	// Checksum hex encoded SHA-256 of the content. Empty for versions added before checksums were recorded
+	Checksum string
+	// Created when the version was added, zero for versions added before it was recorded
+	Created      time.Time
+	Size         int64
+	LastModified time.Time
+	Metadata     ObjectMetadata
+	blobs        BlobStore
+	key          string
+	offset       int64
+	body         io.ReadCloser
+}
+
+// Read reads object content from the current offset
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.Size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.blobs.GetRange(r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("ObjectReader.Seek: negative position")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the current content stream, if any
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// retentionRequester the requester recorded in the history for versions deleted by the garbage collector
+const retentionRequester = "retention"
+
+// RetentionPolicy the rules deciding which versions of the objects in a category are deleted.
+// A version is deleted when it is not one of the newest KeepNewest versions and is older than MaxAgeDays.
+// Versions that are a default, or were within ProtectDefaultsDays, are never deleted
+type RetentionPolicy struct {
+	// KeepNewest the number of newest versions kept regardless of age, 0 keeps none by count
+	KeepNewest int `json:"keepNewest"`
+	// MaxAgeDays versions younger than this are kept, 0 deletes versions of any age past KeepNewest
+	MaxAgeDays int `json:"maxAgeDays"`
+	// ProtectDefaultsDays versions that were a default of any channel within this many days are kept
+	ProtectDefaultsDays int `json:"protectDefaultsDays"`
+}
+
+// RetentionPolicies retention policies keyed by category. The policy of category * applies to
+// categories without their own. Categories without a policy are never collected
+type RetentionPolicies map[string]RetentionPolicy
+
+// ParseRetentionPolicies parses retention policies from json, e.g.
+// {"maps": {"keepNewest": 10, "maxAgeDays": 30, "protectDefaultsDays": 7}}
+func ParseRetentionPolicies(raw string) (RetentionPolicies, error) {
+	policies := RetentionPolicies{}
+	if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+		return nil, fmt.Errorf("Unable to parse retention policies. %s", err.Error())
+	}
+	for category, policy := range policies {
+		if policy.KeepNewest < 0 || policy.MaxAgeDays < 0 || policy.ProtectDefaultsDays < 0 {
+			return nil, fmt.Errorf("Retention policy of category %s can not have negative values", category)
+		}
+		if policy.KeepNewest == 0 && policy.MaxAgeDays == 0 {
+			return nil, fmt.Errorf("Retention policy of category %s must set keepNewest or maxAgeDays", category)
+		}
+	}
+	return policies, nil
+}
+
+// policy returns the retention policy of category and whether it has one
+func (p RetentionPolicies) policy(category string) (RetentionPolicy, bool) {
+	if policy, ok := p[category]; ok {
+		return policy, true
+	}
+	policy, ok := p["*"]
+	return policy, ok
+}
+
+// CollectGarbage deletes the versions of every object that its category retention policy no longer keeps.
+// With dryRun set nothing is deleted. returns the category/object/version of each (would be) deleted version
+func (o ObjectController) CollectGarbage(policies RetentionPolicies, dryRun bool) ([]string, error) {
+	collected := []string{}
+	categories, err := listAll(func(token string) (*ListResponse, error) {
+		return o.ListCategories(token, ListOptions{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list categories. %s", err.Error())
+	}
+	for _, category := range categories {
+		policy, ok := policies.policy(category)
+		if !ok {
+			continue
+		}
+		objects, err := listAll(func(token string) (*ListResponse, error) {
+			return o.ListObjects(category, token, ListOptions{})
+		})
+		if err != nil {
+			return collected, fmt.Errorf("Unable to list objects of category %s. %s", category, err.Error())
+		}
+		for _, object := range objects {
+			objectName := category + "/" + object
+			expired, err := o.expiredVersions(objectName, policy, time.Now())
+			if err != nil {
+				return collected, err
+			}
+			for _, version := range expired {
+				if !dryRun {
+					err := o.DeleteObjectVersion(objectName, version, false, retentionRequester)
+					// versions that became a default or were deleted in the meantime are skipped
+					if reqErr, ok := err.(RequestError); ok && (reqErr.StatusCode == http.StatusConflict || reqErr.StatusCode == http.StatusNotFound) {
+						continue
+					} else if err != nil {
+						return collected, err
+					}
+				}
+				collected = append(collected, objectName+"/"+version)
+			}
+		}
+	}
+	return collected, nil
+}
+
+// versionAge a version and when it was added
+type versionAge struct {
+	version string
+	created time.Time
+}
+
+// expiredVersions returns the versions of objectName policy does not keep at now, oldest first
+func (o ObjectController) expiredVersions(objectName string, policy RetentionPolicy, now time.Time) ([]string, error) {
+	entries, err := o.listAllIndexedVersions(objectName, "")
+	if err != nil {
+		return nil, err
+	}
+	// the index only holds versions that can be served, so uploads in progress are left alone
+	ages := []versionAge{}
+	for _, entry := range entries {
+		ages = append(ages, versionAge{version: entry.Version, created: entry.Created})
+	}
+	// newest first
+	sort.Slice(ages, func(i, j int) bool { return ages[i].created.After(ages[j].created) })
+
+	protected, err := o.protectedVersions(objectName, now.AddDate(0, 0, -policy.ProtectDefaultsDays))
+	if err != nil {
+		return nil, err
+	}
+	expired := []string{}
+	cutoff := now.AddDate(0, 0, -policy.MaxAgeDays)
+	for i := len(ages) - 1; i >= policy.KeepNewest; i-- {
+		if ages[i].created.Before(cutoff) && !protected[ages[i].version] {
+			expired = append(expired, ages[i].version)
+		}
+	}
+	return expired, nil
+}
+
+// protectedVersions the versions of objectName that are tagged or a default of any channel, or were a default since since
+func (o ObjectController) protectedVersions(objectName string, since time.Time) (map[string]bool, error) {
+	protected := map[string]bool{}
+	defaults, err := o.versions.GetDefaults(objectName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read object %s defaults. %s", objectName, err.Error())
+	}
+	for _, version := range defaults {
+		protected[version] = true
+	}
+	tags, err := o.versions.GetTags(objectName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read object %s tags. %s", objectName, err.Error())
+	}
+	for _, version := range tags {
+		protected[version] = true
+	}
+	history, err := o.versions.GetHistory(objectName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read object %s history. %s", objectName, err.Error())
+	}
+	for _, change := range history {
+		// the previous version was the default until the change
+		if len(change.Action) == 0 && change.Time.After(since) {
+			protected[change.Previous] = true
+			protected[change.Version] = true
+		}
+	}
+	return protected, nil
+}
+
+// collectGarbageEvery runs CollectGarbage with policies every interval, logging what is collected
+func (o ObjectController) collectGarbageEvery(interval time.Duration, policies RetentionPolicies, dryRun bool) {
+	for range time.Tick(interval) {
+		collected, err := o.CollectGarbage(policies, dryRun)
+		logCollected(collected, dryRun, err)
+	}
+}
+
+// logCollected logs the result of a CollectGarbage run
+func logCollected(collected []string, dryRun bool, err error) {
+	action := "deleted"
+	if dryRun {
+		action = "would delete"
+	}
+	for _, version := range collected {
+		log.Printf("Retention: %s %s", action, version)
+	}
+	if err != nil {
+		log.Printf("Retention: garbage collection failed. %s", err.Error())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	policies, err := ParseRetentionPolicies(`{"maps": {"keepNewest": 10}, "*": {"maxAgeDays": 30}}`)
+	if err != nil {
+		t.Fatalf("ParseRetentionPolicies returned an error: %v", err)
+	}
+	if policy, _ := policies.policy("maps"); policy.KeepNewest != 10 {
+		t.Fatalf("maps should have its own policy. Is: %+v", policy)
+	}
+	if policy, ok := policies.policy("builds"); !ok || policy.MaxAgeDays != 30 {
+		t.Fatalf("categories without a policy should use the * policy. Is: %+v", policy)
+	}
+	for _, raw := range []string{`{"maps": {}}`, `{"maps": {"keepNewest": -1}}`, `nope`} {
+		if _, err := ParseRetentionPolicies(raw); err == nil {
+			t.Fatalf("ParseRetentionPolicies should refuse %s", raw)
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	objects := NewObjectController(blobs, versions, "dang")
+	now := time.Now()
+	for i, version := range []string{"1", "2", "3", "4", "5"} {
+		objects.AddObject("maps/de_dust.map", strings.NewReader("content "+version), nil, nil, false, false, version)
+		objects.AddObject("builds/app.jar", strings.NewReader("content "+version), nil, nil, false, false, version)
+		// version 1 is 50 days old, version 5 10 days
+		created := now.AddDate(0, 0, -10*(5-i))
+		objects.versions.PutVersionInfo("maps/de_dust.map", version, &VersionInfo{State: VersionReady, Created: created})
+		objects.versions.PutVersionInfo("builds/app.jar", version, &VersionInfo{State: VersionReady, Created: created})
+	}
+	// versions are aged from their creation in the index
+	objects.Reindex()
+	// 1 is the default, 2 was until just now
+	objects.SetObjectVersion("maps/de_dust.map", "2")
+	objects.SetObjectVersion("maps/de_dust.map", "1")
+
+	policies := RetentionPolicies{"maps": RetentionPolicy{KeepNewest: 2, MaxAgeDays: 15, ProtectDefaultsDays: 7}}
+	collected, err := objects.CollectGarbage(policies, true)
+	if err != nil {
+		t.Fatalf("CollectGarbage returned an error: %v", err)
+	}
+	if fmt.Sprint(collected) != "[maps/de_dust.map/3]" {
+		t.Fatalf("CollectGarbage should collect only version 3. Collected: %v", collected)
+	}
+	if _, err := objects.GetObject("maps/de_dust.map", "3", ""); err != nil {
+		t.Fatalf("CollectGarbage should not delete anything on a dry run. Error: %v", err)
+	}
+
+	collected, _ = objects.CollectGarbage(policies, false)
+	if fmt.Sprint(collected) != "[maps/de_dust.map/3]" {
+		t.Fatalf("CollectGarbage should delete version 3. Deleted: %v", collected)
+	}
+	list, _ := objects.ListObjectVersions("maps", "de_dust.map", "")
+	if strings.Join(list.Objects, ",") != "1,2,4,5" {
+		t.Fatalf("CollectGarbage should have deleted only version 3. Left: %v", list.Objects)
+	}
+	list, _ = objects.ListObjectVersions("builds", "app.jar", "")
+	if len(list.Objects) != 5 {
+		t.Fatalf("CollectGarbage should not delete versions of categories without a policy. Left: %v", list.Objects)
+	}
+
+	// without protection for past defaults only the current ones and tagged versions are kept
+	objects.SetObjectTag("builds/app.jar", "lts", "2", "unit test")
+	collected, _ = objects.CollectGarbage(RetentionPolicies{"*": RetentionPolicy{MaxAgeDays: 15}}, true)
+	if fmt.Sprint(collected) != "[builds/app.jar/1 builds/app.jar/3 builds/app.jar/4 maps/de_dust.map/2 maps/de_dust.map/4]" {
+		t.Fatalf("CollectGarbage should collect everything older than 15 days but the defaults and tags. Collected: %v", collected)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverPattern matches semantic versions (https://semver.org), optionally prefixed with v
+var semverPattern = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+
+// Semver a semantic version
+type Semver struct {
+	Major int64
+	Minor int64
+	Patch int64
+	// Prerelease the dot separated pre-release identifiers, e.g. rc.1
+	Prerelease []string
+	// Build the build metadata, ignored when comparing versions
+	Build string
+}
+
+// ParseSemver parses version as a semantic version. returns false if it is not one
+func ParseSemver(version string) (Semver, bool) {
+	match := semverPattern.FindStringSubmatch(version)
+	if match == nil {
+		return Semver{}, false
+	}
+	semver := Semver{Build: match[5]}
+	var err error
+	for i, part := range []*int64{&semver.Major, &semver.Minor, &semver.Patch} {
+		if *part, err = strconv.ParseInt(match[i+1], 10, 64); err != nil {
+			return Semver{}, false
+		}
+	}
+	if len(match[4]) > 0 {
+		semver.Prerelease = strings.Split(match[4], ".")
+	}
+	return semver, true
+}
+
+// Compare returns -1, 0 or 1 if s has lower, equal or higher precedence than other
+func (s Semver) Compare(other Semver) int {
+	for _, parts := range [][2]int64{{s.Major, other.Major}, {s.Minor, other.Minor}, {s.Patch, other.Patch}} {
+		if parts[0] != parts[1] {
+			return compareInts(parts[0], parts[1])
+		}
+	}
+	// a pre-release has lower precedence than the release
+	if len(s.Prerelease) == 0 || len(other.Prerelease) == 0 {
+		return compareInts(int64(len(other.Prerelease)), int64(len(s.Prerelease)))
+	}
+	for i := 0; i < len(s.Prerelease) && i < len(other.Prerelease); i++ {
+		if cmp := comparePrerelease(s.Prerelease[i], other.Prerelease[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return compareInts(int64(len(s.Prerelease)), int64(len(other.Prerelease)))
+}
+
+// comparePrerelease compares pre-release identifiers. Numeric identifiers are compared numerically and
+// have lower precedence than alphanumeric ones, which are compared lexically
+func comparePrerelease(a string, b string) int {
+	aNum, aErr := strconv.ParseInt(a, 10, 64)
+	bNum, bErr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInts(aNum, bNum)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Constraint a semantic version constraint such as ^2.3, ~1.2.0, >=1.2 <2, 1.x || 2.0.0 - 2.4 or latest
+type Constraint struct {
+	// alternatives the comparator sets separated by ||. A version matches when it satisfies every
+	// comparator of any of them
+	alternatives [][]comparator
+}
+
+type comparator struct {
+	// op one of =, <, <=, >, >=
+	op      string
+	version Semver
+}
+
+// prereleasePattern matches dot separated pre-release identifiers
+var prereleasePattern = regexp.MustCompile(`^[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*$`)
+
+// ParseConstraint parses a semantic version constraint. Comparators are separated by spaces or commas,
+// alternatives by ||. Partial versions and x-ranges (1, 1.2, 1.x, *) match every version they leave open,
+// latest matches any version. Pre-releases only match comparators naming a pre-release of the same version
+func ParseConstraint(constraint string) (Constraint, error) {
+	parsed := Constraint{}
+	for _, alternative := range strings.Split(constraint, "||") {
+		comparators, err := parseComparators(alternative)
+		if err != nil {
+			return Constraint{}, fmt.Errorf("Invalid version constraint %q. %s", constraint, err.Error())
+		}
+		parsed.alternatives = append(parsed.alternatives, comparators)
+	}
+	return parsed, nil
+}
+
+// parseComparators parses one alternative of a constraint
+func parseComparators(alternative string) ([]comparator, error) {
+	fields := strings.Fields(strings.Replace(alternative, ",", " ", -1))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Empty comparator set")
+	}
+	// hyphen ranges: 1.2 - 2.3.4
+	if len(fields) == 3 && fields[1] == "-" {
+		lower, lowerParts, err := parsePartialSemver(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		upper, upperParts, err := parsePartialSemver(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		comparators := []comparator{}
+		if lowerParts > 0 {
+			comparators = append(comparators, comparator{op: ">=", version: lower})
+		}
+		if upperParts == 3 {
+			comparators = append(comparators, comparator{op: "<=", version: upper})
+		} else if upperParts > 0 {
+			comparators = append(comparators, comparator{op: "<", version: bumpSemver(upper, upperParts)})
+		}
+		return comparators, nil
+	}
+
+	comparators := []comparator{}
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if strings.ToLower(field) == "latest" {
+			continue
+		}
+		version := strings.TrimLeft(field, "<>=~^")
+		op := field[:len(field)-len(version)]
+		// the operator may be separated from its version: >= 1.2
+		if len(version) == 0 && i+1 < len(fields) {
+			i++
+			version = fields[i]
+		}
+		semver, parts, err := parsePartialSemver(version)
+		if err != nil {
+			return nil, err
+		}
+		ranged, err := rangeComparators(op, semver, parts)
+		if err != nil {
+			return nil, err
+		}
+		comparators = append(comparators, ranged...)
+	}
+	return comparators, nil
+}
+
+// rangeComparators the comparators of op applied to a version of which only the first parts are given
+func rangeComparators(op string, version Semver, parts int) ([]comparator, error) {
+	switch op {
+	case "^":
+		if parts == 0 {
+			return nil, nil
+		}
+		// the leftmost non-zero part may not change
+		upper := bumpSemver(version, 3)
+		if version.Major > 0 || parts == 1 {
+			upper = bumpSemver(version, 1)
+		} else if version.Minor > 0 || parts == 2 {
+			upper = bumpSemver(version, 2)
+		}
+		return []comparator{{op: ">=", version: version}, {op: "<", version: upper}}, nil
+	case "~":
+		if parts == 0 {
+			return nil, nil
+		}
+		upper := bumpSemver(version, 2)
+		if parts == 1 {
+			upper = bumpSemver(version, 1)
+		}
+		return []comparator{{op: ">=", version: version}, {op: "<", version: upper}}, nil
+	case "", "=":
+		if parts == 3 {
+			return []comparator{{op: "=", version: version}}, nil
+		} else if parts == 0 {
+			return nil, nil
+		}
+		return []comparator{{op: ">=", version: version}, {op: "<", version: bumpSemver(version, parts)}}, nil
+	case "<", "<=", ">", ">=":
+		if parts == 3 {
+			return []comparator{{op: op, version: version}}, nil
+		} else if parts == 0 {
+			// <* and >* match nothing, <=* and >=* everything
+			if op == "<" || op == ">" {
+				return []comparator{{op: "<", version: Semver{}}}, nil
+			}
+			return nil, nil
+		}
+		// >1.2 means 1.3.0 or higher, <=1.2 any 1.2.x
+		switch op {
+		case ">":
+			return []comparator{{op: ">=", version: bumpSemver(version, parts)}}, nil
+		case "<=":
+			return []comparator{{op: "<", version: bumpSemver(version, parts)}}, nil
+		}
+		return []comparator{{op: op, version: version}}, nil
+	}
+	return nil, fmt.Errorf("Unknown operator %s", op)
+}
+
+// parsePartialSemver parses a version of which trailing parts may be left out or be wildcards (x, X or *).
+// Returns the version with the missing parts set to 0 and the number of parts given
+func parsePartialSemver(version string) (Semver, int, error) {
+	semver := Semver{}
+	rest := strings.TrimPrefix(version, "v")
+	if i := strings.Index(rest, "+"); i >= 0 {
+		rest, semver.Build = rest[:i], rest[i+1:]
+	}
+	if i := strings.Index(rest, "-"); i >= 0 {
+		prerelease := rest[i+1:]
+		if !prereleasePattern.MatchString(prerelease) {
+			return Semver{}, 0, fmt.Errorf("Invalid pre-release in version %s", version)
+		}
+		rest, semver.Prerelease = rest[:i], strings.Split(prerelease, ".")
+	}
+	given := strings.Split(rest, ".")
+	if len(given) > 3 {
+		return Semver{}, 0, fmt.Errorf("Invalid version %s", version)
+	}
+	parts := 0
+	targets := []*int64{&semver.Major, &semver.Minor, &semver.Patch}
+	for _, part := range given {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		number, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || number < 0 {
+			return Semver{}, 0, fmt.Errorf("Invalid version %s", version)
+		}
+		*targets[parts] = number
+		parts++
+	}
+	for _, part := range given[parts:] {
+		if part != "x" && part != "X" && part != "*" {
+			return Semver{}, 0, fmt.Errorf("Invalid version %s, wildcards must come last", version)
+		}
+	}
+	if parts < 3 && (len(semver.Prerelease) > 0 || len(semver.Build) > 0) {
+		return Semver{}, 0, fmt.Errorf("Invalid version %s, only full versions can have a pre-release", version)
+	}
+	return semver, parts, nil
+}
+
+// bumpSemver the lowest version above every version starting with the first parts of version
+func bumpSemver(version Semver, parts int) Semver {
+	switch parts {
+	case 1:
+		return Semver{Major: version.Major + 1}
+	case 2:
+		return Semver{Major: version.Major, Minor: version.Minor + 1}
+	}
+	return Semver{Major: version.Major, Minor: version.Minor, Patch: version.Patch + 1}
+}
+
+// Match returns whether version satisfies the constraint
+func (c Constraint) Match(version Semver) bool {
+	for _, comparators := range c.alternatives {
+		if matchComparators(comparators, version) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComparators(comparators []comparator, version Semver) bool {
+	for _, c := range comparators {
+		if !c.match(version) {
+			return false
+		}
+	}
+	if len(version.Prerelease) == 0 {
+		return true
+	}
+	// pre-releases are opted into per version: >=1.2.3-rc.1 matches 1.2.3-rc.2, but not 1.3.0-rc.1
+	for _, c := range comparators {
+		if len(c.version.Prerelease) > 0 && c.version.Major == version.Major && c.version.Minor == version.Minor && c.version.Patch == version.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c comparator) match(version Semver) bool {
+	cmp := version.Compare(c.version)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestParseSemver(t *testing.T) {
+	semver, ok := ParseSemver("v1.2.3-rc.1+build.42")
+	if !ok || semver.Major != 1 || semver.Minor != 2 || semver.Patch != 3 || len(semver.Prerelease) != 2 || semver.Build != "build.42" {
+		t.Fatalf("ParseSemver should parse v1.2.3-rc.1+build.42. Parsed: %+v", semver)
+	}
+	for _, version := range []string{"1.2", "01.2.3", "1.2.3-", "abc123", ""} {
+		if _, ok := ParseSemver(version); ok {
+			t.Fatalf("%s should not parse as a semantic version", version)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	// in increasing precedence, from the semver spec
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.2.0", "2.0.0"}
+	for i := 0; i < len(ordered)-1; i++ {
+		lower, _ := ParseSemver(ordered[i])
+		higher, _ := ParseSemver(ordered[i+1])
+		if lower.Compare(higher) != -1 || higher.Compare(lower) != 1 {
+			t.Fatalf("%s should have lower precedence than %s", ordered[i], ordered[i+1])
+		}
+	}
+	withBuild, _ := ParseSemver("1.0.0+build")
+	release, _ := ParseSemver("1.0.0")
+	if withBuild.Compare(release) != 0 {
+		t.Fatalf("Build metadata should be ignored when comparing versions")
+	}
+}
+
+func TestConstraintMatch(t *testing.T) {
+	cases := []struct {
+		constraint string
+		matching   []string
+		other      []string
+	}{
+		{"^2.3", []string{"2.3.0", "2.9.1"}, []string{"2.2.9", "3.0.0", "2.4.0-rc.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0", "1.2.2"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{">=1.2 <2", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0"}},
+		{">= 1.2, <= 1.3", []string{"1.3.7"}, []string{"1.4.0"}},
+		{"1.x || >=3.0.0-rc.1", []string{"1.5.0", "3.0.0-rc.2", "4.0.0"}, []string{"2.0.0", "3.1.0-rc.1"}},
+		{"1.2.0 - 1.4", []string{"1.2.0", "1.4.9"}, []string{"1.5.0"}},
+		{"=1.2.3", []string{"v1.2.3"}, []string{"1.2.4"}},
+		{"latest", []string{"0.0.1", "10.0.0"}, []string{"1.0.0-beta"}},
+	}
+	for _, c := range cases {
+		constraint, err := ParseConstraint(c.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%s) returned an error: %v", c.constraint, err)
+		}
+		for _, version := range c.matching {
+			semver, _ := ParseSemver(version)
+			if !constraint.Match(semver) {
+				t.Fatalf("%s should match %s", c.constraint, version)
+			}
+		}
+		for _, version := range c.other {
+			semver, _ := ParseSemver(version)
+			if constraint.Match(semver) {
+				t.Fatalf("%s should not match %s", c.constraint, version)
+			}
+		}
+	}
+	for _, constraint := range []string{"", "^", "1.2.3.4", "1.x.3", "!1.2", "1.2 ||", "^1.2-rc"} {
+		if _, err := ParseConstraint(constraint); err == nil {
+			t.Fatalf("ParseConstraint(%q) should return an error", constraint)
+		}
+	}
+}
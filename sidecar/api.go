@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -34,6 +37,7 @@ func NewAPI(cacheSize int, cacheExpirySeconds int, url string) *API {
 		ObjectClient: NewObjectServiceClient(url),
 	}
 
+	router.HandleFunc("/batch", api.GetBatch).Methods("POST")
 	router.HandleFunc("/{category}/{object}/{version}", api.GetObject).Methods("GET")
 	router.HandleFunc("/{category}/{object}", api.GetObject).Methods("GET")
 
@@ -42,43 +46,114 @@ func NewAPI(cacheSize int, cacheExpirySeconds int, url string) *API {
 	return api
 }
 
+// Object an object fetched from the object service
+type Object struct {
+	Content []byte
+	// Header holds the headers describing the object returned by the object service:
+	// Content-Type, Content-Encoding, X-Object-Meta-*, the validators and the version served
+	Header http.Header
+}
+
+// ErrNotModified returned by ObjectClient.GetObject when the object still has the ETag it was asked about,
+// along with an Object holding only the headers of the 304 response
+var ErrNotModified = errors.New("Object not modified")
+
+// objectHeaders the headers describing object content which are kept with cached objects
+var objectHeaders = []string{"Content-Type", "Content-Encoding", "ETag", "Digest", "Last-Modified", "X-Object-Version"}
+
+// userMetadataPrefix prefix of the headers holding user supplied object metadata
+const userMetadataPrefix = "X-Object-Meta-"
+
+// objectHeader returns the headers from header that describe object content
+func objectHeader(header http.Header) http.Header {
+	kept := make(http.Header)
+	for _, name := range objectHeaders {
+		if value := header.Get(name); len(value) > 0 {
+			kept.Set(name, value)
+		}
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, userMetadataPrefix) {
+			kept[name] = values
+		}
+	}
+	return kept
+}
+
+// ObjectClient fetches objects. If no version is given the highest version matching constraint is fetched,
+// or without a constraint the default version in channel ("" for the prod channel).
+// If etag is set and the object still has it ErrNotModified is returned, with the headers it was returned with.
+// GetBatch fetches several objects at once, returned in the order of entries
 type ObjectClient interface {
-	GetObject(objectname string, objectversion string, dev bool) ([]byte, error)
+	GetObject(objectname string, objectversion string, channel string, constraint string, etag string) (*Object, error)
+	GetBatch(entries []BatchEntry) (*BatchStream, error)
 }
 
 type ObjectServiceClient struct {
 	ObjectServiceURL string
+	client           *http.Client
+	// batchClient the client batches are streamed with. Only connecting and waiting for the response headers
+	// time out, as batches of large objects can take longer than any fixed timeout to read
+	batchClient *http.Client
 }
 
 func NewObjectServiceClient(url string) ObjectServiceClient {
+	// objects stored with a Content-Encoding are passed on as is, not decoded
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DisableCompression:    true,
+		DialContext:           (&net.Dialer{Timeout: time.Second * 30}).DialContext,
+		ResponseHeaderTimeout: time.Second * 30,
+	}
 	return ObjectServiceClient{
 		ObjectServiceURL: url,
+		client: &http.Client{
+			Timeout:   time.Second * 30,
+			Transport: transport,
+		},
+		batchClient: &http.Client{
+			Transport: transport,
+		},
 	}
 }
 
-func (o ObjectServiceClient) GetObject(objectname string, objectversion string, dev bool) ([]byte, error) {
+func (o ObjectServiceClient) GetObject(objectname string, objectversion string, channel string, constraint string, etag string) (*Object, error) {
 	var endpoint = fmt.Sprintf("%s", objectname)
 	if len(objectversion) > 0 {
 		endpoint += fmt.Sprintf("/%s", objectversion)
 	}
 
-	if dev && len(objectversion) == 0 {
-		endpoint += "?dev=true"
+	if len(constraint) > 0 && len(objectversion) == 0 {
+		endpoint += "?constraint=" + url.QueryEscape(constraint)
+	} else if len(channel) > 0 && len(objectversion) == 0 {
+		endpoint += "?channel=" + url.QueryEscape(channel)
 	}
 
-	client := &http.Client{
-		Timeout: time.Second * 30,
+	req, err := http.NewRequest("GET", o.ObjectServiceURL+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
 	}
-	res, err := client.Get(o.ObjectServiceURL + endpoint)
+	res, err := o.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	defer res.Body.Close()
 
-	if res.StatusCode == 200 {
-		objectcontent, _ := ioutil.ReadAll(res.Body)
-		return objectcontent, nil
+	if res.StatusCode == http.StatusNotModified {
+		return &Object{Header: objectHeader(res.Header)}, ErrNotModified
+	} else if res.StatusCode == 200 {
+		objectcontent, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &Object{
+			Content: objectcontent,
+			Header:  objectHeader(res.Header),
+		}, nil
 	} else {
 		body, _ := ioutil.ReadAll(res.Body)
 
@@ -95,36 +170,64 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func makeKey(objectname string, objectversion string, dev bool) string {
+// makeKey the cache key of an object version, of the version of an object matching a constraint,
+// or of the default version of an object in a channel
+func makeKey(objectname string, objectversion string, channel string, constraint string) string {
 	if len(objectversion) > 0 {
 		return fmt.Sprintf("%s/%s", objectname, objectversion)
-	} else if dev {
-		return fmt.Sprintf("%s/dev", objectname)
+	} else if len(constraint) > 0 {
+		return fmt.Sprintf("%s?constraint=%s", objectname, url.QueryEscape(constraint))
+	} else if len(channel) > 0 && channel != "prod" {
+		// channels can not be confused with versions as versions can not contain ?
+		return fmt.Sprintf("%s?channel=%s", objectname, channel)
 	}
 	return objectname
 }
 
+// revalidated the cached object with the headers of the 304 response revalidating it. The content is the same,
+// but e.g. a channel default can now be another version with the same content, or the metadata may have changed.
+// headers the 304 response left out are kept from the cached object
+func revalidated(cached *Object, notModified *Object) *Object {
+	header := make(http.Header)
+	for name, values := range cached.Header {
+		header[name] = values
+	}
+	if notModified != nil {
+		for name, values := range notModified.Header {
+			header[name] = values
+		}
+	}
+	return &Object{Content: cached.Content, Header: header}
+}
+
 // resolveobject fetches a object from the cache or from the object service, if needed
-func (a API) resolveObject(objectname string, objectversion string, dev bool) ([]byte, error) {
-	cacheKey := makeKey(objectname, objectversion, dev)
+// expired objects are revalidated with a conditional request and only fetched again if they changed
+func (a API) resolveObject(objectname string, objectversion string, channel string, constraint string) (*Object, error) {
+	cacheKey := makeKey(objectname, objectversion, channel, constraint)
 
-	objectIface, exists := a.Cache.Get(cacheKey)
-	var objectContent []byte
-	var err error
+	objectIface, fresh, exists := a.Cache.Lookup(cacheKey)
+	if exists && fresh {
+		fmt.Printf("Found object %s in cache\n", objectname)
+		return objectIface.(*Object), nil
+	}
 
+	etag := ""
 	if exists {
-		fmt.Printf("Found object %s in cache\n", objectname)
-		objectContent = objectIface.([]byte)
+		fmt.Printf("Object %s expired in cache, revalidating with object service\n", objectname)
+		etag = objectIface.(*Object).Header.Get("ETag")
 	} else {
 		fmt.Printf("Object %s not in cache, pulling from object service\n", objectname)
-		objectContent, err = a.ObjectClient.GetObject(objectname, objectversion, dev)
-		if err != nil {
-			return nil, err
-		}
-		a.Cache.Add(cacheKey, objectContent)
 	}
+	object, err := a.ObjectClient.GetObject(objectname, objectversion, channel, constraint, etag)
+	if err == ErrNotModified {
+		object = revalidated(objectIface.(*Object), object)
+	} else if err != nil {
+		return nil, err
+	}
+	// (re)adding the object restarts its expiry
+	a.Cache.Add(cacheKey, object)
 
-	return objectContent, nil
+	return object, nil
 }
 
 func (a API) GetObject(res http.ResponseWriter, req *http.Request) {
@@ -134,13 +237,22 @@ func (a API) GetObject(res http.ResponseWriter, req *http.Request) {
 	objectName := routeVars["object"]
 	objectKey := fmt.Sprintf("%s/%s", categoryName, objectName)
 
-	dev := req.URL.Query().Get("dev")
-	devParam := strings.ToLower(dev) == "true"
+	// dev=true is an alias for channel=dev
+	channel := req.URL.Query().Get("channel")
+	if len(channel) == 0 && strings.ToLower(req.URL.Query().Get("dev")) == "true" {
+		channel = "dev"
+	}
+	// constraint=^2.3 resolves the highest matching version, see the object service
+	constraint := req.URL.Query().Get("constraint")
 
-	objectcontent, err := a.resolveObject(objectKey, objectVersion, devParam)
+	object, err := a.resolveObject(objectKey, objectVersion, channel, constraint)
 	if err == nil {
-		res.Header().Set("Content-Type", "application/java-archive")
-		res.Write(objectcontent)
+		for name, values := range object.Header {
+			res.Header()[name] = values
+		}
+		// ServeContent answers conditional and Range requests from the cached content
+		lastModified, _ := http.ParseTime(object.Header.Get("Last-Modified"))
+		http.ServeContent(res, req, "", lastModified, bytes.NewReader(object.Content))
 	} else {
 		responseBody, _ := json.Marshal(JSONResponse{
 			Status: "error",
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -15,10 +21,64 @@ import (
 type MockObjectClient struct {
 	mockObjectContent []byte
 	mockObjectError   error
+	// etags the If-None-Match etags GetObject was called with
+	etags *[]string
+	// notModifiedHeader the headers returned with ErrNotModified
+	notModifiedHeader http.Header
+	// batches the entries GetBatch was called with
+	batches *[][]BatchEntry
 }
 
-func (m MockObjectClient) GetObject(objectname string, objectversion string, dev bool) ([]byte, error) {
-	return m.mockObjectContent, m.mockObjectError
+func (m MockObjectClient) GetObject(objectname string, objectversion string, channel string, constraint string, etag string) (*Object, error) {
+	if m.etags != nil {
+		*m.etags = append(*m.etags, etag)
+	}
+	if m.mockObjectError != nil {
+		return nil, m.mockObjectError
+	}
+	if etag == "\"mock\"" {
+		return &Object{Header: m.notModifiedHeader}, ErrNotModified
+	}
+	return &Object{
+		Content: m.mockObjectContent,
+		Header: http.Header{
+			"Content-Type":           []string{"application/json"},
+			"X-Object-Meta-Build-Id": []string{"42"},
+			"Etag":                   []string{"\"mock\""},
+			"X-Object-Version":       []string{"1"},
+		},
+	}, nil
+}
+
+func (m MockObjectClient) GetBatch(entries []BatchEntry) (*BatchStream, error) {
+	if m.batches != nil {
+		*m.batches = append(*m.batches, entries)
+	}
+	if m.mockObjectError != nil {
+		return nil, m.mockObjectError
+	}
+	manifest := BatchManifest{}
+	for _, entry := range entries {
+		member := BatchMember{Category: entry.Category, Object: entry.Object, Version: entry.Version, ContentType: "application/json",
+			Metadata: map[string]string{"build-id": "42"}}
+		if len(member.Version) == 0 {
+			member.Version, member.Channel = "1", "prod"
+		}
+		member.Path = entry.Category + "/" + entry.Object + "/" + member.Version
+		member.Size = int64(len(entry.Object) + 1 + len(m.mockObjectContent))
+		manifest.Objects = append(manifest.Objects, member)
+	}
+	archive := &bytes.Buffer{}
+	writer := tar.NewWriter(archive)
+	content, _ := json.Marshal(manifest)
+	writer.WriteHeader(&tar.Header{Name: batchManifestName, Mode: 0644, Size: int64(len(content))})
+	writer.Write(content)
+	for _, member := range manifest.Objects {
+		writer.WriteHeader(&tar.Header{Name: member.Path, Mode: 0644, Size: member.Size})
+		writer.Write(append([]byte(member.Object+" "), m.mockObjectContent...))
+	}
+	writer.Close()
+	return newBatchStream(ioutil.NopCloser(archive), len(entries))
 }
 
 func NewMockAPI(mockObjectContent []byte, mockObjectError error) *API {
@@ -56,52 +116,178 @@ func TestMakeKey(t *testing.T) {
 	objectversion := "123abc"
 
 	expectedRes := fmt.Sprintf("%s/%s", objectname, objectversion)
-	actualRes := makeKey(objectname, objectversion, false)
+	actualRes := makeKey(objectname, objectversion, "", "")
 	if expectedRes != actualRes {
 		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
 	}
 
 	expectedRes = objectname
-	actualRes = makeKey(objectname, "", false)
+	actualRes = makeKey(objectname, "", "", "")
+	if expectedRes != actualRes {
+		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
+	}
+
+	actualRes = makeKey(objectname, "", "prod", "")
 	if expectedRes != actualRes {
 		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
 	}
 
-	expectedRes = fmt.Sprintf("%s/dev", objectname)
-	actualRes = makeKey(objectname, "", true)
+	expectedRes = fmt.Sprintf("%s?channel=dev", objectname)
+	actualRes = makeKey(objectname, "", "dev", "")
+	if expectedRes != actualRes {
+		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
+	}
+
+	expectedRes = fmt.Sprintf("%s?channel=staging", objectname)
+	actualRes = makeKey(objectname, "", "staging", "")
+	if expectedRes != actualRes {
+		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
+	}
+	// versions win over channels
+	expectedRes = fmt.Sprintf("%s/%s", objectname, objectversion)
+	actualRes = makeKey(objectname, objectversion, "staging", "")
+	if expectedRes != actualRes {
+		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
+	}
+	// constraints are cached apart from the channel defaults
+	expectedRes = fmt.Sprintf("%s?constraint=%s", objectname, "%5E2.3")
+	actualRes = makeKey(objectname, "", "", "^2.3")
 	if expectedRes != actualRes {
 		t.Fatalf("makeKey should match expected output. Expected: %s, Actual: %s", expectedRes, actualRes)
 	}
+}
+
+func TestObjectServiceClientGetObject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == "\"abc\"" {
+			res.Header().Set("X-Object-Version", "2")
+			res.WriteHeader(http.StatusNotModified)
+			return
+		}
+		res.Header().Set("ETag", "\"abc\"")
+		res.Header().Set("Content-Type", "application/x-protobuf")
+		res.Header().Set("Content-Encoding", "gzip")
+		res.Header().Set("X-Object-Meta-Build-Id", "42")
+		res.Header().Set("X-Unrelated", "nope")
+		res.Write([]byte("proto bytes"))
+	}))
+	defer server.Close()
+
+	client := NewObjectServiceClient(server.URL + "/")
+	object, err := client.GetObject("foo/bar.proto", "1", "", "", "")
+	if err != nil {
+		t.Fatalf("ObjectServiceClient.GetObject returned an error: %v", err)
+	}
+	if string(object.Content) != "proto bytes" {
+		t.Fatalf("ObjectServiceClient.GetObject returned the wrong content: %s", string(object.Content))
+	}
+	if object.Header.Get("Content-Type") != "application/x-protobuf" || object.Header.Get("Content-Encoding") != "gzip" || object.Header.Get("X-Object-Meta-Build-Id") != "42" {
+		t.Fatalf("ObjectServiceClient.GetObject should keep the object headers. Headers: %v", object.Header)
+	}
+	if len(object.Header.Get("X-Unrelated")) > 0 {
+		t.Fatalf("ObjectServiceClient.GetObject should only keep headers describing the object. Headers: %v", object.Header)
+	}
+
+	notModified, err := client.GetObject("foo/bar.proto", "1", "", "", object.Header.Get("ETag"))
+	if err != ErrNotModified {
+		t.Fatalf("ObjectServiceClient.GetObject should return ErrNotModified when the etag still matches. Returned: %v", err)
+	}
+	if notModified.Header.Get("X-Object-Version") != "2" {
+		t.Fatalf("ObjectServiceClient.GetObject should return the headers of the 304. Headers: %v", notModified.Header)
+	}
+}
 
+func TestObjectServiceClientChannels(t *testing.T) {
+	requested := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requested = append(requested, req.URL.String())
+		res.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	client := NewObjectServiceClient(server.URL + "/")
+	client.GetObject("foo/bar.proto", "", "staging", "", "")
+	client.GetObject("foo/bar.proto", "", "", "", "")
+	client.GetObject("foo/bar.proto", "1", "staging", "", "")
+	client.GetObject("foo/bar.proto", "", "staging", "^2.3", "")
+	// tags are part of the object name
+	client.GetObject("foo/bar.proto@lts", "", "", "", "")
+	expected := []string{"/foo/bar.proto?channel=staging", "/foo/bar.proto", "/foo/bar.proto/1", "/foo/bar.proto?constraint=%5E2.3", "/foo/bar.proto@lts"}
+	if fmt.Sprint(requested) != fmt.Sprint(expected) {
+		t.Fatalf("ObjectServiceClient.GetObject should request the channel or constraint of unversioned objects. Requested: %v", requested)
+	}
 }
 
 func TestResolveObject(t *testing.T) {
 	mockApi := NewMockAPI([]byte("whoopty doo"), nil)
-	res, err := mockApi.resolveObject("ok", "", false)
+	res, err := mockApi.resolveObject("ok", "", "", "")
 	// first one should not be cached.
 	if err != nil {
 		t.Fatalf("resolveObject returned an error: %s", err)
 	}
-	if string(res) != "whoopty doo" {
-		t.Fatalf("resolveObject did not return expected content: %s", string(res))
+	if string(res.Content) != "whoopty doo" {
+		t.Fatalf("resolveObject did not return expected content: %s", string(res.Content))
 	}
 	// second one should be cached
-	res, err = mockApi.resolveObject("ok", "", false)
+	res, err = mockApi.resolveObject("ok", "", "", "")
 	if err != nil {
 		t.Fatalf("resolveObject returned an error: %s", err)
 	}
-	if string(res) != "whoopty doo" {
-		t.Fatalf("resolveObject did not return expected content: %s", string(res))
+	if string(res.Content) != "whoopty doo" {
+		t.Fatalf("resolveObject did not return expected content: %s", string(res.Content))
 	}
 
 	// make it err
 	mockApi = NewMockAPI(nil, errors.New("unit test"))
-	res, err = mockApi.resolveObject("ok", "", false)
+	res, err = mockApi.resolveObject("ok", "", "", "")
 	if err.Error() != "unit test" {
 		t.Fatalf("resolveObject should return ObjectClient.GetObject error")
 	}
 }
 
+func TestResolveObjectRevalidates(t *testing.T) {
+	etags := []string{}
+	mockApi := NewMockAPI([]byte("whoopty doo"), nil)
+	mockApi.ObjectClient = MockObjectClient{mockObjectContent: []byte("whoopty doo"), etags: &etags}
+	cache := mockApi.Cache.(*ObjectCache)
+
+	mockApi.resolveObject("ok", "", "", "")
+	// expire the entry
+	cache.expiryObject["ok"] = time.Now().Add(-time.Second)
+	res, err := mockApi.resolveObject("ok", "", "", "")
+	if err != nil || string(res.Content) != "whoopty doo" {
+		t.Fatalf("resolveObject should return the cached object when it is not modified. Object: %v, Error: %v", res, err)
+	}
+	if len(etags) != 2 || etags[0] != "" || etags[1] != "\"mock\"" {
+		t.Fatalf("resolveObject should revalidate expired objects with their etag. Requests: %v", etags)
+	}
+	if _, fresh, _ := cache.Lookup("ok"); !fresh {
+		t.Fatalf("resolveObject should restart the expiry of revalidated objects")
+	}
+	mockApi.resolveObject("ok", "", "", "")
+	if len(etags) != 2 {
+		t.Fatalf("resolveObject should not revalidate fresh objects. Requests: %v", etags)
+	}
+
+	// the default can move to another version with the same content
+	mockApi.ObjectClient = MockObjectClient{notModifiedHeader: http.Header{
+		"X-Object-Version":       []string{"2"},
+		"Last-Modified":          []string{"Mon, 01 Oct 2018 12:00:00 GMT"},
+		"X-Object-Meta-Build-Id": []string{"43"},
+	}}
+	cache.expiryObject["ok"] = time.Now().Add(-time.Second)
+	res, _ = mockApi.resolveObject("ok", "", "", "")
+	if res.Header.Get("X-Object-Version") != "2" || len(res.Header.Get("Last-Modified")) == 0 || res.Header.Get("X-Object-Meta-Build-Id") != "43" {
+		t.Fatalf("resolveObject should update the cached object with the headers of the 304. Headers: %v", res.Header)
+	}
+	if string(res.Content) != "whoopty doo" || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("resolveObject should keep the cached content and the headers the 304 left out. Object: %v", res)
+	}
+	if cached, _, _ := cache.Lookup("ok"); cached.(*Object).Header.Get("X-Object-Version") != "2" {
+		t.Fatalf("resolveObject should cache the updated headers")
+	}
+}
+
 func TestAPIGetObject(t *testing.T) {
 	req := makeRequest("foo", "bar.jar", "", false)
 	res := httptest.NewRecorder()
@@ -112,6 +298,22 @@ func TestAPIGetObject(t *testing.T) {
 	if string(objectContent) != "super object" {
 		t.Fatalf("objectContent should be 'super object'. Was: %s", string(objectContent))
 	}
+	if res.Header().Get("Content-Type") != "application/json" || res.Header().Get("X-Object-Meta-Build-Id") != "42" {
+		t.Fatalf("GetObject should return the object service content type and metadata. Headers: %v", res.Header())
+	}
+
+	if res.Header().Get("X-Object-Version") != "1" {
+		t.Fatalf("GetObject should return the version served. Headers: %v", res.Header())
+	}
+
+	// conditional requests are answered from the cache
+	conditionalReq := makeRequest("foo", "bar.jar", "", false)
+	conditionalReq.Header.Set("If-None-Match", res.Header().Get("ETag"))
+	conditionalRes := httptest.NewRecorder()
+	happyApi.GetObject(conditionalRes, conditionalReq)
+	if conditionalRes.Code != http.StatusNotModified {
+		t.Fatalf("GetObject should return 304 when If-None-Match matches. Status code: %d", conditionalRes.Code)
+	}
 
 	errorRes := httptest.NewRecorder()
 	errorApi := NewMockAPI(nil, errors.New("unit test"))
@@ -122,3 +324,117 @@ func TestAPIGetObject(t *testing.T) {
 		t.Fatalf("GetObject error message should be 'unit test'. Is: %s", response.Error)
 	}
 }
+
+func TestObjectServiceClientGetBatch(t *testing.T) {
+	var requested []BatchEntry
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/batch" {
+			t.Fatalf("ObjectServiceClient.GetBatch should POST /batch. Requested: %s %s", req.Method, req.URL.Path)
+		}
+		json.NewDecoder(req.Body).Decode(&requested)
+		manifest, _ := json.Marshal(BatchManifest{Objects: []BatchMember{
+			{Category: "foo", Object: "bar.proto", Channel: "prod", Version: "2", Path: "foo/bar.proto/2", Size: 11, ContentType: "application/x-protobuf",
+				Checksum: "0a0b", Metadata: map[string]string{"build-id": "42"}},
+			{Category: "foo", Object: "bar.proto", Version: "2", Path: "foo/bar.proto/2", Size: 11, ContentType: "application/x-protobuf"},
+		}})
+		archive := tar.NewWriter(res)
+		for _, file := range []struct{ name, content string }{{batchManifestName, string(manifest)}, {"foo/bar.proto/2", "proto bytes"}} {
+			archive.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content))})
+			archive.Write([]byte(file.content))
+		}
+		archive.Close()
+	}))
+	defer server.Close()
+
+	client := NewObjectServiceClient(server.URL + "/")
+	entries := []BatchEntry{{Category: "foo", Object: "bar.proto"}, {Category: "foo", Object: "bar.proto", Version: "2"}}
+	stream, err := client.GetBatch(entries)
+	if err != nil {
+		t.Fatalf("ObjectServiceClient.GetBatch returned an error: %v", err)
+	}
+	defer stream.Close()
+	if fmt.Sprint(requested) != fmt.Sprint(entries) || len(stream.Manifest.Objects) != 2 {
+		t.Fatalf("ObjectServiceClient.GetBatch should request and describe each entry. Requested: %v, Manifest: %+v", requested, stream.Manifest)
+	}
+	path, size, content, err := stream.Next()
+	if body, _ := ioutil.ReadAll(content); err != nil || path != "foo/bar.proto/2" || size != 11 || string(body) != "proto bytes" {
+		t.Fatalf("ObjectServiceClient.GetBatch should stream the content of each object. Path: %s, Content: %s, Error: %v", path, string(body), err)
+	}
+	if _, _, _, err := stream.Next(); err != io.EOF {
+		t.Fatalf("The batch should end after the last object. Error: %v", err)
+	}
+	if client.batchClient.Timeout != 0 {
+		t.Fatalf("Batches should be read for as long as they take. Timeout: %s", client.batchClient.Timeout)
+	}
+}
+
+func TestMemberHeader(t *testing.T) {
+	header := memberHeader(BatchMember{Version: "2", ContentType: "application/x-protobuf", Checksum: "0a0b", Metadata: map[string]string{"build-id": "42"}})
+	if header.Get("X-Object-Version") != "2" || header.Get("Content-Type") != "application/x-protobuf" || header.Get("ETag") != "\"0a0b\"" ||
+		header.Get("Digest") != "SHA-256=Cgs=" || header.Get("X-Object-Meta-Build-Id") != "42" {
+		t.Fatalf("Batch members should be described with the headers of the object service. Headers: %v", header)
+	}
+}
+
+func TestAPIGetBatch(t *testing.T) {
+	batches := [][]BatchEntry{}
+	api := NewMockAPI([]byte("content"), nil)
+	api.ObjectClient = MockObjectClient{mockObjectContent: []byte("content"), batches: &batches}
+	// bar.jar is cached already, as a single object would be
+	api.resolveObject("foo/bar.jar", "", "", "")
+	getBatch := func(accept string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(body))
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		api.GetBatch(res, req)
+		return res
+	}
+
+	batch := `[{"category": "foo", "object": "bar.jar"}, {"category": "foo", "object": "baz.jar", "version": "3"}]`
+	res := getBatch("", batch)
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("GetBatch should return a tar archive. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	files := map[string]string{}
+	reader := tar.NewReader(res.Body)
+	for header, err := reader.Next(); err == nil; header, err = reader.Next() {
+		content, _ := ioutil.ReadAll(reader)
+		files[header.Name] = string(content)
+	}
+	manifest := &BatchManifest{}
+	json.Unmarshal([]byte(files[batchManifestName]), manifest)
+	if len(manifest.Objects) != 2 || manifest.Objects[0].Channel != "prod" || manifest.Objects[0].Path != "foo/bar.jar/1" ||
+		manifest.Objects[1].Path != "foo/baz.jar/3" || manifest.Objects[1].Metadata["build-id"] != "42" {
+		t.Fatalf("GetBatch should start with a manifest of each object. Manifest: %s", files[batchManifestName])
+	}
+	if files["foo/bar.jar/1"] != "content" || files["foo/baz.jar/3"] != "baz.jar content" {
+		t.Fatalf("GetBatch should serve cached objects locally and fetch the rest. Files: %v", files)
+	}
+	if len(batches) != 1 || fmt.Sprint(batches[0]) != fmt.Sprint([]BatchEntry{{Category: "foo", Object: "baz.jar", Version: "3"}}) {
+		t.Fatalf("GetBatch should only fetch the objects not in the cache. Fetched: %v", batches)
+	}
+	if object, fresh, ok := api.Cache.Lookup("foo/baz.jar/3"); !ok || !fresh || string(object.(*Object).Content) != "baz.jar content" || object.(*Object).Header.Get("X-Object-Version") != "3" {
+		t.Fatalf("GetBatch should cache the objects it fetched. Cached: %v", object)
+	}
+
+	res = getBatch("application/zip", batch)
+	zipReader, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	if res.Header().Get("Content-Type") != "application/zip" || err != nil || len(zipReader.File) != 3 {
+		t.Fatalf("GetBatch should return a zip archive when it is accepted. Headers: %v, Error: %v", res.Header(), err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("GetBatch should serve a batch cached entirely locally. Fetched: %v", batches)
+	}
+
+	if res := getBatch("", "[]"); res.Code != http.StatusBadRequest {
+		t.Fatalf("GetBatch should return 400 for an empty batch. Status code: %d", res.Code)
+	}
+	errorApi := NewMockAPI(nil, errors.New("unit test"))
+	errorRes := httptest.NewRecorder()
+	errorApi.GetBatch(errorRes, httptest.NewRequest("POST", "/batch", strings.NewReader(batch)))
+	response := &JSONResponse{}
+	json.Unmarshal(errorRes.Body.Bytes(), response)
+	if errorRes.Code != http.StatusInternalServerError || response.Error != "unit test" {
+		t.Fatalf("GetBatch should return the object service error. Status code: %d, Body: %s", errorRes.Code, errorRes.Body.String())
+	}
+}
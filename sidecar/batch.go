@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBatchSize the most objects a batch can request, as limited by the object service
+const maxBatchSize = 100
+
+// batchManifestName the name of the manifest in batch archives, written before the objects
+const batchManifestName = "manifest.json"
+
+// BatchEntry an object requested in a batch, by version or by the default version of a channel (prod if neither is given)
+type BatchEntry struct {
+	Category string `json:"category"`
+	Object   string `json:"object"`
+	Version  string `json:"version,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+}
+
+// BatchMember an object of a batch as it was resolved, as described in the manifest of the object service
+type BatchMember struct {
+	Category        string            `json:"category"`
+	Object          string            `json:"object"`
+	Channel         string            `json:"channel,omitempty"`
+	Version         string            `json:"version"`
+	Path            string            `json:"path"`
+	Size            int64             `json:"size"`
+	LastModified    time.Time         `json:"lastModified"`
+	Checksum        string            `json:"checksum,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// BatchManifest describes the objects of a batch archive, in the order they were requested
+type BatchManifest struct {
+	Objects []BatchMember `json:"objects"`
+}
+
+// memberHeader the headers the object service would have returned for member, so objects fetched
+// in a batch are cached the same as objects fetched one at a time
+func memberHeader(member BatchMember) http.Header {
+	header := make(http.Header)
+	header.Set("X-Object-Version", member.Version)
+	header.Set("Content-Type", "application/octet-stream")
+	if len(member.ContentType) > 0 {
+		header.Set("Content-Type", member.ContentType)
+	}
+	if len(member.ContentEncoding) > 0 {
+		header.Set("Content-Encoding", member.ContentEncoding)
+	}
+	header.Set("Last-Modified", member.LastModified.UTC().Format(http.TimeFormat))
+	header.Set("ETag", fmt.Sprintf("\"version-%x\"", member.Version))
+	if sum, err := hex.DecodeString(member.Checksum); err == nil && len(sum) > 0 {
+		header.Set("ETag", fmt.Sprintf("\"%s\"", member.Checksum))
+		header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+	for name, value := range member.Metadata {
+		header.Set(userMetadataPrefix+name, value)
+	}
+	return header
+}
+
+// batchMember describes a cached object in a batch manifest
+func batchMember(entry BatchEntry, object *Object) BatchMember {
+	member := BatchMember{
+		Category:        entry.Category,
+		Object:          entry.Object,
+		Version:         object.Header.Get("X-Object-Version"),
+		Size:            int64(len(object.Content)),
+		ContentType:     object.Header.Get("Content-Type"),
+		ContentEncoding: object.Header.Get("Content-Encoding"),
+	}
+	if len(entry.Version) == 0 {
+		member.Channel = entry.Channel
+		if len(member.Channel) == 0 {
+			member.Channel = "prod"
+		}
+	}
+	member.Path = fmt.Sprintf("%s/%s/%s", entry.Category, entry.Object, member.Version)
+	member.LastModified, _ = http.ParseTime(object.Header.Get("Last-Modified"))
+	digest := object.Header.Get("Digest")
+	if strings.HasPrefix(digest, "SHA-256=") {
+		if sum, err := base64.StdEncoding.DecodeString(digest[len("SHA-256="):]); err == nil {
+			member.Checksum = hex.EncodeToString(sum)
+		}
+	}
+	for name, values := range object.Header {
+		if strings.HasPrefix(name, userMetadataPrefix) && len(name) > len(userMetadataPrefix) {
+			if member.Metadata == nil {
+				member.Metadata = map[string]string{}
+			}
+			member.Metadata[strings.ToLower(name[len(userMetadataPrefix):])] = values[0]
+		}
+	}
+	return member
+}
+
+// BatchStream a batch being read from the object service: the manifest describing its objects, followed by
+// the content of each object as it arrives
+type BatchStream struct {
+	Manifest *BatchManifest
+	reader   *tar.Reader
+	body     io.ReadCloser
+}
+
+// newBatchStream reads the manifest of the batch archive body, requested with entries entries
+func newBatchStream(body io.ReadCloser, entries int) (*BatchStream, error) {
+	stream := &BatchStream{Manifest: &BatchManifest{}, reader: tar.NewReader(body), body: body}
+	header, err := stream.reader.Next()
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("Unable to read batch from the object service. %s", err.Error())
+	} else if header.Name != batchManifestName {
+		body.Close()
+		return nil, fmt.Errorf("The batch from the object service does not start with a manifest. Got: %s", header.Name)
+	}
+	if err := json.NewDecoder(stream.reader).Decode(stream.Manifest); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("Unable to read batch manifest. %s", err.Error())
+	}
+	if len(stream.Manifest.Objects) != entries {
+		body.Close()
+		return nil, fmt.Errorf("The object service returned %d objects for a batch of %d", len(stream.Manifest.Objects), entries)
+	}
+	return stream, nil
+}
+
+// Next returns the path, size and content of the next object of the batch. The content can only be read
+// until Next is called again. io.EOF is returned after the last object
+func (b *BatchStream) Next() (string, int64, io.Reader, error) {
+	header, err := b.reader.Next()
+	if err == io.EOF {
+		return "", 0, nil, err
+	} else if err != nil {
+		return "", 0, nil, fmt.Errorf("Unable to read batch from the object service. %s", err.Error())
+	}
+	return header.Name, header.Size, b.reader, nil
+}
+
+// Close closes the response the batch is read from
+func (b *BatchStream) Close() error {
+	return b.body.Close()
+}
+
+// GetBatch requests the objects of entries from the object service in a single batch, returning the batch once
+// its manifest is read so the objects can be streamed as they arrive. Batches are read with the batch client,
+// which does not limit how long reading a batch takes
+func (o ObjectServiceClient) GetBatch(entries []BatchEntry) (*BatchStream, error) {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", o.ObjectServiceURL+"batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-tar")
+	res, err := o.batchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+
+		errMsg := &JSONResponse{}
+		json.Unmarshal(body, errMsg)
+		return nil, errors.New(errMsg.Error)
+	}
+	return newBatchStream(res.Body, len(entries))
+}
+
+// cachedBatch looks the objects of entries up in the cache, returning nil for the objects that are not cached
+// or expired. Unlike single objects, expired objects are fetched again rather than revalidated
+func (a API) cachedBatch(entries []BatchEntry) []*Object {
+	objects := make([]*Object, len(entries))
+	for i, entry := range entries {
+		cacheKey := makeKey(entry.Category+"/"+entry.Object, entry.Version, entry.Channel, "")
+		if objectIface, fresh, exists := a.Cache.Lookup(cacheKey); exists && fresh {
+			objects[i] = objectIface.(*Object)
+		}
+	}
+	return objects
+}
+
+// streamBatch writes the objects of stream to archive as they arrive, skipping the paths in written, and caches
+// each of them under the entries of fetched that resolved to it. Each object is held in memory once to be cached
+func (a API) streamBatch(archive batchArchive, stream *BatchStream, fetched []BatchEntry, written map[string]bool) error {
+	received := map[string]bool{}
+	for {
+		path, size, content, err := stream.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		received[path] = true
+		cached := &bytes.Buffer{}
+		content = io.TeeReader(content, cached)
+		if written[path] {
+			_, err = io.Copy(ioutil.Discard, content)
+		} else {
+			written[path] = true
+			modified := time.Time{}
+			for _, member := range stream.Manifest.Objects {
+				if member.Path == path {
+					modified = member.LastModified
+				}
+			}
+			err = archive.add(path, content, size, modified)
+		}
+		if err != nil {
+			return err
+		}
+		for i, member := range stream.Manifest.Objects {
+			if member.Path == path {
+				entry := fetched[i]
+				a.Cache.Add(makeKey(entry.Category+"/"+entry.Object, entry.Version, entry.Channel, ""), &Object{Content: cached.Bytes(), Header: memberHeader(member)})
+			}
+		}
+	}
+	for _, member := range stream.Manifest.Objects {
+		if !received[member.Path] {
+			return fmt.Errorf("The batch from the object service is missing %s", member.Path)
+		}
+	}
+	return nil
+}
+
+// batchArchive writes the files of a batch archive
+type batchArchive interface {
+	add(name string, content io.Reader, size int64, modified time.Time) error
+	Close() error
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) add(name string, content io.Reader, size int64, modified time.Time) error {
+	err := t.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t, content)
+	return err
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) add(name string, content io.Reader, size int64, modified time.Time) error {
+	writer, err := z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, content)
+	return err
+}
+
+// GetBatch serves a batch of objects as a tar archive, or a zip archive with an Accept header of application/zip,
+// the same as the object service. Cached objects are served locally, the others are fetched in a single batch
+// and streamed to the client as they arrive from the object service
+func (a API) GetBatch(res http.ResponseWriter, req *http.Request) {
+	entries := []BatchEntry{}
+	objects := []*Object{}
+	fetched := []BatchEntry{}
+	var stream *BatchStream
+	status := http.StatusBadRequest
+	err := json.NewDecoder(req.Body).Decode(&entries)
+	if err != nil {
+		err = fmt.Errorf("Invalid batch. %s", err.Error())
+	} else if len(entries) == 0 || len(entries) > maxBatchSize {
+		err = fmt.Errorf("A batch must request from 1 to %d objects", maxBatchSize)
+	} else {
+		objects = a.cachedBatch(entries)
+		for i, entry := range entries {
+			if objects[i] == nil {
+				fetched = append(fetched, entry)
+			}
+		}
+		if len(fetched) > 0 {
+			status = http.StatusInternalServerError
+			stream, err = a.ObjectClient.GetBatch(fetched)
+		}
+	}
+	if err != nil {
+		responseBody, _ := json.Marshal(JSONResponse{
+			Status: "error",
+			Error:  err.Error(),
+		})
+		res.WriteHeader(status)
+		res.Write(responseBody)
+		return
+	}
+	if stream != nil {
+		defer stream.Close()
+	}
+
+	// the fetched objects are described by the manifest of the object service, in the order they were requested
+	manifest := &BatchManifest{}
+	next := 0
+	for i, entry := range entries {
+		if objects[i] != nil {
+			manifest.Objects = append(manifest.Objects, batchMember(entry, objects[i]))
+		} else {
+			manifest.Objects = append(manifest.Objects, stream.Manifest.Objects[next])
+			next++
+		}
+	}
+	var archive batchArchive = tarArchive{tar.NewWriter(res)}
+	res.Header().Set("Content-Type", "application/x-tar")
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == "application/zip" {
+			archive = zipArchive{zip.NewWriter(res)}
+			res.Header().Set("Content-Type", "application/zip")
+			break
+		}
+	}
+	res.WriteHeader(http.StatusOK)
+
+	content, _ := json.MarshalIndent(manifest, "", "  ")
+	err = archive.add(batchManifestName, bytes.NewReader(content), int64(len(content)), time.Now().UTC())
+	written := map[string]bool{}
+	for i, member := range manifest.Objects {
+		if err != nil {
+			break
+		}
+		if objects[i] != nil && !written[member.Path] {
+			written[member.Path] = true
+			err = archive.add(member.Path, bytes.NewReader(objects[i].Content), member.Size, member.LastModified)
+		}
+	}
+	if err == nil && stream != nil {
+		err = a.streamBatch(archive, stream, fetched, written)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		log.Printf("Unable to stream batch. %s", err.Error())
+	}
+}
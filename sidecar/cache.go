@@ -9,6 +9,7 @@ import (
 type Cache interface {
 	Add(key string, value interface{})
 	Get(key string) (interface{}, bool)
+	Lookup(key string) (value interface{}, fresh bool, ok bool)
 }
 
 // ObjectCache implements an LRU cache with per-item expiration
@@ -48,3 +49,15 @@ func (c *ObjectCache) Get(key string) (interface{}, bool) {
 		return nil, false
 	}
 }
+
+// Lookup returns an item if it exists in the cache, along with whether it has not yet expired.
+// Unlike Get expired items are kept, so they can be revalidated instead of fetched again
+func (c *ObjectCache) Lookup(key string) (interface{}, bool, bool) {
+	val, ok := c.cache.Get(key)
+	if !ok {
+		delete(c.expiryObject, key)
+		return nil, false, false
+	}
+	expiryTime, timeOk := c.expiryObject[key]
+	return val, timeOk && time.Now().Before(expiryTime), true
+}
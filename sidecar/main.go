@@ -43,11 +43,12 @@ func main() {
 
 	api := NewAPI(cacheSize, cacheExpirySeconds, objectServiceURL)
 
+	// large objects and batches are written for as long as they take, only the headers and idle connections time out
 	srv := &http.Server{
-		Handler:      api.Router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		Addr:         ":80",
+		Handler:           api.Router,
+		ReadHeaderTimeout: 15 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		Addr:              ":80",
 	}
 
 	log.Fatal(srv.ListenAndServe())
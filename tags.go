@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// tagPattern valid tag names, e.g. lts, approved-by-qa or release-2024.10
+var tagPattern = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$")
+
+// checkTag returns a bad request error if tag is not a valid tag name
+func checkTag(tag string) error {
+	if !tagPattern.MatchString(tag) {
+		return RequestError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("Invalid tag %q. Tags are letters, numbers, ., - and _", tag),
+		}
+	}
+	return nil
+}
+
+// GetObjectTags returns the versions the tags of objectName point at, keyed by tag
+func (o ObjectController) GetObjectTags(objectName string) (map[string]string, error) {
+	tags, err := o.versions.GetTags(objectName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read object %s tags from the version store. %s", objectName, err.Error())
+	}
+	return tags, nil
+}
+
+// ResolveObjectTag returns the version tag of objectName points at, or a 404 RequestError if it is not set
+func (o ObjectController) ResolveObjectTag(objectName string, tag string) (string, error) {
+	if err := checkTag(tag); err != nil {
+		return "", err
+	}
+	tags, err := o.GetObjectTags(objectName)
+	if err != nil {
+		return "", err
+	}
+	version, ok := tags[tag]
+	if !ok {
+		return "", RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s has no tag %s", objectName, tag),
+		}
+	}
+	return version, nil
+}
+
+// SetObjectTag points tag of objectName at version, which must exist. the change is recorded in the history
+func (o ObjectController) SetObjectTag(objectName string, tag string, version string, requester string) error {
+	if err := checkTag(tag); err != nil {
+		return err
+	}
+	if err := o.checkVersionAvailable(objectName, version); err != nil {
+		return err
+	}
+	previous, err := o.versions.SetTag(objectName, tag, version)
+	if err != nil {
+		return fmt.Errorf("Unable to set object %s tag %s in the version store. %s", objectName, tag, err.Error())
+	}
+	return o.versions.AppendHistory(objectName, []VersionChange{
+		{Time: time.Now().UTC(), Action: ActionTagged, Tag: tag, Previous: previous, Version: version, Requester: requester},
+	})
+}
+
+// DeleteObjectTag removes tag of objectName, returning a 404 RequestError if it is not set
+func (o ObjectController) DeleteObjectTag(objectName string, tag string, requester string) error {
+	if err := checkTag(tag); err != nil {
+		return err
+	}
+	previous, err := o.versions.DeleteTag(objectName, tag)
+	if err == ErrTagNotFound {
+		return RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s has no tag %s", objectName, tag),
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to delete object %s tag %s from the version store. %s", objectName, tag, err.Error())
+	}
+	return o.versions.AppendHistory(objectName, []VersionChange{
+		{Time: time.Now().UTC(), Action: ActionUntagged, Tag: tag, Previous: previous, Requester: requester},
+	})
+}
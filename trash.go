@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// trashCategory the category deleted versions are moved under. It is hidden from the category listing
+const trashCategory = ".trash"
+
+// DefaultTrashGracePeriod how long deleted versions can be restored by default
+const DefaultTrashGracePeriod = 7 * 24 * time.Hour
+
+// trashPurgeInterval how often versions past the grace period are purged from the trash
+const trashPurgeInterval = time.Hour
+
+// TrashEntry a deleted version waiting in the trash to be purged
+type TrashEntry struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Deleted   time.Time `json:"deleted"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+	// PurgeAfter when the version stops being restorable
+	PurgeAfter time.Time `json:"purgeAfter"`
+}
+
+// gracePeriod how long deleted versions can be restored
+func (o ObjectController) gracePeriod() time.Duration {
+	if o.trashGracePeriod <= 0 {
+		return DefaultTrashGracePeriod
+	}
+	return o.trashGracePeriod
+}
+
+// trashKey the key the content of version of objectName is kept at while it is in the trash
+func (o ObjectController) trashKey(objectName string, version string) string {
+	return o.getObjectKey(trashCategory+"/"+objectName, version)
+}
+
+// trashVersion marks version of objectName as deleted, so it is no longer served, and moves its content to the trash
+func (o ObjectController) trashVersion(objectName string, version string, requester string) error {
+	info, err := o.versions.GetVersionInfo(objectName, version)
+	if err != nil {
+		return fmt.Errorf("Unable to read object %s version %s info from the version store. %s", objectName, version, err.Error())
+	}
+	if info == nil {
+		// versions added before their info was recorded
+		info = &VersionInfo{}
+	}
+	info.State = VersionDeleted
+	info.Deleted = time.Now().UTC()
+	info.DeletedBy = requester
+	if err := o.versions.PutVersionInfo(objectName, version, info); err != nil {
+		return fmt.Errorf("Unable to mark object %s version %s deleted in the version store. %s", objectName, version, err.Error())
+	}
+	if err := o.unindexVersion(objectName, version); err != nil {
+		return err
+	}
+	if err := o.blobs.Move(o.getObjectKey(objectName, version), o.trashKey(objectName, version)); err != nil && err != ErrBlobNotFound {
+		return fmt.Errorf("Unable to move object %s version %s to the trash. %s", objectName, version, err.Error())
+	}
+	return nil
+}
+
+// RestoreObjectVersion moves a deleted version of objectName back out of the trash. The restore is recorded
+// in the object history. Restoring a version does not make it a default again
+func (o ObjectController) RestoreObjectVersion(objectName string, version string, requester string) error {
+	info, err := o.versions.GetVersionInfo(objectName, version)
+	if err != nil {
+		return fmt.Errorf("Unable to read object %s version %s info from the version store. %s", objectName, version, err.Error())
+	}
+	if info == nil || !info.Trashed() {
+		return RequestError{
+			StatusCode: http.StatusNotFound,
+			Message:    fmt.Sprintf("Object %s version %s is not in the trash", objectName, version),
+		}
+	}
+	// the content is still in place if moving it to the trash did not complete
+	err = o.blobs.Move(o.trashKey(objectName, version), o.getObjectKey(objectName, version))
+	if err == ErrBlobNotFound {
+		if exists, _ := o.checkVersionExists(objectName, version); !exists {
+			return RequestError{
+				StatusCode: http.StatusNotFound,
+				Message:    fmt.Sprintf("Object %s version %s content is no longer in the trash", objectName, version),
+			}
+		}
+	} else if err != nil {
+		return fmt.Errorf("Unable to move object %s version %s out of the trash. %s", objectName, version, err.Error())
+	}
+	info.State = VersionReady
+	info.Deleted = time.Time{}
+	info.DeletedBy = ""
+	if err := o.versions.PutVersionInfo(objectName, version, info); err != nil {
+		return fmt.Errorf("Unable to mark object %s version %s restored in the version store. %s", objectName, version, err.Error())
+	}
+	if err := o.indexVersion(objectName, version); err != nil {
+		return err
+	}
+	return o.versions.AppendHistory(objectName, []VersionChange{
+		{Time: time.Now().UTC(), Action: ActionRestored, Version: version, Requester: requester},
+	})
+}
+
+// ListTrash returns the deleted versions waiting to be purged
+func (o ObjectController) ListTrash() ([]TrashEntry, error) {
+	// the trash holds category/object/version like the store itself
+	trashed := []TrashEntry{}
+	categories, err := listAll(func(token string) (*ListResponse, error) {
+		return o.listBlobObjects(trashCategory, token)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list the trash. %s", err.Error())
+	}
+	for _, category := range categories {
+		objects, err := listAll(func(token string) (*ListResponse, error) {
+			return o.listBlobObjects(trashCategory+"/"+category, token)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list the trash. %s", err.Error())
+		}
+		for _, object := range objects {
+			versions, err := listAll(func(token string) (*ListResponse, error) {
+				return o.listBlobVersions(trashCategory+"/"+category, object, token)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Unable to list the trash. %s", err.Error())
+			}
+			for _, version := range versions {
+				trashed = append(trashed, TrashEntry{Name: category + "/" + object, Version: version})
+			}
+		}
+	}
+	entries := []TrashEntry{}
+	for _, entry := range trashed {
+		info, err := o.versions.GetVersionInfo(entry.Name, entry.Version)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			entry.Deleted = info.Deleted
+			entry.DeletedBy = info.DeletedBy
+		}
+		// fall back to when the content was moved to the trash
+		if entry.Deleted.IsZero() {
+			blob, err := o.blobs.Head(o.trashKey(entry.Name, entry.Version))
+			if err == ErrBlobNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			entry.Deleted = blob.LastModified
+		}
+		entry.PurgeAfter = entry.Deleted.Add(o.gracePeriod())
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// PurgeTrash removes the versions that were deleted longer than the grace period ago for good.
+// With dryRun set nothing is removed. returns the category/object/version of each (would be) purged version
+func (o ObjectController) PurgeTrash(dryRun bool) ([]string, error) {
+	entries, err := o.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.PurgeAfter.After(now) {
+			continue
+		}
+		if !dryRun {
+			if err := o.blobs.Delete(o.trashKey(entry.Name, entry.Version)); err != nil && err != ErrBlobNotFound {
+				return purged, fmt.Errorf("Unable to purge object %s version %s from the trash. %s", entry.Name, entry.Version, err.Error())
+			}
+			if err := o.versions.DeleteVersionInfo(entry.Name, entry.Version); err != nil {
+				return purged, fmt.Errorf("Unable to delete object %s version %s info from the version store. %s", entry.Name, entry.Version, err.Error())
+			}
+			err := o.versions.AppendHistory(entry.Name, []VersionChange{
+				{Time: time.Now().UTC(), Action: ActionPurged, Version: entry.Version, Requester: retentionRequester},
+			})
+			if err != nil {
+				return purged, fmt.Errorf("Unable to record object %s version %s purge in the history. %s", entry.Name, entry.Version, err.Error())
+			}
+		}
+		purged = append(purged, entry.Name+"/"+entry.Version)
+	}
+	return purged, nil
+}
+
+// purgeTrashEvery runs PurgeTrash every interval, logging what is purged
+func (o ObjectController) purgeTrashEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		purged, err := o.PurgeTrash(false)
+		for _, version := range purged {
+			log.Printf("Trash: purged %s", version)
+		}
+		if err != nil {
+			log.Printf("Trash: purge failed. %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	blobs, cleanupBlobs := newTestFileStore(t)
+	defer cleanupBlobs()
+	versions, cleanupVersions := newTestBoltStore(t)
+	defer cleanupVersions()
+	api := NewAPI(NewObjectController(blobs, versions, "dang"))
+	objects := api.Objects
+	for _, version := range []string{"1", "2"} {
+		objects.AddObject("maps/de_dust.map", strings.NewReader("content "+version), nil, nil, false, false, version)
+	}
+
+	if err := objects.DeleteObjectVersion("maps/de_dust.map", "2", false, "alice"); err != nil {
+		t.Fatalf("DeleteObjectVersion returned an error: %v", err)
+	}
+	if _, err := objects.GetObject("maps/de_dust.map", "2", ""); err == nil {
+		t.Fatalf("GetObject should not return deleted versions")
+	}
+	if list, _ := objects.ListObjectVersions("maps", "de_dust.map", ""); strings.Join(list.Objects, ",") != "1" {
+		t.Fatalf("ListObjectVersions should not return deleted versions. Returned: %v", list.Objects)
+	}
+	if list, _ := objects.ListCategories("", ListOptions{}); strings.Join(list.Objects, ",") != "maps" {
+		t.Fatalf("ListCategories should not return the trash. Returned: %v", list.Objects)
+	}
+	// deleted version names can not be reused until they are purged
+	if err := objects.AddObject("maps/de_dust.map", strings.NewReader("other content"), nil, nil, false, false, "2"); err == nil {
+		t.Fatalf("AddObject should not replace deleted versions")
+	}
+
+	res := httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("GET", "/trash", nil))
+	response := &JSONResponse{}
+	json.Unmarshal(res.Body.Bytes(), response)
+	if res.Code != http.StatusOK || len(response.Trash) != 1 {
+		t.Fatalf("GET /trash should return the deleted version. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	entry := response.Trash[0]
+	if entry.Name != "maps/de_dust.map" || entry.Version != "2" || entry.DeletedBy != "alice" || entry.PurgeAfter.Sub(entry.Deleted) != DefaultTrashGracePeriod {
+		t.Fatalf("GET /trash should describe the deleted version. Entry: %+v", entry)
+	}
+
+	res = httptest.NewRecorder()
+	api.Router.ServeHTTP(res, httptest.NewRequest("POST", "/maps/de_dust.map/2/restore", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("POST restore should restore the deleted version. Status code: %d, Body: %s", res.Code, res.Body.String())
+	}
+	body, err := objects.GetObject("maps/de_dust.map", "2", "")
+	if err != nil {
+		t.Fatalf("GetObject should return restored versions. Error: %v", err)
+	}
+	body.Close()
+	if body.Checksum == "" {
+		t.Fatalf("Restored versions should keep their checksum")
+	}
+	if err := objects.RestoreObjectVersion("maps/de_dust.map", "2", ""); err == nil {
+		t.Fatalf("RestoreObjectVersion should fail for versions that are not deleted")
+	}
+
+	// whole objects are hidden once deleted, and purged after the grace period
+	objects.trashGracePeriod = time.Millisecond
+	objects.DeleteObject("maps/de_dust.map", false, "bob")
+	if list, _ := objects.ListObjects("maps", "", ListOptions{}); len(list.Objects) != 0 {
+		t.Fatalf("ListObjects should not return deleted objects. Returned: %v", list.Objects)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if purged, _ := objects.PurgeTrash(true); len(purged) != 2 {
+		t.Fatalf("PurgeTrash should report both versions on a dry run. Returned: %v", purged)
+	}
+	if trash, _ := objects.ListTrash(); len(trash) != 2 {
+		t.Fatalf("PurgeTrash should not purge anything on a dry run. Trash: %v", trash)
+	}
+	if purged, err := objects.PurgeTrash(false); len(purged) != 2 || err != nil {
+		t.Fatalf("PurgeTrash should purge both versions. Returned: %v, %v", purged, err)
+	}
+	if err := objects.RestoreObjectVersion("maps/de_dust.map", "1", ""); err == nil {
+		t.Fatalf("RestoreObjectVersion should fail for purged versions")
+	}
+	if err := objects.AddObject("maps/de_dust.map", strings.NewReader("other content"), nil, nil, false, false, "2"); err != nil {
+		t.Fatalf("AddObject should reuse purged version names. Error: %v", err)
+	}
+}
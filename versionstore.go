@@ -0,0 +1,1162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// release channels every object has. Objects can have any number of other channels
+const (
+	// ProdChannel the channel served when no channel is requested
+	ProdChannel = "prod"
+	// DevChannel the channel for lower environments. Setting the prod version the original way also sets it
+	DevChannel = "dev"
+)
+
+// VersionStore stores the default versions of objects for each release channel
+type VersionStore interface {
+	// GetVersion returns the default version of objectName in channel
+	GetVersion(objectName string, channel string) (string, error)
+	// SetVersion sets the default version of objectName in channel, recording the change in its history
+	// as made by requester. The other channels are left alone
+	SetVersion(objectName string, channel string, version string, requester string) error
+	// SetProdVersion sets the prod and dev versions of objectName together like SetVersion, as setting
+	// the default version did before there were channels
+	SetProdVersion(objectName string, version string, requester string) error
+	// CompareAndSetVersion sets the default version of objectName in channel like SetVersion, but only
+	// if it is currently expected ("*" matches any version). Otherwise a VersionMismatchError is returned
+	CompareAndSetVersion(objectName string, channel string, expected string, version string, requester string) error
+	// PromoteVersion sets the default version of objectName in channel to to version like SetVersion, but only
+	// if version is currently the default of channel from. Otherwise a VersionMismatchError for from is returned
+	PromoteVersion(objectName string, from string, to string, version string, requester string) error
+	// GetDefaults returns the default versions of objectName, keyed by channel
+	GetDefaults(objectName string) (map[string]string, error)
+	// ClearVersion removes the default version of objectName in channel if it is currently expected,
+	// recording the change. Otherwise a VersionMismatchError is returned
+	ClearVersion(objectName string, channel string, expected string, requester string) error
+	// DeleteDefaults removes all default versions of objectName, recording the change of each channel
+	DeleteDefaults(objectName string, requester string) error
+	// GetHistory returns the changes made to the default versions of objectName, oldest first.
+	// Only the latest historyLimit changes are returned
+	GetHistory(objectName string) ([]VersionChange, error)
+	// AppendHistory records changes in the history of objectName
+	AppendHistory(objectName string, changes []VersionChange) error
+	// GetVersionInfo returns what was recorded about a version of objectName when it was added,
+	// or nil if nothing was recorded (versions added before checksums were recorded)
+	GetVersionInfo(objectName string, version string) (*VersionInfo, error)
+	// CreateVersionInfo records information about a new version of objectName. Exactly one of any
+	// concurrent calls for the same version succeeds, the others return ErrVersionExists
+	CreateVersionInfo(objectName string, version string, info *VersionInfo) error
+	// PutVersionInfo records information about a version of objectName, replacing what was recorded
+	PutVersionInfo(objectName string, version string, info *VersionInfo) error
+	// DeleteVersionInfo removes the information recorded about a version of objectName
+	DeleteVersionInfo(objectName string, version string) error
+	// GetTags returns the versions the tags of objectName point at, keyed by tag
+	GetTags(objectName string) (map[string]string, error)
+	// SetTag points tag of objectName at version, returning the version it pointed at before ("" if none)
+	SetTag(objectName string, tag string, version string) (string, error)
+	// DeleteTag removes tag of objectName, returning the version it pointed at.
+	// ErrTagNotFound is returned if the tag is not set
+	DeleteTag(objectName string, tag string) (string, error)
+	// DeleteTags removes every tag of objectName
+	DeleteTags(objectName string) error
+	// IndexVersion records a version of object objectName in categoryName in the index of categories,
+	// objects and versions the listings are served from, replacing what was recorded for it
+	IndexVersion(categoryName string, objectName string, entry IndexEntry) error
+	// UnindexVersion removes a version from the index, along with its object and category once they
+	// have no versions left
+	UnindexVersion(categoryName string, objectName string, version string) error
+	// ListIndexedCategories returns up to limit indexed categories starting with prefix sorted by name, starting after after
+	ListIndexedCategories(prefix string, after string, limit int) ([]string, error)
+	// ListIndexedObjects returns up to limit indexed objects of categoryName starting with prefix sorted by name,
+	// starting after after
+	ListIndexedObjects(categoryName string, prefix string, after string, limit int) ([]string, error)
+	// ListIndexedVersions returns up to limit indexed versions of object objectName in categoryName starting with prefix
+	// sorted by version, starting after after
+	ListIndexedVersions(categoryName string, objectName string, prefix string, after string, limit int) ([]IndexEntry, error)
+	// GetCategory returns the category registered as categoryName. ErrCategoryNotFound is returned if it is not registered
+	GetCategory(categoryName string) (*Category, error)
+	// CreateCategory registers a new category. ErrCategoryExists is returned if it is already registered
+	CreateCategory(category *Category) error
+	// PutCategory replaces a registered category. ErrCategoryNotFound is returned if it is not registered
+	PutCategory(category *Category) error
+}
+
+// IndexEntry a version of an object as recorded in the index
+type IndexEntry struct {
+	Version      string    `json:"version"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	// Created when the version was added
+	Created  time.Time `json:"created"`
+	Checksum string    `json:"checksum,omitempty"`
+}
+
+// ErrVersionExists is returned by VersionStore.CreateVersionInfo when the version already exists
+var ErrVersionExists = errors.New("Version already exists")
+
+// ErrTagNotFound is returned by VersionStore.DeleteTag when the tag is not set
+var ErrTagNotFound = errors.New("Tag not found")
+
+// ErrCategoryNotFound is returned by VersionStore.GetCategory and PutCategory when the category is not registered
+var ErrCategoryNotFound = errors.New("Category not found")
+
+// ErrCategoryExists is returned by VersionStore.CreateCategory when the category is already registered
+var ErrCategoryExists = errors.New("Category already exists")
+
+// VersionMismatchError is returned by VersionStore.CompareAndSetVersion when the default version is not the one expected
+type VersionMismatchError struct {
+	ObjectName string
+	Channel    string
+	Expected   string
+	// Current the default version, empty if there is none
+	Current string
+}
+
+func (e VersionMismatchError) Error() string {
+	current := e.Current
+	if len(current) == 0 {
+		current = "not set"
+	}
+	return fmt.Sprintf("Default %s version of object %s is %s, expected %s", e.Channel, e.ObjectName, current, e.Expected)
+}
+
+// VersionChange a change of the default version of an object in a channel, or with Action set,
+// another change to the object
+type VersionChange struct {
+	Time time.Time `json:"time"`
+	// Action what was done, empty for default changes
+	Action  string `json:"action,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	// Tag the tag changed by ActionTagged and ActionUntagged
+	Tag string `json:"tag,omitempty"`
+	// Previous the version before the change, empty if there was none
+	Previous string `json:"previous,omitempty"`
+	// Version the version after the change, empty if the default was removed
+	Version   string `json:"version,omitempty"`
+	Requester string `json:"requester,omitempty"`
+}
+
+// change actions
+const (
+	// ActionDeleted a version was deleted, or the whole object without a version
+	ActionDeleted = "deleted"
+	// ActionRestored a deleted version was restored from the trash
+	ActionRestored = "restored"
+	// ActionPurged a deleted version was removed from the trash for good
+	ActionPurged = "purged"
+	// ActionTagged a tag was pointed at a version
+	ActionTagged = "tagged"
+	// ActionUntagged a tag was removed
+	ActionUntagged = "untagged"
+)
+
+// historyLimit the number of latest changes returned from the history of each object
+const historyLimit = 500
+
+// channelChanges the changes made by setting the version of channels, given the versions of each channel
+// before the change, keyed by channelAttribute
+func channelChanges(channels []string, version string, requester string, previous map[string]string) []VersionChange {
+	now := time.Now().UTC()
+	changes := []VersionChange{}
+	for _, changed := range channels {
+		changes = append(changes, VersionChange{
+			Time:      now,
+			Channel:   changed,
+			Previous:  previous[channelAttribute(changed)],
+			Version:   version,
+			Requester: requester,
+		})
+	}
+	return changes
+}
+
+// version states
+const (
+	// VersionPending the version content is being uploaded
+	VersionPending = "pending"
+	// VersionReady the version content is stored and verified
+	VersionReady = "ready"
+	// VersionDeleted the version was deleted and its content moved to the trash, where it can be restored from
+	VersionDeleted = "deleted"
+)
+
+// pendingVersionTimeout how long a pending version blocks others from creating it. Uploads that are
+// interrupted without cleaning up (e.g. the server is killed) can be retried after this
+const pendingVersionTimeout = time.Hour
+
+// VersionInfo information recorded about an object version when it is added
+type VersionInfo struct {
+	State string `json:"state"`
+	// Checksum hex encoded SHA-256 of the version content, set once it is ready
+	Checksum string    `json:"checksum,omitempty"`
+	Created  time.Time `json:"created"`
+	// Deleted when the version was moved to the trash and DeletedBy by whom, set while it is VersionDeleted
+	Deleted   time.Time `json:"deleted"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+}
+
+// Pending returns true while the version content is being uploaded
+func (v VersionInfo) Pending() bool {
+	return v.State == VersionPending
+}
+
+// Trashed returns true while the version is deleted and can be restored
+func (v VersionInfo) Trashed() bool {
+	return v.State == VersionDeleted
+}
+
+// replaceable returns true if the version was abandoned while pending and may be created again
+func (v VersionInfo) replaceable(now time.Time) bool {
+	return v.Pending() && v.Created.Before(now.Add(-pendingVersionTimeout))
+}
+
+// channelAttribute the attribute of the item holding the defaults of an object that holds the version of channel.
+// prod and dev use the attributes they always have
+func channelAttribute(channel string) string {
+	switch channel {
+	case ProdChannel:
+		return "version"
+	case DevChannel:
+		return "dev"
+	}
+	return "channel_" + channel
+}
+
+// attributeChannel the channel whose version is held in attribute of the item holding the defaults of an object.
+// the inverse of channelAttribute, returns false for attributes that do not hold a channel version
+func attributeChannel(attribute string) (string, bool) {
+	switch attribute {
+	case "version":
+		return ProdChannel, true
+	case "dev":
+		return DevChannel, true
+	}
+	if strings.HasPrefix(attribute, "channel_") {
+		return strings.TrimPrefix(attribute, "channel_"), true
+	}
+	return "", false
+}
+
+// clearedChanges the changes made by removing the defaults of channels, given their versions before
+func clearedChanges(previous map[string]string, requester string) []VersionChange {
+	now := time.Now().UTC()
+	channels := []string{}
+	for channel := range previous {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	changes := []VersionChange{}
+	for _, channel := range channels {
+		changes = append(changes, VersionChange{Time: now, Channel: channel, Previous: previous[channel], Requester: requester})
+	}
+	return changes
+}
+
+// noVersionSet the error returned when an object has no default version in channel
+func noVersionSet(objectName string, channel string) error {
+	switch channel {
+	case ProdChannel:
+		return fmt.Errorf("No version set for object %s", objectName)
+	case DevChannel:
+		return fmt.Errorf("No dev version set for object %s", objectName)
+	}
+	return fmt.Errorf("No %s version set for object %s", channel, objectName)
+}
+
+// historyItemName the parent of the items in the children table holding the history of objectName, one per change,
+// and the name of the item that held the whole history before. It is kept apart from the item holding the defaults
+// so it outlives them. Object names never start with / so this can not collide
+func historyItemName(objectName string) string {
+	return "/history/" + objectName
+}
+
+// tagsItemName the name of the item holding the tags of objectName, apart from the defaults like the history
+func tagsItemName(objectName string) string {
+	return "/tags/" + objectName
+}
+
+// tagAttribute the attribute of the item holding the tags of an object that holds the version of tag.
+// prefixed so tags can not collide with the name key
+func tagAttribute(tag string) string {
+	return "tag_" + tag
+}
+
+// indexItemName the parent of the items of a level of the index in the children table: the categories for no names,
+// the objects of a category for its name, or the versions of an object for category and object name. The level below
+// an entry is named parent/entry. like the history these names start with / so they can not collide with objects
+func indexItemName(names ...string) string {
+	return strings.Join(append([]string{"/index"}, names...), "/")
+}
+
+// categoryItemName the name of the item holding the registration of categoryName, apart from its objects like the history
+func categoryItemName(categoryName string) string {
+	return "/categories/" + categoryName
+}
+
+// versionItemName the name of the item holding the info of a version of objectName.
+// object names are always category/object so these never collide with the item holding the defaults
+func versionItemName(objectName string, version string) string {
+	return fmt.Sprintf("%s/%s", objectName, version)
+}
+
+// DynamoVersionStore a VersionStore backed by a dynamodb table, with the index and history in a children table
+type DynamoVersionStore struct {
+	table *string
+	// children the table holding the items under a parent sorted by child, see childItem
+	children *string
+	ddb      dynamodbiface.DynamoDBAPI
+}
+
+// childrenTableName the name of the children table of the dynamodb table table
+func childrenTableName(table string) string {
+	return table + "-children"
+}
+
+// NewDynamoVersionStore returns a VersionStore for the dynamodb table table and its children table
+func NewDynamoVersionStore(table string) *DynamoVersionStore {
+	var sess = session.Must(session.NewSession())
+	return &DynamoVersionStore{
+		table:    aws.String(table),
+		children: aws.String(childrenTableName(table)),
+		ddb:      dynamodb.New(sess),
+	}
+}
+
+// SetVersion sets the default version of objectName in channel
+func (d DynamoVersionStore) SetVersion(objectName string, channel string, version string, requester string) error {
+	previous, err := d.updateChannel(d.channelUpdate(objectName, channel, version))
+	if err != nil {
+		return err
+	}
+	return d.AppendHistory(objectName, channelChanges([]string{channel}, version, requester, previous))
+}
+
+// SetProdVersion sets the prod and dev versions of objectName in a single update
+func (d DynamoVersionStore) SetProdVersion(objectName string, version string, requester string) error {
+	previous, err := d.updateChannel(withDevUpdate(d.channelUpdate(objectName, ProdChannel, version)))
+	if err != nil {
+		return err
+	}
+	return d.AppendHistory(objectName, channelChanges([]string{ProdChannel, DevChannel}, version, requester, previous))
+}
+
+// channelUpdate is a helper to generate the dynamodb updateItem input setting the version of channel.
+// only the attributes of the channels being set are updated, the other channels are left alone
+func (d DynamoVersionStore) channelUpdate(objectName string, channel string, version string) *dynamodb.UpdateItemInput {
+	input := &dynamodb.UpdateItemInput{
+		TableName: d.table,
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": &dynamodb.AttributeValue{S: aws.String(objectName)},
+		},
+		UpdateExpression:         aws.String("SET #channel = :version"),
+		ReturnValues:             aws.String(dynamodb.ReturnValueUpdatedOld),
+		ExpressionAttributeNames: map[string]*string{"#channel": aws.String(channelAttribute(channel))},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":version": &dynamodb.AttributeValue{S: aws.String(version)},
+		},
+	}
+	return input
+}
+
+// withDevUpdate extends a channelUpdate to set the dev version to the same version
+func withDevUpdate(input *dynamodb.UpdateItemInput) *dynamodb.UpdateItemInput {
+	input.UpdateExpression = aws.String(aws.StringValue(input.UpdateExpression) + ", #dev = :version")
+	input.ExpressionAttributeNames["#dev"] = aws.String(channelAttribute(DevChannel))
+	return input
+}
+
+// isRetryable helper function for determining whether an aws error is retryable
+func isRetryable(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case dynamodb.ErrCodeProvisionedThroughputExceededException:
+			return true
+		case dynamodb.ErrCodeInternalServerError:
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// isConditionFailed returns true if err is dynamodb refusing a write because its condition expression was false
+func isConditionFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// dynamoAttempts number of attempts made for dynamodb calls failing with retryable errors
+const dynamoAttempts = 2
+
+// withRetries runs call, backing off and retrying while it fails with retryable errors
+func withRetries(call func() error) error {
+	for i := 1; ; i++ {
+		err := call()
+		if err == nil || !isRetryable(err) || i >= dynamoAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(i) * time.Second)
+	}
+}
+
+// updates item in dynamodb
+// item primary key is name, also has a column for the version of each channel
+// setting the prod version sets the dev version to the same version
+func (d DynamoVersionStore) addObjectToDynamo(objectName string, channel string, version string) error {
+	input := d.channelUpdate(objectName, channel, version)
+	if channel == ProdChannel {
+		input = withDevUpdate(input)
+	}
+	_, err := d.updateChannel(input)
+	return err
+}
+
+// updateChannel runs a channelUpdate, returning the channel versions it replaced
+func (d DynamoVersionStore) updateChannel(input *dynamodb.UpdateItemInput) (map[string]string, error) {
+	previous := map[string]string{}
+	err := withRetries(func() error {
+		res, err := d.ddb.UpdateItem(input)
+		if err != nil {
+			return err
+		}
+		for name, value := range res.Attributes {
+			previous[name] = aws.StringValue(value.S)
+		}
+		return nil
+	})
+	return previous, err
+}
+
+// historyRetention how long the changes in the dynamodb history of an object are kept before the table TTL removes them
+const historyRetention = 365 * 24 * time.Hour
+
+// historySuffix a random suffix for the sort keys of changes, so changes written at the same time by
+// different instances can not overwrite each other
+func historySuffix() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hex.EncodeToString(suffix)
+}
+
+// AppendHistory records each change in an item of its own in the history of objectName, sorted by time,
+// so appending is a small write that can not race other writers. Changes expire after historyRetention
+func (d DynamoVersionStore) AppendHistory(objectName string, changes []VersionChange) error {
+	suffix := historySuffix()
+	for i, change := range changes {
+		// changes made together keep their order
+		child := fmt.Sprintf("%s/%03d/%s", change.Time.UTC().Format(dynamoTimeFormat), i, suffix)
+		item := childItem(historyItemName(objectName), child)
+		item["time"] = &dynamodb.AttributeValue{S: aws.String(change.Time.UTC().Format(dynamoTimeFormat))}
+		item["expires"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(change.Time.Add(historyRetention).Unix(), 10))}
+		// dynamodb does not store empty strings
+		for name, value := range map[string]string{
+			"action":    change.Action,
+			"channel":   change.Channel,
+			"tag":       change.Tag,
+			"previous":  change.Previous,
+			"version":   change.Version,
+			"requester": change.Requester,
+		} {
+			if len(value) > 0 {
+				item[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+			}
+		}
+		err := withRetries(func() error {
+			_, err := d.ddb.PutItem(&dynamodb.PutItemInput{
+				TableName:                d.children,
+				Item:                     item,
+				ConditionExpression:      aws.String("attribute_not_exists(#child)"),
+				ExpressionAttributeNames: map[string]*string{"#child": aws.String("child")},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyChange reads a change from the attributes it was recorded with
+func historyChange(attributes map[string]*dynamodb.AttributeValue) VersionChange {
+	change := VersionChange{}
+	for name, value := range attributes {
+		switch name {
+		case "time":
+			change.Time, _ = time.Parse(time.RFC3339Nano, aws.StringValue(value.S))
+		case "action":
+			change.Action = aws.StringValue(value.S)
+		case "channel":
+			change.Channel = aws.StringValue(value.S)
+		case "tag":
+			change.Tag = aws.StringValue(value.S)
+		case "previous":
+			change.Previous = aws.StringValue(value.S)
+		case "version":
+			change.Version = aws.StringValue(value.S)
+		case "requester":
+			change.Requester = aws.StringValue(value.S)
+		}
+	}
+	return change
+}
+
+// GetHistory returns the latest historyLimit changes made to objectName, oldest first. Changes recorded before
+// each change had an item of its own are read from the item that held the whole history.
+// the changes are read consistently, so retention and lookups as of a time see changes made moments ago
+func (d DynamoVersionStore) GetHistory(objectName string) ([]VersionChange, error) {
+	legacy, err := d.getObjectFromDynamo(historyItemName(objectName))
+	if err != nil {
+		return nil, err
+	}
+	items, err := d.queryChildren(historyItemName(objectName), "", "", historyLimit, true)
+	if err != nil {
+		return nil, err
+	}
+	changes := []VersionChange{}
+	if legacy["changes"] != nil {
+		for _, entry := range legacy["changes"].L {
+			changes = append(changes, historyChange(entry.M))
+		}
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		changes = append(changes, historyChange(items[i]))
+	}
+	if len(changes) > historyLimit {
+		changes = changes[len(changes)-historyLimit:]
+	}
+	return changes, nil
+}
+
+func (d DynamoVersionStore) getObjectFromDynamo(objectName string) (map[string]*dynamodb.AttributeValue, error) {
+	var item map[string]*dynamodb.AttributeValue
+	err := withRetries(func() error {
+		res, err := d.ddb.GetItem(&dynamodb.GetItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(objectName)},
+			},
+			TableName: d.table,
+		})
+		if err != nil {
+			return err
+		}
+		item = res.Item
+		return nil
+	})
+	return item, err
+}
+
+// CompareAndSetVersion sets the default version of objectName in channel with a conditional update
+// that only succeeds if the current version is expected
+func (d DynamoVersionStore) CompareAndSetVersion(objectName string, channel string, expected string, version string, requester string) error {
+	input := d.channelUpdate(objectName, channel, version)
+	if expected == "*" {
+		input.ConditionExpression = aws.String("attribute_exists(#channel)")
+	} else {
+		input.ConditionExpression = aws.String("#channel = :expected")
+		input.ExpressionAttributeValues[":expected"] = &dynamodb.AttributeValue{S: aws.String(expected)}
+	}
+	previous, err := d.updateChannel(input)
+	if isConditionFailed(err) {
+		// report the version that made the condition fail
+		current, _ := d.GetVersion(objectName, channel)
+		return VersionMismatchError{ObjectName: objectName, Channel: channel, Expected: expected, Current: current}
+	} else if err != nil {
+		return err
+	}
+	return d.AppendHistory(objectName, channelChanges([]string{channel}, version, requester, previous))
+}
+
+// PromoteVersion sets the default version of objectName in channel to with an update conditional on the
+// version of channel from. Both are attributes of the same item, so the check and update are atomic
+func (d DynamoVersionStore) PromoteVersion(objectName string, from string, to string, version string, requester string) error {
+	input := d.channelUpdate(objectName, to, version)
+	input.ConditionExpression = aws.String("#from = :from")
+	input.ExpressionAttributeNames["#from"] = aws.String(channelAttribute(from))
+	input.ExpressionAttributeValues[":from"] = &dynamodb.AttributeValue{S: aws.String(version)}
+	previous, err := d.updateChannel(input)
+	if isConditionFailed(err) {
+		current, _ := d.GetVersion(objectName, from)
+		return VersionMismatchError{ObjectName: objectName, Channel: from, Expected: version, Current: current}
+	} else if err != nil {
+		return err
+	}
+	return d.AppendHistory(objectName, channelChanges([]string{to}, version, requester, previous))
+}
+
+// GetDefaults returns the default versions of objectName, keyed by channel
+func (d DynamoVersionStore) GetDefaults(objectName string) (map[string]string, error) {
+	item, err := d.getObjectFromDynamo(objectName)
+	if err != nil {
+		return nil, err
+	}
+	defaults := map[string]string{}
+	for attribute, value := range item {
+		if channel, ok := attributeChannel(attribute); ok {
+			defaults[channel] = aws.StringValue(value.S)
+		}
+	}
+	return defaults, nil
+}
+
+// ClearVersion removes the default version of objectName in channel with an update conditional on it being expected
+func (d DynamoVersionStore) ClearVersion(objectName string, channel string, expected string, requester string) error {
+	err := withRetries(func() error {
+		_, err := d.ddb.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: d.table,
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(objectName)},
+			},
+			UpdateExpression:         aws.String("REMOVE #channel"),
+			ConditionExpression:      aws.String("#channel = :expected"),
+			ExpressionAttributeNames: map[string]*string{"#channel": aws.String(channelAttribute(channel))},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":expected": &dynamodb.AttributeValue{S: aws.String(expected)},
+			},
+		})
+		return err
+	})
+	if isConditionFailed(err) {
+		current, _ := d.GetVersion(objectName, channel)
+		return VersionMismatchError{ObjectName: objectName, Channel: channel, Expected: expected, Current: current}
+	} else if err != nil {
+		return err
+	}
+	return d.AppendHistory(objectName, clearedChanges(map[string]string{channel: expected}, requester))
+}
+
+// DeleteDefaults deletes the item holding the defaults of objectName
+func (d DynamoVersionStore) DeleteDefaults(objectName string, requester string) error {
+	previous := map[string]string{}
+	err := withRetries(func() error {
+		res, err := d.ddb.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: d.table,
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(objectName)},
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+		})
+		if err != nil {
+			return err
+		}
+		for attribute, value := range res.Attributes {
+			if channel, ok := attributeChannel(attribute); ok {
+				previous[channel] = aws.StringValue(value.S)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(previous) == 0 {
+		return err
+	}
+	return d.AppendHistory(objectName, clearedChanges(previous, requester))
+}
+
+// GetVersion returns the default version of objectName in channel
+func (d DynamoVersionStore) GetVersion(objectName string, channel string) (string, error) {
+	item, err := d.getObjectFromDynamo(objectName)
+	if err != nil {
+		return "", err
+	}
+	val, ok := item[channelAttribute(channel)]
+	if ok {
+		return *val.S, nil
+	}
+	return "", noVersionSet(objectName, channel)
+}
+
+// dynamoTimeFormat fixed width timestamp format, so stored times can be compared in condition expressions
+const dynamoTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// versionInfoItem the dynamodb item holding info for version of objectName
+func versionInfoItem(objectName string, version string, info *VersionInfo) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"name":    &dynamodb.AttributeValue{S: aws.String(versionItemName(objectName, version))},
+		"state":   &dynamodb.AttributeValue{S: aws.String(info.State)},
+		"created": &dynamodb.AttributeValue{S: aws.String(info.Created.UTC().Format(dynamoTimeFormat))},
+	}
+	if len(info.Checksum) > 0 {
+		item["checksum"] = &dynamodb.AttributeValue{S: aws.String(info.Checksum)}
+	}
+	if !info.Deleted.IsZero() {
+		item["deleted"] = &dynamodb.AttributeValue{S: aws.String(info.Deleted.UTC().Format(dynamoTimeFormat))}
+	}
+	if len(info.DeletedBy) > 0 {
+		item["deletedBy"] = &dynamodb.AttributeValue{S: aws.String(info.DeletedBy)}
+	}
+	return item
+}
+
+// GetVersionInfo returns the info recorded for version of objectName, nil if there is none
+func (d DynamoVersionStore) GetVersionInfo(objectName string, version string) (*VersionInfo, error) {
+	item, err := d.getObjectFromDynamo(versionItemName(objectName, version))
+	if err != nil {
+		return nil, err
+	}
+	if len(item) == 0 {
+		return nil, nil
+	}
+	info := &VersionInfo{State: VersionReady}
+	if state, ok := item["state"]; ok {
+		info.State = aws.StringValue(state.S)
+	}
+	if checksum, ok := item["checksum"]; ok {
+		info.Checksum = aws.StringValue(checksum.S)
+	}
+	if created, ok := item["created"]; ok {
+		info.Created, _ = time.Parse(time.RFC3339Nano, aws.StringValue(created.S))
+	}
+	if deleted, ok := item["deleted"]; ok {
+		info.Deleted, _ = time.Parse(time.RFC3339Nano, aws.StringValue(deleted.S))
+	}
+	if deletedBy, ok := item["deletedBy"]; ok {
+		info.DeletedBy = aws.StringValue(deletedBy.S)
+	}
+	return info, nil
+}
+
+// CreateVersionInfo records info for a new version of objectName with a conditional put,
+// which only succeeds if there is no item for the version or it was abandoned while pending
+func (d DynamoVersionStore) CreateVersionInfo(objectName string, version string, info *VersionInfo) error {
+	stale := time.Now().Add(-pendingVersionTimeout).UTC().Format(dynamoTimeFormat)
+	err := withRetries(func() error {
+		_, err := d.ddb.PutItem(&dynamodb.PutItemInput{
+			TableName:           d.table,
+			Item:                versionInfoItem(objectName, version, info),
+			ConditionExpression: aws.String("attribute_not_exists(#name) OR #state = :pending AND #created < :stale"),
+			ExpressionAttributeNames: map[string]*string{
+				"#name":    aws.String("name"),
+				"#state":   aws.String("state"),
+				"#created": aws.String("created"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pending": &dynamodb.AttributeValue{S: aws.String(VersionPending)},
+				":stale":   &dynamodb.AttributeValue{S: aws.String(stale)},
+			},
+		})
+		return err
+	})
+	if isConditionFailed(err) {
+		return ErrVersionExists
+	}
+	return err
+}
+
+// PutVersionInfo records info for version of objectName in its own item
+func (d DynamoVersionStore) PutVersionInfo(objectName string, version string, info *VersionInfo) error {
+	return withRetries(func() error {
+		_, err := d.ddb.PutItem(&dynamodb.PutItemInput{
+			TableName: d.table,
+			Item:      versionInfoItem(objectName, version, info),
+		})
+		return err
+	})
+}
+
+// DeleteVersionInfo deletes the item holding info for version of objectName
+func (d DynamoVersionStore) DeleteVersionInfo(objectName string, version string) error {
+	return withRetries(func() error {
+		_, err := d.ddb.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: d.table,
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(versionItemName(objectName, version))},
+			},
+		})
+		return err
+	})
+}
+
+// GetTags returns the versions the tags of objectName point at, keyed by tag
+func (d DynamoVersionStore) GetTags(objectName string) (map[string]string, error) {
+	item, err := d.getObjectFromDynamo(tagsItemName(objectName))
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for attribute, value := range item {
+		if strings.HasPrefix(attribute, "tag_") {
+			tags[strings.TrimPrefix(attribute, "tag_")] = aws.StringValue(value.S)
+		}
+	}
+	return tags, nil
+}
+
+// SetTag points tag of objectName at version, returning the version it pointed at before
+func (d DynamoVersionStore) SetTag(objectName string, tag string, version string) (string, error) {
+	var previous string
+	err := withRetries(func() error {
+		res, err := d.ddb.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: d.table,
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(tagsItemName(objectName))},
+			},
+			UpdateExpression:         aws.String("SET #tag = :version"),
+			ExpressionAttributeNames: map[string]*string{"#tag": aws.String(tagAttribute(tag))},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":version": &dynamodb.AttributeValue{S: aws.String(version)},
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueUpdatedOld),
+		})
+		if err != nil {
+			return err
+		}
+		if old, ok := res.Attributes[tagAttribute(tag)]; ok {
+			previous = aws.StringValue(old.S)
+		}
+		return nil
+	})
+	return previous, err
+}
+
+// DeleteTag removes tag of objectName with an update conditional on it being set
+func (d DynamoVersionStore) DeleteTag(objectName string, tag string) (string, error) {
+	var previous string
+	err := withRetries(func() error {
+		res, err := d.ddb.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: d.table,
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(tagsItemName(objectName))},
+			},
+			UpdateExpression:         aws.String("REMOVE #tag"),
+			ConditionExpression:      aws.String("attribute_exists(#tag)"),
+			ExpressionAttributeNames: map[string]*string{"#tag": aws.String(tagAttribute(tag))},
+			ReturnValues:             aws.String(dynamodb.ReturnValueUpdatedOld),
+		})
+		if err != nil {
+			return err
+		}
+		if old, ok := res.Attributes[tagAttribute(tag)]; ok {
+			previous = aws.StringValue(old.S)
+		}
+		return nil
+	})
+	if isConditionFailed(err) {
+		return "", ErrTagNotFound
+	}
+	return previous, err
+}
+
+// DeleteTags deletes the item holding the tags of objectName
+func (d DynamoVersionStore) DeleteTags(objectName string) error {
+	return withRetries(func() error {
+		_, err := d.ddb.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: d.table,
+			Key: map[string]*dynamodb.AttributeValue{
+				"name": &dynamodb.AttributeValue{S: aws.String(tagsItemName(objectName))},
+			},
+		})
+		return err
+	})
+}
+
+// childItem the key of the item of child under parent in the children table, keyed by parent and child so the
+// items under a parent are queried sorted by child: the entries of each level of the listing index and the changes
+// in the history of each object. each entry is an item of its own, so no item grows with the number of entries
+func childItem(parent string, child string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"parent": &dynamodb.AttributeValue{S: aws.String(parent)},
+		"child":  &dynamodb.AttributeValue{S: aws.String(child)},
+	}
+}
+
+// queryChildren returns up to limit items under parent whose child starts with prefix, sorted by child and
+// starting after after, or the other way round starting before after if descending. the query is strongly
+// consistent, so items written or deleted moments ago are reflected
+func (d DynamoVersionStore) queryChildren(parent string, prefix string, after string, limit int, descending bool) ([]map[string]*dynamodb.AttributeValue, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                d.children,
+		ConsistentRead:           aws.Bool(true),
+		KeyConditionExpression:   aws.String("#parent = :parent"),
+		ExpressionAttributeNames: map[string]*string{"#parent": aws.String("parent")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":parent": &dynamodb.AttributeValue{S: aws.String(parent)},
+		},
+		ScanIndexForward: aws.Bool(!descending),
+	}
+	if len(prefix) > 0 {
+		input.KeyConditionExpression = aws.String("#parent = :parent AND begins_with(#child, :prefix)")
+		input.ExpressionAttributeNames["#child"] = aws.String("child")
+		input.ExpressionAttributeValues[":prefix"] = &dynamodb.AttributeValue{S: aws.String(prefix)}
+	}
+	// the start key only sets the position, the item does not have to exist
+	if len(after) > 0 {
+		input.ExclusiveStartKey = childItem(parent, after)
+	}
+	items := []map[string]*dynamodb.AttributeValue{}
+	for len(items) < limit {
+		input.Limit = aws.Int64(int64(limit - len(items)))
+		var res *dynamodb.QueryOutput
+		err := withRetries(func() error {
+			var err error
+			res, err = d.ddb.Query(input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, res.Items...)
+		// queries return at most 1MB at a time
+		if len(res.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+	return items, nil
+}
+
+// putIndexEntry writes the index item of child under parent, with attributes recording the entry
+func (d DynamoVersionStore) putIndexEntry(parent string, child string, attributes map[string]*dynamodb.AttributeValue) error {
+	item := childItem(parent, child)
+	for name, value := range attributes {
+		item[name] = value
+	}
+	return withRetries(func() error {
+		_, err := d.ddb.PutItem(&dynamodb.PutItemInput{
+			TableName: d.children,
+			Item:      item,
+		})
+		return err
+	})
+}
+
+// deleteIndexEntry deletes the index item of child under parent
+func (d DynamoVersionStore) deleteIndexEntry(parent string, child string) error {
+	return withRetries(func() error {
+		_, err := d.ddb.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: d.children,
+			Key:       childItem(parent, child),
+		})
+		return err
+	})
+}
+
+// hasIndexEntries whether the index level parent has any entries left
+func (d DynamoVersionStore) hasIndexEntries(parent string) (bool, error) {
+	items, err := d.queryChildren(parent, "", "", 1, false)
+	return len(items) > 0, err
+}
+
+// removeEmptyIndexEntry deletes the index item of child under parent if the level below it has no entries,
+// returning whether it was deleted. Indexing writes the entries of a level before the entry leading to it, so
+// the level is checked again once the entry is deleted: an entry added in the meantime either shows up and the
+// deleted entry is written back, or was added after the delete and is followed by writing the entry itself
+func (d DynamoVersionStore) removeEmptyIndexEntry(parent string, child string) (bool, error) {
+	level := parent + "/" + child
+	if left, err := d.hasIndexEntries(level); err != nil || left {
+		return false, err
+	}
+	if err := d.deleteIndexEntry(parent, child); err != nil {
+		return false, err
+	}
+	left, err := d.hasIndexEntries(level)
+	if err == nil && !left {
+		return true, nil
+	}
+	// when in doubt the entry is written back, an empty entry is listed rather than entries hidden
+	if putErr := d.putIndexEntry(parent, child, nil); putErr != nil && err == nil {
+		err = putErr
+	}
+	return false, err
+}
+
+// IndexVersion records the version, then its object and category, so listed entries always lead to versions
+func (d DynamoVersionStore) IndexVersion(categoryName string, objectName string, entry IndexEntry) error {
+	attributes := map[string]*dynamodb.AttributeValue{
+		"size":         &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(entry.Size, 10))},
+		"lastModified": &dynamodb.AttributeValue{S: aws.String(entry.LastModified.UTC().Format(dynamoTimeFormat))},
+		"created":      &dynamodb.AttributeValue{S: aws.String(entry.Created.UTC().Format(dynamoTimeFormat))},
+	}
+	if len(entry.Checksum) > 0 {
+		attributes["checksum"] = &dynamodb.AttributeValue{S: aws.String(entry.Checksum)}
+	}
+	if err := d.putIndexEntry(indexItemName(categoryName, objectName), entry.Version, attributes); err != nil {
+		return err
+	}
+	if err := d.putIndexEntry(indexItemName(categoryName), objectName, nil); err != nil {
+		return err
+	}
+	return d.putIndexEntry(indexItemName(), categoryName, nil)
+}
+
+// UnindexVersion removes the version, then its object and category if they are left empty
+func (d DynamoVersionStore) UnindexVersion(categoryName string, objectName string, version string) error {
+	if err := d.deleteIndexEntry(indexItemName(categoryName, objectName), version); err != nil {
+		return err
+	}
+	removed, err := d.removeEmptyIndexEntry(indexItemName(categoryName), objectName)
+	if err != nil || !removed {
+		return err
+	}
+	_, err = d.removeEmptyIndexEntry(indexItemName(), categoryName)
+	return err
+}
+
+// listIndexEntries returns up to limit entries of the index level parent starting with prefix sorted by name,
+// starting after after
+func (d DynamoVersionStore) listIndexEntries(parent string, prefix string, after string, limit int) ([]string, error) {
+	items, err := d.queryChildren(parent, prefix, after, limit, false)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, item := range items {
+		names = append(names, aws.StringValue(item["child"].S))
+	}
+	return names, nil
+}
+
+// ListIndexedCategories returns up to limit indexed categories starting with prefix sorted by name, starting after after
+func (d DynamoVersionStore) ListIndexedCategories(prefix string, after string, limit int) ([]string, error) {
+	return d.listIndexEntries(indexItemName(), prefix, after, limit)
+}
+
+// ListIndexedObjects returns up to limit indexed objects of categoryName starting with prefix sorted by name,
+// starting after after
+func (d DynamoVersionStore) ListIndexedObjects(categoryName string, prefix string, after string, limit int) ([]string, error) {
+	return d.listIndexEntries(indexItemName(categoryName), prefix, after, limit)
+}
+
+// ListIndexedVersions returns up to limit indexed versions of objectName starting with prefix sorted by version,
+// starting after after
+func (d DynamoVersionStore) ListIndexedVersions(categoryName string, objectName string, prefix string, after string, limit int) ([]IndexEntry, error) {
+	items, err := d.queryChildren(indexItemName(categoryName, objectName), prefix, after, limit, false)
+	if err != nil {
+		return nil, err
+	}
+	entries := []IndexEntry{}
+	for _, item := range items {
+		entry := IndexEntry{Version: aws.StringValue(item["child"].S)}
+		if size, ok := item["size"]; ok {
+			entry.Size, _ = strconv.ParseInt(aws.StringValue(size.N), 10, 64)
+		}
+		if lastModified, ok := item["lastModified"]; ok {
+			entry.LastModified, _ = time.Parse(time.RFC3339Nano, aws.StringValue(lastModified.S))
+		}
+		if created, ok := item["created"]; ok {
+			entry.Created, _ = time.Parse(time.RFC3339Nano, aws.StringValue(created.S))
+		}
+		if checksum, ok := item["checksum"]; ok {
+			entry.Checksum = aws.StringValue(checksum.S)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// categoryItem the dynamodb item holding the registration of category
+func categoryItem(category *Category) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"name":     &dynamodb.AttributeValue{S: aws.String(categoryItemName(category.Name))},
+		"category": &dynamodb.AttributeValue{S: aws.String(category.Name)},
+		"maxSize":  &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(category.MaxSize, 10))},
+	}
+	// empty strings can not be stored
+	for attribute, value := range map[string]string{"owner": category.Owner, "description": category.Description, "versionPattern": category.VersionPattern} {
+		if len(value) > 0 {
+			item[attribute] = &dynamodb.AttributeValue{S: aws.String(value)}
+		}
+	}
+	if len(category.ContentTypes) > 0 {
+		contentTypes := []*dynamodb.AttributeValue{}
+		for _, contentType := range category.ContentTypes {
+			contentTypes = append(contentTypes, &dynamodb.AttributeValue{S: aws.String(contentType)})
+		}
+		item["contentTypes"] = &dynamodb.AttributeValue{L: contentTypes}
+	}
+	if category.RequireRegisteredObjects {
+		item["requireRegisteredObjects"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	if len(category.Objects) > 0 {
+		objects := []*dynamodb.AttributeValue{}
+		for _, object := range category.Objects {
+			objects = append(objects, &dynamodb.AttributeValue{S: aws.String(object)})
+		}
+		item["objects"] = &dynamodb.AttributeValue{L: objects}
+	}
+	return item
+}
+
+// GetCategory returns the category registered as categoryName, or ErrCategoryNotFound
+func (d DynamoVersionStore) GetCategory(categoryName string) (*Category, error) {
+	item, err := d.getObjectFromDynamo(categoryItemName(categoryName))
+	if err != nil {
+		return nil, err
+	}
+	if len(item) == 0 {
+		return nil, ErrCategoryNotFound
+	}
+	category := &Category{Name: categoryName}
+	if owner, ok := item["owner"]; ok {
+		category.Owner = aws.StringValue(owner.S)
+	}
+	if description, ok := item["description"]; ok {
+		category.Description = aws.StringValue(description.S)
+	}
+	if versionPattern, ok := item["versionPattern"]; ok {
+		category.VersionPattern = aws.StringValue(versionPattern.S)
+	}
+	if maxSize, ok := item["maxSize"]; ok {
+		category.MaxSize, _ = strconv.ParseInt(aws.StringValue(maxSize.N), 10, 64)
+	}
+	if contentTypes, ok := item["contentTypes"]; ok {
+		for _, contentType := range contentTypes.L {
+			category.ContentTypes = append(category.ContentTypes, aws.StringValue(contentType.S))
+		}
+	}
+	if requireRegisteredObjects, ok := item["requireRegisteredObjects"]; ok {
+		category.RequireRegisteredObjects = aws.BoolValue(requireRegisteredObjects.BOOL)
+	}
+	if objects, ok := item["objects"]; ok {
+		for _, object := range objects.L {
+			category.Objects = append(category.Objects, aws.StringValue(object.S))
+		}
+	}
+	return category, nil
+}
+
+// putCategory writes the item of category if condition holds for the item already there
+func (d DynamoVersionStore) putCategory(category *Category, condition string) error {
+	return withRetries(func() error {
+		_, err := d.ddb.PutItem(&dynamodb.PutItemInput{
+			TableName:                d.table,
+			Item:                     categoryItem(category),
+			ConditionExpression:      aws.String(condition),
+			ExpressionAttributeNames: map[string]*string{"#name": aws.String("name")},
+		})
+		return err
+	})
+}
+
+// CreateCategory registers category with a put conditional on it not being registered yet
+func (d DynamoVersionStore) CreateCategory(category *Category) error {
+	err := d.putCategory(category, "attribute_not_exists(#name)")
+	if isConditionFailed(err) {
+		return ErrCategoryExists
+	}
+	return err
+}
+
+// PutCategory replaces category with a put conditional on it being registered
+func (d DynamoVersionStore) PutCategory(category *Category) error {
+	err := d.putCategory(category, "attribute_exists(#name)")
+	if isConditionFailed(err) {
+		return ErrCategoryNotFound
+	}
+	return err
+}
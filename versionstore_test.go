@@ -0,0 +1,710 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+type MockDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	items []map[string]*dynamodb.AttributeValue
+	// putItemErr errors returned by PutItem and UpdateItem calls
+	putItemErr []error
+	// getItemErr errors returned by GetItem and Query calls
+	getItemErr []error
+	// queryPageSize the most items each Query call returns, no limit but the request's if 0
+	queryPageSize int
+	// deleting is called with the key of each item before DeleteItem deletes it, to interleave other calls
+	deleting func(key string)
+}
+
+// itemKey the key of an item of either table: its name, or parent/child for the children table
+func itemKey(key map[string]*dynamodb.AttributeValue) string {
+	if key["name"] != nil {
+		return *key["name"].S
+	}
+	return *key["parent"].S + "/" + *key["child"].S
+}
+
+// findItem returns the latest item with key key
+func (d *MockDynamo) findItem(key string) map[string]*dynamodb.AttributeValue {
+	var found map[string]*dynamodb.AttributeValue
+	for _, item := range d.items {
+		if itemKey(item) == key {
+			found = item
+		}
+	}
+	return found
+}
+
+// evalCondition evaluates the condition expressions used by DynamoVersionStore against item:
+// attribute_exists / attribute_not_exists and comparisons (=, <>, <, >) joined by AND / OR
+func evalCondition(expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue, item map[string]*dynamodb.AttributeValue) bool {
+	attribute := func(name string) *dynamodb.AttributeValue {
+		if real, ok := names[name]; ok {
+			name = *real
+		}
+		return item[name]
+	}
+	for _, or := range strings.Split(expression, " OR ") {
+		matches := true
+		for _, term := range strings.Split(or, " AND ") {
+			term = strings.Trim(strings.TrimSpace(term), "()")
+			if strings.HasPrefix(term, "attribute_not_exists(") {
+				matches = matches && attribute(strings.TrimPrefix(term, "attribute_not_exists(")) == nil
+				continue
+			}
+			if strings.HasPrefix(term, "attribute_exists(") {
+				matches = matches && attribute(strings.TrimPrefix(term, "attribute_exists(")) != nil
+				continue
+			}
+			parts := strings.Fields(term)
+			current := attribute(parts[0])
+			if current == nil {
+				matches = matches && parts[1] == "<>"
+				continue
+			}
+			left, right := aws.StringValue(current.S)+aws.StringValue(current.N), aws.StringValue(values[parts[2]].S)+aws.StringValue(values[parts[2]].N)
+			switch parts[1] {
+			case "=":
+				matches = matches && left == right
+			case "<>":
+				matches = matches && left != right
+			case "<":
+				matches = matches && left < right
+			case ">":
+				matches = matches && left > right
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// writeErr returns the next error queued for PutItem / UpdateItem calls, if any
+func (d *MockDynamo) writeErr() error {
+	if len(d.putItemErr) == 0 || d.putItemErr[0] == nil {
+		return nil
+	}
+	err := d.putItemErr[0]
+	d.putItemErr = d.putItemErr[1:]
+	return err
+}
+
+func (d *MockDynamo) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if err := d.writeErr(); err != nil {
+		return nil, err
+	}
+	existing := d.findItem(itemKey(input.Item))
+	if input.ConditionExpression != nil && !evalCondition(*input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, existing) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", errors.New("ok"))
+	}
+	d.items = append(d.items, input.Item)
+	return nil, nil
+}
+
+// splitTopLevel splits expression on commas outside of parentheses
+func splitTopLevel(expression string) []string {
+	parts := []string{}
+	depth, start := 0, 0
+	for i, c := range expression {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(expression[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(expression[start:]))
+}
+
+// UpdateItem applies the update expressions used by DynamoVersionStore: SET of values or
+// list_append(if_not_exists(...)), and REMOVE of list elements
+func (d *MockDynamo) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if err := d.writeErr(); err != nil {
+		return nil, err
+	}
+	existing := d.findItem(*input.Key["name"].S)
+	if input.ConditionExpression != nil && !evalCondition(*input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, existing) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "condition failed", errors.New("ok"))
+	}
+	realName := func(name string) string {
+		if real, ok := input.ExpressionAttributeNames[name]; ok {
+			return *real
+		}
+		return name
+	}
+	item := map[string]*dynamodb.AttributeValue{"name": input.Key["name"]}
+	for name, value := range existing {
+		item[name] = value
+	}
+	updated := []string{}
+	expression := *input.UpdateExpression
+	if strings.HasPrefix(expression, "REMOVE ") {
+		removed := map[string]map[int]bool{}
+		for _, path := range splitTopLevel(strings.TrimPrefix(expression, "REMOVE ")) {
+			open := strings.Index(path, "[")
+			if open < 0 {
+				delete(item, realName(path))
+				updated = append(updated, realName(path))
+				continue
+			}
+			index, _ := strconv.Atoi(strings.TrimSuffix(path[open+1:], "]"))
+			name := realName(path[:open])
+			if removed[name] == nil {
+				removed[name] = map[int]bool{}
+			}
+			removed[name][index] = true
+		}
+		for name, indexes := range removed {
+			kept := []*dynamodb.AttributeValue{}
+			for i, value := range item[name].L {
+				if !indexes[i] {
+					kept = append(kept, value)
+				}
+			}
+			item[name] = &dynamodb.AttributeValue{L: kept}
+		}
+	} else {
+		for _, assignment := range splitTopLevel(strings.TrimPrefix(expression, "SET ")) {
+			parts := strings.SplitN(assignment, " = ", 2)
+			name := realName(parts[0])
+			value := parts[1]
+			if strings.HasPrefix(value, "list_append(if_not_exists(") {
+				// list_append(if_not_exists(#a, :empty), :values)
+				args := strings.Split(strings.TrimSuffix(strings.TrimPrefix(value, "list_append(if_not_exists("), ")"), ", ")
+				list := input.ExpressionAttributeValues[strings.TrimSuffix(args[1], ")")].L
+				if current := item[realName(args[0])]; current != nil {
+					list = current.L
+				}
+				appended := append(append([]*dynamodb.AttributeValue{}, list...), input.ExpressionAttributeValues[args[2]].L...)
+				item[name] = &dynamodb.AttributeValue{L: appended}
+			} else {
+				item[name] = input.ExpressionAttributeValues[value]
+			}
+			updated = append(updated, name)
+		}
+	}
+	d.items = append(d.items, item)
+
+	output := &dynamodb.UpdateItemOutput{Attributes: map[string]*dynamodb.AttributeValue{}}
+	for _, name := range updated {
+		switch aws.StringValue(input.ReturnValues) {
+		case dynamodb.ReturnValueUpdatedOld:
+			if existing[name] != nil {
+				output.Attributes[name] = existing[name]
+			}
+		case dynamodb.ReturnValueUpdatedNew:
+			output.Attributes[name] = item[name]
+		}
+	}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllNew {
+		output.Attributes = item
+	}
+	return output, nil
+}
+
+// readErr returns the next error queued for GetItem / Query calls, if any
+func (d *MockDynamo) readErr() error {
+	if len(d.getItemErr) == 0 || d.getItemErr[0] == nil {
+		return nil
+	}
+	err := d.getItemErr[0]
+	d.getItemErr = d.getItemErr[1:]
+	return err
+}
+
+func (d *MockDynamo) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if err := d.readErr(); err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{
+		Item: d.findItem(*input.Key["name"].S),
+	}, nil
+}
+
+// Query lists the items of the children table under :parent sorted by child, applying begins_with(#child, :prefix),
+// ExclusiveStartKey, ScanIndexForward and Limit
+func (d *MockDynamo) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	if err := d.readErr(); err != nil {
+		return nil, err
+	}
+	latest := map[string]map[string]*dynamodb.AttributeValue{}
+	for _, item := range d.items {
+		latest[itemKey(item)] = item
+	}
+	parent := aws.StringValue(input.ExpressionAttributeValues[":parent"].S)
+	prefix := ""
+	if value, ok := input.ExpressionAttributeValues[":prefix"]; ok {
+		prefix = aws.StringValue(value.S)
+	}
+	forward := input.ScanIndexForward == nil || *input.ScanIndexForward
+	start := ""
+	if input.ExclusiveStartKey != nil {
+		start = aws.StringValue(input.ExclusiveStartKey["child"].S)
+	}
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range latest {
+		if item["parent"] == nil || aws.StringValue(item["parent"].S) != parent {
+			continue
+		}
+		child := aws.StringValue(item["child"].S)
+		if !strings.HasPrefix(child, prefix) || len(start) > 0 && (forward && child <= start || !forward && child >= start) {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return (aws.StringValue(items[i]["child"].S) < aws.StringValue(items[j]["child"].S)) == forward
+	})
+	limit := int(aws.Int64Value(input.Limit))
+	if d.queryPageSize > 0 && (limit == 0 || d.queryPageSize < limit) {
+		limit = d.queryPageSize
+	}
+	output := &dynamodb.QueryOutput{Items: items}
+	if limit > 0 && len(items) > limit {
+		output.Items = items[:limit]
+		last := items[limit-1]
+		output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{"parent": last["parent"], "child": last["child"]}
+	}
+	return output, nil
+}
+
+func (d *MockDynamo) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	key := itemKey(input.Key)
+	if d.deleting != nil {
+		d.deleting(key)
+	}
+	output := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		output.Attributes = d.findItem(key)
+	}
+	kept := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range d.items {
+		if itemKey(item) != key {
+			kept = append(kept, item)
+		}
+	}
+	d.items = kept
+	return output, nil
+}
+
+func mockDynamoStore(m *MockDynamo) *DynamoVersionStore {
+	return &DynamoVersionStore{
+		table:    aws.String("unit test"),
+		children: aws.String(childrenTableName("unit test")),
+		ddb:      m,
+	}
+}
+
+func TestAddObjectToDynamo(t *testing.T) {
+	mocker := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			items: []map[string]*dynamodb.AttributeValue{},
+		},
+	}
+
+	mocker.addObjectToDynamo("prod object", ProdChannel, "123")
+	mocker.addObjectToDynamo("dev object", DevChannel, "456")
+
+	prodObjectVersion, err := mocker.GetVersion("prod object", ProdChannel)
+	if err != nil || prodObjectVersion != "123" {
+		t.Fatalf("addObjectToDynamo should have set version to: %+v. Is: %+v", "123", prodObjectVersion)
+	}
+	prodObjectDevVersion, err := mocker.GetVersion("prod object", DevChannel)
+	if err != nil || prodObjectDevVersion != "123" {
+		t.Fatalf("addObjectToDynamo should have set dev version to: %+v. Is: %+v", "123", prodObjectDevVersion)
+	}
+
+	devObjectVersion, err := mocker.GetVersion("dev object", ProdChannel)
+	if err == nil {
+		t.Fatalf("addObjectToDynamo should not have set prod version when new object is created for dev: Prod version: %s", devObjectVersion)
+	}
+	devObjectDevVersion, err := mocker.GetVersion("dev object", DevChannel)
+	if err != nil || devObjectDevVersion != "456" {
+		t.Fatalf("addObjectToDynamo should have set dev version to: %+v. Is: %+v", "456", devObjectDevVersion)
+	}
+}
+
+func TestAddObjectToDynamoRetries(t *testing.T) {
+	retryable := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			putItemErr: []error{
+				awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "foo", errors.New("ok")),
+			},
+		},
+	}
+
+	err := retryable.addObjectToDynamo("unite test", ProdChannel, "yup")
+	if err != nil {
+		t.Fatalf("ProvisionedThroughPutExceeded errors should be retried. Received error: %v", err.Error())
+	}
+
+	notRetryable := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			putItemErr: []error{
+				errors.New("hot dang"),
+			},
+		},
+	}
+	err = notRetryable.addObjectToDynamo("unite test", ProdChannel, "yup")
+	if err == nil {
+		t.Fatalf("non aws errors should returned. Did not receive error")
+	}
+
+	exceedRetries := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			putItemErr: []error{
+				awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "poo", errors.New("ok")),
+				awserr.New(dynamodb.ErrCodeInternalServerError, "poo", errors.New("ok")),
+				awserr.New(dynamodb.ErrCodeBackupInUseException, "poo", errors.New("ok")),
+				awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "poo", errors.New("ok")),
+			},
+		},
+	}
+	err = exceedRetries.addObjectToDynamo("unite test", ProdChannel, "yup")
+	if err == nil {
+		t.Fatalf("error should be returned when retries are exceeded. Did not receive error")
+	}
+}
+
+func TestGetObjectFromDynamoRetries(t *testing.T) {
+	retryable := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			getItemErr: []error{
+				awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "poo", errors.New("ok")),
+			},
+		},
+	}
+	retryable.addObjectToDynamo("unit test", ProdChannel, "123")
+	_, err := retryable.getObjectFromDynamo("unit test")
+	if err != nil {
+		t.Fatalf("ProvisionedThroughPutExceeded errors should be retried. Received error: %v", err.Error())
+	}
+
+	notRetryable := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			getItemErr: []error{
+				errors.New("hot dang"),
+			},
+		},
+	}
+	notRetryable.addObjectToDynamo("unit test", ProdChannel, "123")
+	_, err = notRetryable.getObjectFromDynamo("unit test")
+	if err == nil {
+		t.Fatalf("non aws errors should returned. Did not receive error")
+	}
+
+	exceedRetries := DynamoVersionStore{
+		table: aws.String("unit test"),
+		ddb: &MockDynamo{
+			getItemErr: []error{
+				awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "poo", errors.New("ok")),
+				awserr.New(dynamodb.ErrCodeInternalServerError, "poo", errors.New("ok")),
+				awserr.New(dynamodb.ErrCodeBackupInUseException, "poo", errors.New("ok")),
+				awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "poo", errors.New("ok")),
+			},
+		},
+	}
+	err = exceedRetries.addObjectToDynamo("unit test", ProdChannel, "yup")
+	_, err = exceedRetries.getObjectFromDynamo("unit test")
+	if err == nil {
+		t.Fatalf("error should be returned when retries are exceeded. Did not receive error")
+	}
+}
+
+func TestDynamoCreateVersionInfo(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	if err := mocker.CreateVersionInfo("fun/foo.obj", "1", &VersionInfo{State: VersionPending, Created: time.Now()}); err != nil {
+		t.Fatalf("CreateVersionInfo returned an error: %v", err)
+	}
+	if err := mocker.CreateVersionInfo("fun/foo.obj", "1", &VersionInfo{State: VersionPending, Created: time.Now()}); err != ErrVersionExists {
+		t.Fatalf("CreateVersionInfo should return ErrVersionExists for pending versions. Returned: %v", err)
+	}
+	info, _ := mocker.GetVersionInfo("fun/foo.obj", "1")
+	if info == nil || !info.Pending() {
+		t.Fatalf("GetVersionInfo should return the pending version. Is: %+v", info)
+	}
+
+	// abandoned uploads can be retried
+	mocker.PutVersionInfo("fun/foo.obj", "2", &VersionInfo{State: VersionPending, Created: time.Now().Add(-2 * pendingVersionTimeout)})
+	if err := mocker.CreateVersionInfo("fun/foo.obj", "2", &VersionInfo{State: VersionPending, Created: time.Now()}); err != nil {
+		t.Fatalf("CreateVersionInfo should replace abandoned pending versions. Returned: %v", err)
+	}
+	// ready versions can not be replaced however old they are
+	mocker.PutVersionInfo("fun/foo.obj", "3", &VersionInfo{State: VersionReady, Created: time.Now().Add(-2 * pendingVersionTimeout)})
+	if err := mocker.CreateVersionInfo("fun/foo.obj", "3", &VersionInfo{State: VersionPending, Created: time.Now()}); err != ErrVersionExists {
+		t.Fatalf("CreateVersionInfo should return ErrVersionExists for ready versions. Returned: %v", err)
+	}
+
+	mocker.DeleteVersionInfo("fun/foo.obj", "1")
+	if info, _ := mocker.GetVersionInfo("fun/foo.obj", "1"); info != nil {
+		t.Fatalf("DeleteVersionInfo should remove the version info. Is: %+v", info)
+	}
+}
+
+func TestDynamoCompareAndSetVersion(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	mocker.SetProdVersion("fun/foo.obj", "1", "unit test")
+	err := mocker.CompareAndSetVersion("fun/foo.obj", ProdChannel, "2", "3", "unit test")
+	if mismatch, ok := err.(VersionMismatchError); !ok || mismatch.Current != "1" {
+		t.Fatalf("CompareAndSetVersion should return the current version when it does not match. Returned: %v", err)
+	}
+	if err := mocker.CompareAndSetVersion("fun/foo.obj", ProdChannel, "*", "3", "unit test"); err != nil {
+		t.Fatalf("CompareAndSetVersion should set the version when any version is expected. Returned: %v", err)
+	}
+	if version, _ := mocker.GetVersion("fun/foo.obj", ProdChannel); version != "3" {
+		t.Fatalf("CompareAndSetVersion should have set the version to 3. Is: %s", version)
+	}
+	// setting prod did not change dev
+	if err := mocker.CompareAndSetVersion("fun/foo.obj", DevChannel, "1", "4", "unit test"); err != nil {
+		t.Fatalf("CompareAndSetVersion should set the dev version when it matches. Returned: %v", err)
+	}
+}
+
+func TestDynamoChannels(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	mocker.SetVersion("fun/foo.obj", ProdChannel, "1", "unit test")
+	mocker.SetVersion("fun/foo.obj", "staging", "2", "unit test")
+	mocker.SetVersion("fun/foo.obj", DevChannel, "3", "unit test")
+
+	for channel, expected := range map[string]string{ProdChannel: "1", "staging": "2", DevChannel: "3"} {
+		if version, err := mocker.GetVersion("fun/foo.obj", channel); version != expected {
+			t.Fatalf("Setting a channel should leave the other channels alone. %s version should be %s. Is: %s (%v)", channel, expected, version, err)
+		}
+	}
+	if _, err := mocker.GetVersion("fun/foo.obj", "canary"); err == nil {
+		t.Fatalf("GetVersion should return an error for channels with no version set")
+	}
+}
+
+func TestDynamoHistory(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	mocker.SetProdVersion("fun/foo.obj", "1", "alice")
+	mocker.CompareAndSetVersion("fun/foo.obj", ProdChannel, "1", "2", "bob")
+	mocker.SetVersion("fun/foo.obj", "staging", "3", "carol")
+
+	history, err := mocker.GetHistory("fun/foo.obj")
+	if err != nil {
+		t.Fatalf("GetHistory returned an error: %v", err)
+	}
+	// setting prod and dev together records both changes, setting the prod channel only the one
+	expected := []VersionChange{
+		{Channel: ProdChannel, Version: "1", Requester: "alice"},
+		{Channel: DevChannel, Version: "1", Requester: "alice"},
+		{Channel: ProdChannel, Previous: "1", Version: "2", Requester: "bob"},
+		{Channel: "staging", Version: "3", Requester: "carol"},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("GetHistory should return %d changes. Returned: %+v", len(expected), history)
+	}
+	for i, change := range history {
+		if change.Time.IsZero() {
+			t.Fatalf("GetHistory should return the time of each change. Returned: %+v", change)
+		}
+		change.Time = time.Time{}
+		if change != expected[i] {
+			t.Fatalf("GetHistory change %d should be %+v. Is: %+v", i, expected[i], change)
+		}
+	}
+
+	// only the latest historyLimit changes are kept
+	for i := 0; i < historyLimit; i++ {
+		mocker.SetVersion("fun/bar.obj", "staging", strconv.Itoa(i), "")
+	}
+	mocker.SetVersion("fun/bar.obj", "staging", "last", "")
+	history, _ = mocker.GetHistory("fun/bar.obj")
+	if len(history) != historyLimit || history[0].Version != "1" || history[historyLimit-1].Version != "last" {
+		t.Fatalf("GetHistory should only return the latest %d changes. Returned %d, from %+v", historyLimit, len(history), history[0])
+	}
+}
+
+func TestDynamoHistoryItems(t *testing.T) {
+	mock := &MockDynamo{}
+	mocker := mockDynamoStore(mock)
+
+	// changes recorded before each change had an item of its own come first
+	mock.items = append(mock.items, map[string]*dynamodb.AttributeValue{
+		"name": &dynamodb.AttributeValue{S: aws.String(historyItemName("fun/foo.obj"))},
+		"changes": &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{
+			&dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+				"time":    &dynamodb.AttributeValue{S: aws.String("2018-10-01T12:00:00.000000000Z")},
+				"channel": &dynamodb.AttributeValue{S: aws.String(ProdChannel)},
+				"version": &dynamodb.AttributeValue{S: aws.String("1")},
+			}},
+		}},
+	})
+	mocker.SetVersion("fun/foo.obj", "staging", "2", "alice")
+	history, err := mocker.GetHistory("fun/foo.obj")
+	if err != nil || len(history) != 2 || history[0].Version != "1" || history[1].Version != "2" || history[1].Requester != "alice" {
+		t.Fatalf("GetHistory should return the changes of the old history item before the new ones. History: %+v, Error: %v", history, err)
+	}
+
+	changes := 0
+	for _, item := range mock.items {
+		if item["parent"] != nil && aws.StringValue(item["parent"].S) == historyItemName("fun/foo.obj") {
+			changes++
+			expires, _ := strconv.ParseInt(aws.StringValue(item["expires"].N), 10, 64)
+			if time.Unix(expires, 0).Before(time.Now().Add(historyRetention - time.Hour)) {
+				t.Fatalf("History items should expire after historyRetention. Item: %v", item)
+			}
+		}
+	}
+	if changes != 1 {
+		t.Fatalf("AppendHistory should write an item per change. Items: %d", changes)
+	}
+}
+
+func TestDynamoPromoteVersion(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	mocker.SetVersion("fun/foo.obj", DevChannel, "1", "unit test")
+	err := mocker.PromoteVersion("fun/foo.obj", DevChannel, "staging", "2", "unit test")
+	if mismatch, ok := err.(VersionMismatchError); !ok || mismatch.Channel != DevChannel || mismatch.Current != "1" {
+		t.Fatalf("PromoteVersion should return the current version of the from channel when it changed. Returned: %v", err)
+	}
+	if err := mocker.PromoteVersion("fun/foo.obj", DevChannel, "staging", "1", "unit test"); err != nil {
+		t.Fatalf("PromoteVersion should promote the current version. Returned: %v", err)
+	}
+	if version, _ := mocker.GetVersion("fun/foo.obj", "staging"); version != "1" {
+		t.Fatalf("PromoteVersion should have set the staging version to 1. Is: %s", version)
+	}
+}
+
+func TestDynamoTags(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	mocker.SetProdVersion("fun/foo.obj", "1", "unit test")
+	if previous, err := mocker.SetTag("fun/foo.obj", "lts", "1"); err != nil || previous != "" {
+		t.Fatalf("SetTag should set new tags. Previous: %s, Error: %v", previous, err)
+	}
+	if previous, _ := mocker.SetTag("fun/foo.obj", "lts", "2"); previous != "1" {
+		t.Fatalf("SetTag should return the version the tag pointed at. Previous: %s", previous)
+	}
+	mocker.SetTag("fun/foo.obj", "approved-by-qa", "2")
+	tags, err := mocker.GetTags("fun/foo.obj")
+	if err != nil || len(tags) != 2 || tags["lts"] != "2" {
+		t.Fatalf("GetTags should return both tags. Tags: %v, Error: %v", tags, err)
+	}
+	// tags are kept apart from the defaults
+	if defaults, _ := mocker.GetDefaults("fun/foo.obj"); len(defaults) != 2 {
+		t.Fatalf("Tags should not be returned as defaults. Defaults: %v", defaults)
+	}
+	if previous, err := mocker.DeleteTag("fun/foo.obj", "lts"); err != nil || previous != "2" {
+		t.Fatalf("DeleteTag should return the version the tag pointed at. Previous: %s, Error: %v", previous, err)
+	}
+	if _, err := mocker.DeleteTag("fun/foo.obj", "lts"); err != ErrTagNotFound {
+		t.Fatalf("DeleteTag should return ErrTagNotFound for missing tags. Returned: %v", err)
+	}
+	mocker.DeleteTags("fun/foo.obj")
+	if tags, _ := mocker.GetTags("fun/foo.obj"); len(tags) != 0 {
+		t.Fatalf("DeleteTags should remove every tag. Tags: %v", tags)
+	}
+}
+
+func TestDynamoIndex(t *testing.T) {
+	// queries return a page at a time, as they do for results over 1MB
+	mock := &MockDynamo{queryPageSize: 1}
+	mocker := mockDynamoStore(mock)
+
+	for _, version := range []string{"1", "2", "3", "31"} {
+		mocker.IndexVersion("fun", "foo.obj", IndexEntry{Version: version, Size: 42, Checksum: "abc"})
+	}
+	mocker.IndexVersion("fun", "bar.obj", IndexEntry{Version: "1"})
+	// each version is an item of its own
+	if item := mock.findItem("/index/fun/foo.obj/2"); item == nil || aws.StringValue(item["child"].S) != "2" || aws.StringValue(item["size"].N) != "42" {
+		t.Fatalf("IndexVersion should write an item per version. Item: %v", item)
+	}
+	entries, err := mocker.ListIndexedVersions("fun", "foo.obj", "", "1", 1)
+	if err != nil || len(entries) != 1 || entries[0].Version != "2" || entries[0].Size != 42 || entries[0].Checksum != "abc" {
+		t.Fatalf("ListIndexedVersions should return the version after 1. Entries: %+v, Error: %v", entries, err)
+	}
+	entries, _ = mocker.ListIndexedVersions("fun", "foo.obj", "3", "", 10)
+	if len(entries) != 2 || entries[0].Version != "3" || entries[1].Version != "31" {
+		t.Fatalf("ListIndexedVersions should return every version starting with the prefix across query pages. Entries: %+v", entries)
+	}
+	if objects, _ := mocker.ListIndexedObjects("fun", "", "", 10); strings.Join(objects, ",") != "bar.obj,foo.obj" {
+		t.Fatalf("ListIndexedObjects should return both objects. Objects: %v", objects)
+	}
+
+	mocker.UnindexVersion("fun", "bar.obj", "1")
+	if objects, _ := mocker.ListIndexedObjects("fun", "", "", 10); strings.Join(objects, ",") != "foo.obj" {
+		t.Fatalf("UnindexVersion should remove objects without versions. Objects: %v", objects)
+	}
+	for _, version := range []string{"1", "2", "3", "31"} {
+		mocker.UnindexVersion("fun", "foo.obj", version)
+	}
+	if categories, _ := mocker.ListIndexedCategories("", "", 10); len(categories) != 0 {
+		t.Fatalf("UnindexVersion should remove categories without objects. Categories: %v", categories)
+	}
+
+	// a version indexed while the last one is removed keeps its object and category listed
+	mocker.IndexVersion("fun", "foo.obj", IndexEntry{Version: "1"})
+	mock.deleting = func(key string) {
+		if key == "/index/fun/foo.obj" {
+			mock.deleting = nil
+			mocker.IndexVersion("fun", "foo.obj", IndexEntry{Version: "2"})
+		}
+	}
+	if err := mocker.UnindexVersion("fun", "foo.obj", "1"); err != nil {
+		t.Fatalf("UnindexVersion should not fail when a version is indexed meanwhile. Returned: %v", err)
+	}
+	if objects, _ := mocker.ListIndexedObjects("fun", "", "", 10); strings.Join(objects, ",") != "foo.obj" {
+		t.Fatalf("UnindexVersion should keep objects a version was indexed to meanwhile. Objects: %v", objects)
+	}
+	if categories, _ := mocker.ListIndexedCategories("", "", 10); strings.Join(categories, ",") != "fun" {
+		t.Fatalf("UnindexVersion should keep the category of objects a version was indexed to meanwhile. Categories: %v", categories)
+	}
+}
+
+func TestDynamoCategories(t *testing.T) {
+	mocker := mockDynamoStore(&MockDynamo{})
+
+	if _, err := mocker.GetCategory("maps"); err != ErrCategoryNotFound {
+		t.Fatalf("GetCategory should return ErrCategoryNotFound for categories that are not registered. Returned: %v", err)
+	}
+	if err := mocker.PutCategory(&Category{Name: "maps"}); err != ErrCategoryNotFound {
+		t.Fatalf("PutCategory should return ErrCategoryNotFound for categories that are not registered. Returned: %v", err)
+	}
+	maps := &Category{Name: "maps", Owner: "mappers", ContentTypes: []string{"application/zip", "application/gzip"}, MaxSize: 1024, VersionPattern: "semver"}
+	if err := mocker.CreateCategory(maps); err != nil {
+		t.Fatalf("CreateCategory should register new categories. Returned: %v", err)
+	}
+	if err := mocker.CreateCategory(maps); err != ErrCategoryExists {
+		t.Fatalf("CreateCategory should return ErrCategoryExists for registered categories. Returned: %v", err)
+	}
+	category, err := mocker.GetCategory("maps")
+	if err != nil || category.Owner != "mappers" || category.MaxSize != 1024 || category.VersionPattern != "semver" || strings.Join(category.ContentTypes, ",") != "application/zip,application/gzip" {
+		t.Fatalf("GetCategory should return the registered category. Category: %+v, Error: %v", category, err)
+	}
+	mocker.PutCategory(&Category{Name: "maps", Description: "game maps", RequireRegisteredObjects: true, Objects: []string{"de_dust.map"}})
+	if category, _ := mocker.GetCategory("maps"); category.Owner != "" || category.Description != "game maps" || len(category.ContentTypes) != 0 || !category.RequireRegisteredObjects || strings.Join(category.Objects, ",") != "de_dust.map" {
+		t.Fatalf("PutCategory should replace the category. Category: %+v", category)
+	}
+}